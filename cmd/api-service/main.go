@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"eric-cw-hsu.github.io/internal/api/config"
 	"eric-cw-hsu.github.io/internal/api/routes"
 	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/outbox"
 	"eric-cw-hsu.github.io/internal/rabbitmq"
+	"eric-cw-hsu.github.io/internal/resource"
 	"eric-cw-hsu.github.io/internal/shared/logger"
 	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"eric-cw-hsu.github.io/internal/shared/metrics"
 	"go.uber.org/zap"
 )
 
@@ -18,14 +25,15 @@ func main() {
 	}
 
 	cfg := config.Load()
+	metrics.Register()
+	metrics.RegisterOutbox()
 
-	// Initialize MongoDB connection
-	mongoService, err := database.NewMongoService(cfg.Mongo.URI, cfg.Mongo.Database)
-	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
-	}
-	defer mongoService.Close()
-	planCollection := mongoService.GetCollection("plans")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Initialize the node store and the outbox sharing its database
+	nodeStore, planOutbox, closeStore := openNodeStore(ctx, cfg)
+	defer closeStore()
 
 	// Initialize RabbitMQ connection
 	rabbitmqConn, err := rabbitmq.NewMQConnection(cfg.RabbitMQ.URI)
@@ -33,14 +41,89 @@ func main() {
 		logger.Logger.Fatal("Failed to connect to RabbitMQ", zap.Error(err))
 	}
 	defer rabbitmqConn.Close()
-	publisher, err := messagequeue.NewPublisher(rabbitmqConn.Channel, cfg.RabbitMQ.Exchange)
+	publisher := messagequeue.NewPublisher(cfg.RabbitMQ.Exchange, cfg.RabbitMQ.ConfirmTimeout)
+	if err := rabbitmqConn.Attach(publisher); err != nil {
+		logger.Logger.Fatal("Failed to create RabbitMQ publisher", zap.Error(err))
+	}
+
+	// Initialize the relay publishing the outbox entries to RabbitMQ
+	relay := outbox.NewRelay(planOutbox, publisher, cfg.Outbox.PollInterval, cfg.Outbox.BatchSize)
+	relay.Start(ctx)
 
 	redisService := database.NewRedisService(cfg.Redis.URI)
 	defer redisService.Close()
 	redisClient := redisService.GetClient()
 
-	router := routes.NewRouter(planCollection, publisher, redisClient, cfg)
+	// Initialize ElasticSearch Client for the search endpoints
+	esClient, err := elasticsearch.NewElasticSearchClient(
+		cfg.ElasticSearch.Addr,
+		cfg.ElasticSearch.Username,
+		cfg.ElasticSearch.Password,
+		cfg.ElasticSearch.Index,
+	)
+	if err != nil {
+		logger.Logger.Fatal("Failed to create ElasticSearch client", zap.Error(err))
+	}
+
+	router := routes.NewRouter(nodeStore, planOutbox, relay, redisClient, esClient, resource.NewDefaultRegistry(), cfg)
 	if err := router.Run(":" + cfg.Server.Port); err != nil {
 		logger.Logger.Fatal("Failed to start server", zap.Error(err))
 	}
 }
+
+/*
+openNodeStore opens the node store backend selected by node_store.backend, with the outbox in the
+same database so node writes and their events commit together. The returned func closes it.
+*/
+func openNodeStore(ctx context.Context, cfg *config.Config) (nodestore.NodeStore, outbox.Store, func()) {
+	switch cfg.NodeStore.Backend {
+	case "", "mongo":
+		mongoService, err := database.NewMongoService(cfg.Mongo.URI, cfg.Mongo.Database)
+		if err != nil {
+			log.Fatalf("Failed to connect to MongoDB: %v", err)
+		}
+		planCollection := mongoService.GetCollection("plans")
+		mongoStore := nodestore.NewMongoStore(planCollection, mongoService.GetCollection("plan_versions"))
+
+		// Derive the edge sets of nodes stored before reference tracking used them
+		if err := mongoStore.EnsureIndexes(ctx); err != nil {
+			logger.Logger.Fatal("Failed to initialize plan storage", zap.Error(err))
+		}
+		if backfilled, err := storage.BackfillEdges(ctx, planCollection); err != nil {
+			logger.Logger.Fatal("Failed to backfill node edges", zap.Error(err))
+		} else if backfilled > 0 {
+			logger.Logger.Info("Backfilled node edges", zap.Int("nodes", backfilled))
+		}
+		if backfilled, err := storage.BackfillCreationDates(ctx, planCollection); err != nil {
+			logger.Logger.Fatal("Failed to backfill creation dates", zap.Error(err))
+		} else if backfilled > 0 {
+			logger.Logger.Info("Backfilled creation dates", zap.Int("nodes", backfilled))
+		}
+
+		planOutbox := outbox.NewOutbox(mongoService.GetCollection("outbox"))
+		if err := planOutbox.EnsureIndexes(ctx); err != nil {
+			logger.Logger.Fatal("Failed to initialize outbox", zap.Error(err))
+		}
+		return mongoStore, planOutbox, mongoService.Close
+
+	case database.DriverSQLite, database.DriverPostgres:
+		sqlService, err := database.NewSQLService(cfg.NodeStore.Backend, cfg.NodeStore.DSN)
+		if err != nil {
+			log.Fatalf("Failed to open %s node store: %v", cfg.NodeStore.Backend, err)
+		}
+
+		sqlStore := nodestore.NewSQLStore(sqlService.GetDB())
+		if err := sqlStore.EnsureSchema(ctx); err != nil {
+			logger.Logger.Fatal("Failed to initialize plan storage", zap.Error(err))
+		}
+		planOutbox := outbox.NewSQLOutbox(sqlService.GetDB())
+		if err := planOutbox.EnsureSchema(ctx); err != nil {
+			logger.Logger.Fatal("Failed to initialize outbox", zap.Error(err))
+		}
+		return sqlStore, planOutbox, sqlService.Close
+
+	default:
+		log.Fatalf("Unknown node_store.backend %q, expected mongo, sqlite or postgres", cfg.NodeStore.Backend)
+		return nil, nil, nil
+	}
+}
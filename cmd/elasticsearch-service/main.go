@@ -2,46 +2,70 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 
 	"eric-cw-hsu.github.io/internal/elasticsearch"
 	"eric-cw-hsu.github.io/internal/elasticsearch/config"
 	"eric-cw-hsu.github.io/internal/rabbitmq"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
 	"eric-cw-hsu.github.io/internal/shared/messagequeue"
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	if err := logger.InitLogger(); err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+
 	cfg := config.Load()
 
+	// Initialize ElasticSearch Client, the bulk indexer is closed after the consumer
+	esClient, err := elasticsearch.NewElasticSearchClient(
+		cfg.ElasticSearch.Addr,
+		cfg.ElasticSearch.Username,
+		cfg.ElasticSearch.Password,
+		cfg.ElasticSearch.Index,
+	)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create ElasticSearch client: %v", err))
+	}
+
+	bulkIndexer := elasticsearch.NewBulkIndexer(esClient, cfg.ElasticSearch.Bulk)
+	defer bulkIndexer.Close()
+
+	// Deliveries are acked once their bulk item is flushed, with fewer in flight than a batch
+	// the buffer never fills and every batch waits for the flush interval
+	prefetch := cfg.RabbitMQ.Prefetch
+	if prefetch == 0 {
+		prefetch = bulkIndexer.FlushSize()
+	}
+	if prefetch < bulkIndexer.FlushSize() {
+		panic(fmt.Sprintf("rabbitmq.prefetch (%d) must be at least elastic_search.bulk.flush_size (%d)", prefetch, bulkIndexer.FlushSize()))
+	}
+
 	// Initialize RabbitMQ Consumer
 	rabbitMQConn, err := rabbitmq.NewMQConnection(cfg.RabbitMQ.URI)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to connect to RabbitMQ: %v", err))
 	}
 	defer rabbitMQConn.Close()
-	rabbitMQConsumer, err := messagequeue.NewConsumer(
-		rabbitMQConn.Channel,
+	rabbitMQConsumer := messagequeue.NewConsumer(
 		cfg.RabbitMQ.Exchange,
 		cfg.RabbitMQ.Queue,
+		prefetch,
+		cfg.RabbitMQ.Retry,
 		"plan.node.create",
 		"plan.node.update",
 		"plan.node.delete",
 	)
-	if err != nil {
+	if err := rabbitMQConn.Attach(rabbitMQConsumer); err != nil {
 		panic(fmt.Sprintf("Failed to create RabbitMQ consumer: %v", err))
 	}
 	defer rabbitMQConsumer.Close()
 
-	// Initialize ElasticSearch Client
-	esClient, err := elasticsearch.NewElasticSearchClient(
-		cfg.ElasticSearch.Addr,
-		cfg.ElasticSearch.Username,
-		cfg.ElasticSearch.Password,
-		cfg.ElasticSearch.Index,
-	)
-
-	elasticsearch.Start(rabbitMQConsumer, esClient)
+	elasticsearch.Start(rabbitMQConsumer, esClient, bulkIndexer, resource.NewDefaultRegistry())
 
 	// Start the health check server
 	fmt.Println("Starting health check server...")
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/objectstore/fsck"
+	"eric-cw-hsu.github.io/internal/objectstore/fsck/config"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+)
+
+func main() {
+	fix := flag.Bool("fix", false, "repair edge sets and garbage-collect unreachable nodes")
+	flag.Parse()
+
+	if err := logger.InitLogger(); err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	cfg := config.Load()
+
+	mongoService, err := database.NewMongoService(cfg.Mongo.URI, cfg.Mongo.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer mongoService.Close()
+	planCollection := mongoService.GetCollection("plans")
+
+	ctx := context.Background()
+	report, err := fsck.Check(ctx, planCollection)
+	if err != nil {
+		log.Fatalf("Check failed: %v", err)
+	}
+
+	for _, issue := range report.Issues {
+		fmt.Printf("%-15s %s: %s\n", issue.Kind, issue.NodeID, issue.Detail)
+	}
+	fmt.Printf("\n%d nodes, %d plans\n", report.Nodes, report.Roots)
+	for _, kind := range []string{fsck.IssueDanglingRef, fsck.IssueMissingParent, fsck.IssueParentLink, fsck.IssueEdgeMismatch, fsck.IssueUnreachable} {
+		fmt.Printf("  %-15s %d\n", kind, report.Count(kind))
+	}
+
+	if !*fix {
+		if len(report.Issues) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	indices := []string{}
+	for _, res := range resource.NewDefaultRegistry().All() {
+		indices = append(indices, res.Index)
+	}
+	result, err := fsck.Fix(ctx, planCollection, outbox.NewOutbox(mongoService.GetCollection("outbox")), indices, report)
+	if err != nil {
+		log.Fatalf("Fix failed: %v", err)
+	}
+
+	fmt.Printf("\nrepaired %d edge sets, removed %d nodes, skipped %d changed nodes\n", result.EdgesRepaired, len(result.Removed), len(result.Skipped))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/reconcile"
+	"eric-cw-hsu.github.io/internal/reconcile/config"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const defaultInterval = time.Hour
+
+func main() {
+	once := flag.Bool("once", false, "run a single reconciliation, print the report and exit")
+	repair := flag.Bool("repair", false, "republish missing and stale nodes and delete orphaned documents (default: reconcile.repair)")
+	flag.Parse()
+
+	if err := logger.InitLogger(); err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	cfg := config.Load()
+	*repair = *repair || cfg.Reconcile.Repair
+
+	mongoService, err := database.NewMongoService(cfg.Mongo.URI, cfg.Mongo.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer mongoService.Close()
+
+	esClient, err := elasticsearch.NewElasticSearchClient(
+		cfg.ElasticSearch.Addr,
+		cfg.ElasticSearch.Username,
+		cfg.ElasticSearch.Password,
+		cfg.ElasticSearch.Index,
+	)
+	if err != nil {
+		log.Fatalf("Failed to create ElasticSearch client: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reconciler := reconcile.NewReconciler(
+		resource.NewDefaultRegistry().All(),
+		mongoService.GetCollection("plans"),
+		outbox.NewOutbox(mongoService.GetCollection("outbox")),
+		esClient,
+		cfg.ElasticSearch.Bulk,
+		cfg.Reconcile.BatchSize,
+	)
+
+	if *once {
+		report, err := reconciler.Run(ctx, *repair)
+		if err != nil {
+			logger.Logger.Error("Reconciliation failed", zap.Error(err))
+			os.Exit(1)
+		}
+		fmt.Printf("nodes: %d, documents: %d, in sync: %d\n", report.Nodes, report.Documents, report.InSync)
+		fmt.Printf("missing (%d): %v\nstale (%d): %v\norphaned (%d): %v\n",
+			len(report.Missing), report.Missing, len(report.Stale), report.Stale, len(report.Orphaned), report.Orphaned)
+		if *repair {
+			fmt.Printf("republished: %d, deleted: %d\n", report.Republished, report.Deleted)
+		}
+		return
+	}
+
+	metrics.RegisterReconcile()
+	router := gin.Default()
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/health", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	go router.Run(fmt.Sprintf(":%s", cfg.Reconcile.MetricsPort))
+
+	interval := cfg.Reconcile.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := reconciler.Run(ctx, *repair); err != nil {
+			logger.Logger.Error("Reconciliation failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			logger.Logger.Info("Reconciler stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/reindex"
+	"eric-cw-hsu.github.io/internal/reindex/config"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.uber.org/zap"
+)
+
+func main() {
+	resourceName := flag.String("resource", resource.Plans, "registered resource type whose index is rebuilt")
+	index := flag.String("index", "", "target index to rebuild (default: the next version <alias>_vN of the resource index alias)")
+	resume := flag.Bool("resume", false, "resume the interrupted reindex of -index (or migration) from its checkpoint")
+	migrate := flag.Bool("migrate", false, "build the next index version and swap the elastic_search.index alias to it")
+	batchSize := flag.Int("batch-size", 0, "nodes read from MongoDB per batch (default: reindex.batch_size or 500)")
+	flag.Parse()
+
+	if err := logger.InitLogger(); err != nil {
+		log.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	cfg := config.Load()
+
+	if *resume && !*migrate && *index == "" {
+		log.Fatal("-resume requires -index")
+	}
+	if backend := cfg.NodeStore.Backend; backend != "" && backend != "mongo" {
+		log.Fatalf("node_store.backend %q is not supported, the reindex reads the nodes and the outbox from MongoDB", backend)
+	}
+	if *batchSize <= 0 {
+		*batchSize = cfg.Reindex.BatchSize
+	}
+	res, ok := resource.NewDefaultRegistry().Get(*resourceName)
+	if !ok {
+		log.Fatalf("Resource %q is not registered", *resourceName)
+	}
+
+	mongoService, err := database.NewMongoService(cfg.Mongo.URI, cfg.Mongo.Database)
+	if err != nil {
+		log.Fatalf("Failed to connect to MongoDB: %v", err)
+	}
+	defer mongoService.Close()
+
+	esClient, err := elasticsearch.NewElasticSearchClient(
+		cfg.ElasticSearch.Addr,
+		cfg.ElasticSearch.Username,
+		cfg.ElasticSearch.Password,
+		cfg.ElasticSearch.Index,
+	)
+	if err != nil {
+		log.Fatalf("Failed to create ElasticSearch client: %v", err)
+	}
+
+	// stop between batches on Ctrl-C, the checkpoint keeps the progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	reindexer := reindex.NewReindexer(
+		res,
+		mongoService.GetCollection("plans"),
+		mongoService.GetCollection("reindex_checkpoints"),
+		esClient,
+		cfg.ElasticSearch.Bulk,
+		*batchSize,
+	)
+	if *migrate {
+		migrator := reindex.NewMigrator(reindexer, outbox.NewOutbox(mongoService.GetCollection("outbox")))
+		target, err := migrator.Migrate(ctx, *resume)
+		if err != nil {
+			logger.Logger.Error("Migration stopped", zap.String("index", target), zap.Error(err))
+			os.Exit(1)
+		}
+		fmt.Printf("Alias %s now points to %s\n", reindexer.Alias(), target)
+		return
+	}
+
+	if *index == "" {
+		latest, err := esClient.LatestIndexVersion(reindexer.Alias())
+		if err != nil {
+			log.Fatalf("Failed to look up index versions: %v", err)
+		}
+		*index = elasticsearch.VersionedIndexName(reindexer.Alias(), latest+1)
+	}
+
+	checkpoint, err := reindexer.Run(ctx, *index, *resume)
+	if err != nil {
+		logger.Logger.Error("Reindex stopped", zap.String("index", *index), zap.Error(err))
+		if checkpoint != nil {
+			fmt.Printf("Resume with: reindex -resource %s -index %s -resume\n", res.Name, *index)
+		}
+		os.Exit(1)
+	}
+
+	if len(checkpoint.FailedIDs) > 0 {
+		fmt.Printf("%d nodes were rejected by Elasticsearch: %v\n", len(checkpoint.FailedIDs), checkpoint.FailedIDs)
+	}
+	fmt.Printf("Indexed %d nodes into %s\n", checkpoint.Indexed, *index)
+}
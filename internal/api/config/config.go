@@ -4,7 +4,9 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
+	esconfig "eric-cw-hsu.github.io/internal/elasticsearch/config"
 	"github.com/spf13/viper"
 )
 
@@ -16,17 +18,28 @@ type Config struct {
 		URI      string
 		Database string
 	}
+	// NodeStore selects where plan nodes and the outbox live: "mongo" (default), "sqlite" or "postgres"
+	NodeStore struct {
+		Backend string
+		DSN     string
+	} `mapstructure:"node_store"`
 	OAuth struct {
 		GoogleClientID string `mapstructure:"google_client_id"`
 	}
 	RabbitMQ struct {
-		URI      string
-		Queue    string
-		Exchange string
+		URI            string
+		Queue          string
+		Exchange       string
+		ConfirmTimeout time.Duration `mapstructure:"confirm_timeout"`
 	}
 	Redis struct {
 		URI string
 	}
+	Outbox struct {
+		PollInterval time.Duration `mapstructure:"poll_interval"`
+		BatchSize    int           `mapstructure:"batch_size"`
+	}
+	ElasticSearch esconfig.ElasticSearch
 }
 
 func Load() *Config {
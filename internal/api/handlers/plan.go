@@ -1,11 +1,18 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"eric-cw-hsu.github.io/internal/api/repositories"
 	"eric-cw-hsu.github.io/internal/api/services"
+	"eric-cw-hsu.github.io/internal/api/utils"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
 	"eric-cw-hsu.github.io/internal/shared/apperror"
 	"github.com/gin-gonic/gin"
 )
@@ -31,6 +38,11 @@ func (h *PlanHandler) StorePlanHandler(c *gin.Context) {
 
 	plan, err := h.planService.Create(c, planPayload)
 	if err != nil {
+		// If-None-Match: * turns the conflict with an existing plan into a failed precondition
+		if _, wildcard := utils.ParseETags(c.GetHeader("If-None-Match")); wildcard && err.StatusCode == http.StatusConflict {
+			planId, _ := planPayload["objectId"].(string)
+			err = apperror.NewPlanExistsPreconditionError(planId)
+		}
 		c.JSON(err.StatusCode, err)
 		return
 	}
@@ -46,40 +58,241 @@ func (h *PlanHandler) StorePlanHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Plan stored successfully"})
 }
 
+/*
+OutboxHealthHandler reports whether the node events committed with the writes reach RabbitMQ:
+200 while the relay publishes them, 503 with the publish error (nack, unroutable, confirm timeout)
+and the entry the relay is stuck at otherwise.
+*/
+func (h *PlanHandler) OutboxHealthHandler(c *gin.Context) {
+	failure, appErr := h.planService.EventsFailure()
+	if failure == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"status":     "failing",
+		"entryId":    failure.EntryID.Hex(),
+		"routingKey": failure.RoutingKey,
+		"since":      failure.At,
+		"error":      appErr,
+	})
+}
+
 func (h *PlanHandler) GetPlanHandler(c *gin.Context) {
 	planId := c.Param("id")
 
-	if h.planService.CheckETag(c, planId, c.GetHeader("If-None-Match")) == nil {
-		c.Status(http.StatusNotModified)
+	if c.Query("version") != "" || c.Query("asOf") != "" {
+		h.getPlanVersion(c, planId)
 		return
 	}
 
+	// a conditional GET is answered from the cached ETag without reading the plan
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		if etag, err := h.planService.GetETag(c, planId); err == nil {
+			if tags, _ := utils.ParseETags(etag); len(tags) == 1 && utils.MatchIfNoneMatch(ifNoneMatch, tags[0]) {
+				c.Header("ETag", etag)
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
 	plan, err := h.planService.Get(c, planId)
 	if err != nil {
 		c.JSON(http.StatusNotFound, apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", planId)))
 		return
 	}
 
-	// Generate a new ETag for the response
-	etag, err := h.planService.GetETag(c, planId)
+	// compute the ETag from the plan read, which also refreshes the cached one
+	etag, err := h.planService.GenerateETag(c, plan)
 	if err != nil {
 		c.JSON(err.StatusCode, err)
 		return
 	}
 	c.Header("ETag", etag)
-	c.JSON(http.StatusOK, plan)
+
+	if tags, _ := utils.ParseETags(etag); len(tags) == 1 && utils.MatchIfNoneMatch(c.GetHeader("If-None-Match"), tags[0]) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, utils.PublicDocument(plan))
 }
 
-func (h *PlanHandler) DeletePlanHandler(c *gin.Context) {
+const (
+	defaultListPageSize = 20
+	maxListPageSize     = 100
+)
+
+/*
+ListPlansHandler lists the stored plans a page at a time, without going through Elasticsearch.
+Supported query parameters: limit, cursor (the nextCursor of the previous page), sort (objectId or
+creationDate, prefixed with - for descending order), _org, planType, fields (comma-separated
+top-level fields to return) and expand (false returns the root nodes with $ref stubs).
+*/
+func (h *PlanHandler) ListPlansHandler(c *gin.Context) {
+	opts, err := parsePlanListOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, apperror.NewInvalidListQueryError(err))
+		return
+	}
+
+	page, appErr := h.planService.List(c, opts, c.Query("cursor"))
+	if appErr != nil {
+		c.JSON(appErr.StatusCode, appErr)
+		return
+	}
+
+	// the page is keyed by the resource name, plans for the plans
+	response := gin.H{h.planService.ResourceName(): page.Plans}
+	if page.NextCursor != "" {
+		response["nextCursor"] = page.NextCursor
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func parsePlanListOptions(c *gin.Context) (services.PlanListOptions, error) {
+	opts := services.PlanListOptions{
+		Query: nodestore.ListQuery{
+			Sort:   nodestore.SortObjectID,
+			Filter: map[string]string{},
+			Limit:  defaultListPageSize,
+		},
+		Expand: true,
+	}
+
+	if sort := c.Query("sort"); sort != "" {
+		opts.Query.Descending = strings.HasPrefix(sort, "-")
+		opts.Query.Sort = strings.TrimPrefix(sort, "-")
+		if opts.Query.Sort != nodestore.SortObjectID && opts.Query.Sort != nodestore.SortCreationDate {
+			return opts, fmt.Errorf("sort must be objectId or creationDate, got %q", sort)
+		}
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		size, err := strconv.Atoi(limit)
+		if err != nil || size < 1 || size > maxListPageSize {
+			return opts, fmt.Errorf("limit must be an integer between 1 and %d, got %q", maxListPageSize, limit)
+		}
+		opts.Query.Limit = size
+	}
+
+	for _, field := range []string{"_org", "planType"} {
+		if value := c.Query(field); value != "" {
+			opts.Query.Filter[field] = value
+		}
+	}
+
+	if fields := c.Query("fields"); fields != "" {
+		for _, field := range strings.Split(fields, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				opts.Fields = append(opts.Fields, field)
+			}
+		}
+	}
+
+	if expand := c.Query("expand"); expand != "" {
+		value, err := strconv.ParseBool(expand)
+		if err != nil {
+			return opts, fmt.Errorf("expand must be true or false, got %q", expand)
+		}
+		opts.Expand = value
+	}
+
+	return opts, nil
+}
+
+/*
+getPlanVersion serves a point-in-time read: ?version=N returns the plan as written in version N,
+?asOf=<RFC 3339 time> the plan as it was at that time.
+*/
+func (h *PlanHandler) getPlanVersion(c *gin.Context, planId string) {
+	var plan map[string]interface{}
+	var version *nodestore.Version
+	var appErr *apperror.AppError
+
+	switch {
+	case c.Query("version") != "" && c.Query("asOf") != "":
+		appErr = apperror.NewInvalidVersionQueryError(errors.New("version and asOf cannot be combined"))
+	case c.Query("version") != "":
+		number, err := strconv.Atoi(c.Query("version"))
+		if err != nil || number < 1 {
+			appErr = apperror.NewInvalidVersionQueryError(fmt.Errorf("version must be a positive integer, got %q", c.Query("version")))
+			break
+		}
+		plan, version, appErr = h.planService.GetVersion(c, planId, number)
+	default:
+		asOf, err := time.Parse(time.RFC3339Nano, c.Query("asOf"))
+		if err != nil {
+			appErr = apperror.NewInvalidVersionQueryError(fmt.Errorf("asOf must be an RFC 3339 time: %v", err))
+			break
+		}
+		plan, version, appErr = h.planService.GetAsOf(c, planId, asOf)
+	}
+	if appErr != nil {
+		c.JSON(appErr.StatusCode, appErr)
+		return
+	}
+
+	c.Header("X-Plan-Version", strconv.Itoa(version.Number))
+	c.JSON(http.StatusOK, utils.PublicDocument(plan))
+}
+
+func (h *PlanHandler) GetPlanVersionsHandler(c *gin.Context) {
 	planId := c.Param("id")
 
-	if err := h.planService.Delete(c, planId); err != nil {
+	versions, err := h.planService.ListVersions(c, planId)
+	if err != nil {
 		c.JSON(err.StatusCode, err)
 		return
 	}
 
-	// delete the plan from Redis
-	if err := h.planService.DeleteETag(c, planId); err != nil {
+	c.JSON(http.StatusOK, gin.H{
+		"planId":   planId,
+		"versions": versions,
+	})
+}
+
+/*
+GetPlanDiffHandler returns the nodes added, removed and modified between the versions ?from=N
+and ?to=M of the plan, to defaulting to the latest version.
+*/
+func (h *PlanHandler) GetPlanDiffHandler(c *gin.Context) {
+	planId := c.Param("id")
+
+	from, err := strconv.Atoi(c.Query("from"))
+	if err != nil || from < 1 {
+		c.JSON(http.StatusBadRequest, apperror.NewInvalidVersionQueryError(fmt.Errorf("from must be a positive integer, got %q", c.Query("from"))))
+		return
+	}
+	to := 0
+	if c.Query("to") != "" {
+		if to, err = strconv.Atoi(c.Query("to")); err != nil || to < 1 {
+			c.JSON(http.StatusBadRequest, apperror.NewInvalidVersionQueryError(fmt.Errorf("to must be a positive integer, got %q", c.Query("to"))))
+			return
+		}
+	}
+
+	diff, to, appErr := h.planService.Diff(c, planId, from, to)
+	if appErr != nil {
+		c.JSON(appErr.StatusCode, appErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"planId":   planId,
+		"from":     from,
+		"to":       to,
+		"added":    diff.Added,
+		"removed":  diff.Removed,
+		"modified": diff.Modified,
+	})
+}
+
+func (h *PlanHandler) DeletePlanHandler(c *gin.Context) {
+	planId := c.Param("id")
+
+	if err := h.planService.Delete(c, planId); err != nil {
 		c.JSON(err.StatusCode, err)
 		return
 	}
@@ -88,15 +301,15 @@ func (h *PlanHandler) DeletePlanHandler(c *gin.Context) {
 }
 
 /*
-* updatePlanHandler updates an existing plan.
-* The update allow the user to update the plan with a partial json.
-* the update plan merged with the exisng plan should be a valid json schema.
- */
-func (h *PlanHandler) UpdatePlanHandler(c *gin.Context) {
+PutPlanHandler replaces an existing plan with the body, which must be a complete plan keeping
+the plan objectId. Like a PATCH it requires the current ETag in If-Match.
+*/
+func (h *PlanHandler) PutPlanHandler(c *gin.Context) {
 	planId := c.Param("id")
-	var planUpdatePayload map[string]interface{}
 
-	if err := c.ShouldBindBodyWithJSON(&planUpdatePayload); err != nil {
+	var planPayload map[string]interface{}
+	if err := c.ShouldBindJSON(&planPayload); err != nil {
+		c.JSON(http.StatusBadRequest, apperror.NewInvalidJSONError(err))
 		return
 	}
 
@@ -105,12 +318,41 @@ func (h *PlanHandler) UpdatePlanHandler(c *gin.Context) {
 		return
 	}
 
-	if err := h.planService.CheckETag(c, planId, c.GetHeader("If-Match")); err != nil {
-		c.JSON(http.StatusPreconditionFailed, apperror.NewETagNotMatchError())
+	plan, err := h.planService.Replace(c, planId, c.GetHeader("If-Match"), planPayload)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	etag, err := h.planService.GenerateETag(c, plan)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Plan replaced successfully",
+		"plan":    utils.PublicDocument(plan),
+	})
+}
+
+/*
+* updatePlanHandler updates an existing plan.
+* The body is dispatched on its Content-Type: a partial json merged with the existing plan
+* (application/json), a JSON Merge Patch (application/merge-patch+json) or a JSON Patch
+* (application/json-patch+json). The patched plan should be a valid json schema.
+ */
+func (h *PlanHandler) UpdatePlanHandler(c *gin.Context) {
+	planId := c.Param("id")
+
+	contentType, body, ok := readPatchRequest(c)
+	if !ok {
 		return
 	}
 
-	plan, err := h.planService.Update(c, planId, planUpdatePayload)
+	// the service checks If-Match against the plan it patches, see PlanService.Update
+	plan, err := h.planService.Update(c, planId, c.GetHeader("If-Match"), contentType, body)
 	if err != nil {
 		c.JSON(err.StatusCode, err)
 		return
@@ -125,6 +367,33 @@ func (h *PlanHandler) UpdatePlanHandler(c *gin.Context) {
 	c.Header("ETag", etag)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Plan updated successfully",
-		"plan":    plan,
+		"plan":    utils.PublicDocument(plan),
 	})
 }
+
+/*
+readPatchRequest reads the Content-Type and body of a PATCH, a missing Content-Type meaning a
+partial json, and checks that it carries If-Match. On failure the error response is already written.
+*/
+func readPatchRequest(c *gin.Context) (string, []byte, bool) {
+	contentType := c.ContentType()
+	if contentType == "" {
+		contentType = services.ContentTypePartial
+	}
+	if !slices.Contains(services.PatchContentTypes, contentType) {
+		c.JSON(http.StatusUnsupportedMediaType, apperror.NewUnsupportedMediaTypeError(contentType, services.PatchContentTypes...))
+		return "", nil, false
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, apperror.NewInvalidJSONError(err))
+		return "", nil, false
+	}
+
+	if c.GetHeader("If-Match") == "" {
+		c.JSON(http.StatusPreconditionRequired, apperror.NewETagRequiredError())
+		return "", nil, false
+	}
+	return contentType, body, true
+}
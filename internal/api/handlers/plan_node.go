@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"net/http"
+
+	"eric-cw-hsu.github.io/internal/api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+writeNode answers with the node and its ETag, or 304 when If-None-Match matches the ETag.
+The body holds the public document of the node, see utils.PublicDocument.
+*/
+func (h *PlanHandler) writeNode(c *gin.Context, node map[string]interface{}, body interface{}) {
+	etag, err := h.planService.NodeETag(node)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+	c.Header("ETag", etag)
+
+	if tags, _ := utils.ParseETags(etag); len(tags) == 1 && utils.MatchIfNoneMatch(c.GetHeader("If-None-Match"), tags[0]) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+/*
+GetPlanNodeHandler returns a node of the plan, expanded, with its own ETag.
+*/
+func (h *PlanHandler) GetPlanNodeHandler(c *gin.Context) {
+	node, err := h.planService.GetNode(c, c.Param("id"), c.Param("nodeId"))
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	h.writeNode(c, node, utils.PublicDocument(node))
+}
+
+/*
+GetNodeHandler returns any stored node, expanded, with the chain of its parents up to the plan root.
+*/
+func (h *PlanHandler) GetNodeHandler(c *gin.Context) {
+	node, parents, err := h.planService.GetNodeWithParents(c, c.Param("id"))
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	h.writeNode(c, node, gin.H{
+		"node":    utils.PublicDocument(node),
+		"parents": parents,
+	})
+}
+
+/*
+UpdatePlanNodeHandler patches a node of the plan like UpdatePlanHandler patches a plan, with the
+ETag of the node in If-Match. The response carries the new ETag of the node, and the new ETag of
+the plan in X-Plan-ETag.
+*/
+func (h *PlanHandler) UpdatePlanNodeHandler(c *gin.Context) {
+	planId := c.Param("id")
+
+	contentType, body, ok := readPatchRequest(c)
+	if !ok {
+		return
+	}
+
+	plan, node, err := h.planService.UpdateNode(c, planId, c.Param("nodeId"), c.GetHeader("If-Match"), contentType, body)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	planETag, err := h.planService.GenerateETag(c, plan)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+	etag, err := h.planService.NodeETag(node)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Header("X-Plan-ETag", planETag)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Plan node updated successfully",
+		"node":    utils.PublicDocument(node),
+	})
+}
+
+/*
+DeletePlanNodeHandler removes a node from the plan, with the ETag of the node in If-Match.
+The response carries the new ETag of the plan in X-Plan-ETag.
+*/
+func (h *PlanHandler) DeletePlanNodeHandler(c *gin.Context) {
+	plan, err := h.planService.DeleteNode(c, c.Param("id"), c.Param("nodeId"), c.GetHeader("If-Match"))
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	planETag, err := h.planService.GenerateETag(c, plan)
+	if err != nil {
+		c.JSON(err.StatusCode, err)
+		return
+	}
+
+	c.Header("X-Plan-ETag", planETag)
+	c.JSON(http.StatusOK, gin.H{"message": "Plan node deleted successfully"})
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"eric-cw-hsu.github.io/internal/api/repositories"
+	"eric-cw-hsu.github.io/internal/api/services"
+	"eric-cw-hsu.github.io/internal/api/utils"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/resource/resourcetest"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+/*
+newTestRouter serves the plan CRUD routes from a MemoryStore.
+*/
+func newTestRouter(t *testing.T) (*gin.Engine, nodestore.NodeStore) {
+	t.Helper()
+	logger.Logger = zap.NewNop()
+	gin.SetMode(gin.TestMode)
+
+	plans, ok := resource.NewDefaultRegistry().Get(resource.Plans)
+	if !ok {
+		t.Fatal("the plan resource is not registered")
+	}
+	store := nodestore.NewMemoryStore()
+	planRepository := repositories.NewPlanRepository(store)
+	events := outbox.NewMemoryStore()
+	relay := outbox.NewRelay(events, messagequeue.NewPublisher("plans", 0), 0, 0)
+	handler := NewPlanHandler(planRepository, services.NewPlanService(plans, events, relay, planRepository, repositories.NewETagCache(nil)))
+
+	router := gin.New()
+	router.POST("/v1/plans", handler.StorePlanHandler)
+	router.GET("/v1/plans/:id", handler.GetPlanHandler)
+	router.PATCH("/v1/plans/:id", handler.UpdatePlanHandler)
+	router.DELETE("/v1/plans/:id", handler.DeletePlanHandler)
+	return router, store
+}
+
+func serve(router *gin.Engine, method, path, body string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+/*
+assertPublicBody checks that the plan in the response body has none of the stored-only fields,
+at any depth, and is the document its ETag was computed from.
+*/
+func assertPublicBody(t *testing.T, what string, recorder *httptest.ResponseRecorder, etag string) {
+	t.Helper()
+	var plan map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &plan); err != nil {
+		t.Fatalf("%s body: %v", what, err)
+	}
+	assertPublicPlan(t, what, plan, etag)
+}
+
+func assertPublicPlan(t *testing.T, what string, plan map[string]interface{}, etag string) {
+	t.Helper()
+	for _, field := range []string{"_id", "parentId", "fieldName", "referencedBy", "_rev", "_creationDate"} {
+		if strings.Contains(mustJSON(t, plan), `"`+field+`"`) {
+			t.Errorf("%s body holds the stored field %s: %v", what, field, plan)
+		}
+	}
+	if tag, err := utils.CanonicalETag(plan); err != nil || tag.String() != etag {
+		t.Errorf("%s body hashes to %v (%v), want its ETag %s", what, tag, err, etag)
+	}
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+func TestPlanHandlersCRUD(t *testing.T) {
+	router, store := newTestRouter(t)
+
+	created := serve(router, http.MethodPost, "/v1/plans", resourcetest.PlanJSON("plan-1", "service-1"), nil)
+	if created.Code != http.StatusOK || created.Header().Get("ETag") == "" {
+		t.Fatalf("POST = %d %s, want 200 with an ETag", created.Code, created.Body)
+	}
+	if conflict := serve(router, http.MethodPost, "/v1/plans", resourcetest.PlanJSON("plan-1", "service-1"), nil); conflict.Code != http.StatusConflict {
+		t.Errorf("second POST = %d, want 409", conflict.Code)
+	}
+	if precondition := serve(router, http.MethodPost, "/v1/plans", resourcetest.PlanJSON("plan-1", "service-1"), map[string]string{"If-None-Match": "*"}); precondition.Code != http.StatusPreconditionFailed {
+		t.Errorf("POST with If-None-Match: * = %d, want 412", precondition.Code)
+	}
+
+	read := serve(router, http.MethodGet, "/v1/plans/plan-1", "", nil)
+	etag := read.Header().Get("ETag")
+	if read.Code != http.StatusOK || etag != created.Header().Get("ETag") {
+		t.Fatalf("GET = %d with ETag %q, want 200 with the ETag of the POST %q", read.Code, etag, created.Header().Get("ETag"))
+	}
+	assertPublicBody(t, "GET", read, etag)
+	if notModified := serve(router, http.MethodGet, "/v1/plans/plan-1", "", map[string]string{"If-None-Match": etag}); notModified.Code != http.StatusNotModified {
+		t.Errorf("conditional GET = %d, want 304", notModified.Code)
+	}
+
+	patch := `{"planType": "outOfNetwork"}`
+	mergePatch := map[string]string{"Content-Type": services.ContentTypeMergePatch}
+	if unconditional := serve(router, http.MethodPatch, "/v1/plans/plan-1", patch, mergePatch); unconditional.Code != http.StatusPreconditionRequired {
+		t.Errorf("PATCH without If-Match = %d, want 428", unconditional.Code)
+	}
+	patched := serve(router, http.MethodPatch, "/v1/plans/plan-1", patch, map[string]string{"Content-Type": services.ContentTypeMergePatch, "If-Match": etag})
+	if patched.Code != http.StatusOK || !strings.Contains(patched.Body.String(), "outOfNetwork") {
+		t.Fatalf("PATCH = %d %s, want 200 with the patched plan", patched.Code, patched.Body)
+	}
+	var patchBody struct {
+		Plan map[string]interface{} `json:"plan"`
+	}
+	if err := json.Unmarshal(patched.Body.Bytes(), &patchBody); err != nil {
+		t.Fatal(err)
+	}
+	assertPublicPlan(t, "PATCH", patchBody.Plan, patched.Header().Get("ETag"))
+	stale := serve(router, http.MethodPatch, "/v1/plans/plan-1", patch, map[string]string{"Content-Type": services.ContentTypeMergePatch, "If-Match": etag})
+	if stale.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with the previous ETag = %d, want 412", stale.Code)
+	}
+
+	if deleted := serve(router, http.MethodDelete, "/v1/plans/plan-1", "", nil); deleted.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d %s, want 200", deleted.Code, deleted.Body)
+	}
+	if gone := serve(router, http.MethodGet, "/v1/plans/plan-1", "", nil); gone.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %d, want 404", gone.Code)
+	}
+
+	// the nodes only the deleted plan referenced are collected with it
+	for _, id := range []string{"plan-1", "plan-1-cost", "plan-1-planservice", "plan-1-service-cost", "service-1"} {
+		if exists, _ := store.Exists(context.Background(), id); exists {
+			t.Errorf("node %s is still stored after DELETE", id)
+		}
+	}
+}
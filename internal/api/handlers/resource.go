@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"eric-cw-hsu.github.io/internal/shared/apperror"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ResourceHandler serves the /v1/:resourceType routes of every registered resource with the
+PlanHandler of the resource, so they run through the same validation, storage and events.
+*/
+type ResourceHandler struct {
+	handlers map[string]*PlanHandler
+}
+
+func NewResourceHandler(handlers map[string]*PlanHandler) *ResourceHandler {
+	return &ResourceHandler{
+		handlers: handlers,
+	}
+}
+
+/*
+Handle returns a gin handler running fn with the handler of the :resourceType path parameter,
+e.g. Handle((*PlanHandler).GetPlanHandler). An unknown resource type gets 404.
+*/
+func (h *ResourceHandler) Handle(fn func(*PlanHandler, *gin.Context)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		resourceType := c.Param("resourceType")
+		handler, ok := h.handlers[resourceType]
+		if !ok {
+			c.JSON(http.StatusNotFound, apperror.NewResourceTypeNotFoundError(resourceType))
+			return
+		}
+		fn(handler, c)
+	}
+}
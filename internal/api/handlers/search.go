@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"eric-cw-hsu.github.io/internal/api/services"
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/shared/apperror"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultSearchPageSize = 10
+	maxSearchPageSize     = 100
+)
+
+type SearchHandler struct {
+	searchService *services.SearchService
+}
+
+func NewSearchHandler(searchService *services.SearchService) *SearchHandler {
+	return &SearchHandler{
+		searchService: searchService,
+	}
+}
+
+/*
+* SearchPlansHandler searches plans in the Elasticsearch index.
+* Supported query parameters: _org, planType, minCopay, maxCopay, minDeductible,
+* maxDeductible, serviceName, page and size.
+ */
+func (h *SearchHandler) SearchPlansHandler(c *gin.Context) {
+	filter, page, err := parsePlanSearchFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, apperror.NewInvalidSearchQueryError(err))
+		return
+	}
+
+	result, appErr := h.searchService.SearchPlans(c, filter)
+	if appErr != nil {
+		c.JSON(appErr.StatusCode, appErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":   result.Total,
+		"page":    page,
+		"size":    filter.Size,
+		"results": result.Hits,
+	})
+}
+
+func parsePlanSearchFilter(c *gin.Context) (elasticsearch.PlanSearchFilter, int, error) {
+	filter := elasticsearch.PlanSearchFilter{
+		Org:         c.Query("_org"),
+		PlanType:    c.Query("planType"),
+		ServiceName: c.Query("serviceName"),
+	}
+
+	ranges := map[string]**int{
+		"minCopay":      &filter.MinCopay,
+		"maxCopay":      &filter.MaxCopay,
+		"minDeductible": &filter.MinDeductible,
+		"maxDeductible": &filter.MaxDeductible,
+	}
+	for param, target := range ranges {
+		value, err := optionalIntQuery(c, param)
+		if err != nil {
+			return filter, 0, err
+		}
+		*target = value
+	}
+
+	page, size, err := parsePagination(c)
+	if err != nil {
+		return filter, 0, err
+	}
+
+	filter.From = (page - 1) * size
+	filter.Size = size
+	return filter, page, nil
+}
+
+/*
+* SearchNodesHandler returns graph nodes of the relation given in the path, answering
+* parent/child questions through the join_field without hand-written ES DSL.
+* Conditions are written as field:op:value, e.g.
+*   /v1/plans/search/plan?has=planserviceCostShares&hasWhere=copay:gt:100
+*   /v1/plans/search/linkedService?under=plan&underWhere=planType:eq:inNetwork
+ */
+func (h *SearchHandler) SearchNodesHandler(c *gin.Context) {
+	search, page, err := parseJoinSearch(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, apperror.NewInvalidSearchQueryError(err))
+		return
+	}
+
+	result, appErr := h.searchService.SearchNodes(c, search)
+	if appErr != nil {
+		c.JSON(appErr.StatusCode, appErr)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"total":   result.Total,
+		"page":    page,
+		"size":    search.Size,
+		"results": result.Hits,
+	})
+}
+
+func parseJoinSearch(c *gin.Context) (elasticsearch.JoinSearch, int, error) {
+	search := elasticsearch.JoinSearch{
+		Relation: c.Param("relation"),
+		Has:      c.Query("has"),
+		Under:    c.Query("under"),
+	}
+
+	var err error
+	if search.Where, err = parseConditions(c.QueryArray("where")); err != nil {
+		return search, 0, err
+	}
+	if search.HasWhere, err = parseConditions(c.QueryArray("hasWhere")); err != nil {
+		return search, 0, err
+	}
+	if search.UnderWhere, err = parseConditions(c.QueryArray("underWhere")); err != nil {
+		return search, 0, err
+	}
+	if search.Has == "" && len(search.HasWhere) > 0 {
+		return search, 0, fmt.Errorf("hasWhere requires has")
+	}
+	if search.Under == "" && len(search.UnderWhere) > 0 {
+		return search, 0, fmt.Errorf("underWhere requires under")
+	}
+
+	page, size, err := parsePagination(c)
+	if err != nil {
+		return search, 0, err
+	}
+
+	search.From = (page - 1) * size
+	search.Size = size
+	return search, page, nil
+}
+
+func parseConditions(raw []string) ([]elasticsearch.Condition, error) {
+	conditions := []elasticsearch.Condition{}
+	for _, item := range raw {
+		parts := strings.SplitN(item, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("condition %q must be written as field:op:value", item)
+		}
+		conditions = append(conditions, elasticsearch.Condition{
+			Field: parts[0],
+			Op:    parts[1],
+			Value: parts[2],
+		})
+	}
+	return conditions, nil
+}
+
+func parsePagination(c *gin.Context) (int, int, error) {
+	page, err := intQuery(c, "page", 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := intQuery(c, "size", defaultSearchPageSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if page < 1 {
+		return 0, 0, fmt.Errorf("page must be greater than 0")
+	}
+	if size < 1 || size > maxSearchPageSize {
+		return 0, 0, fmt.Errorf("size must be between 1 and %d", maxSearchPageSize)
+	}
+	return page, size, nil
+}
+
+func intQuery(c *gin.Context, name string, defaultValue int) (int, error) {
+	value, err := optionalIntQuery(c, name)
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return defaultValue, nil
+	}
+	return *value, nil
+}
+
+func optionalIntQuery(c *gin.Context, name string) (*int, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return nil, nil
+	}
+
+	value, err := strconv.Atoi(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an integer", name)
+	}
+	return &value, nil
+}
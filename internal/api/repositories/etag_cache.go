@@ -0,0 +1,88 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+/*
+etagCacheTTL bounds how long an entry refilled by a read racing a write can outlive the write,
+every committed write also drops the entries of the plans it changed.
+*/
+const etagCacheTTL = 10 * time.Minute
+
+/*
+ETagCache keeps the ETag of each plan in Redis under plan:etag:<id>. It is only a cache: a missing
+entry, or a Redis failure, is rebuilt from the stored plan, so Redis can be flushed at any time.
+A nil client disables the cache.
+*/
+type ETagCache struct {
+	client *redis.Client
+}
+
+func NewETagCache(client *redis.Client) *ETagCache {
+	return &ETagCache{
+		client: client,
+	}
+}
+
+func etagKey(id string) string {
+	return "plan:etag:" + id
+}
+
+/*
+Enabled reports whether the cache is backed by Redis.
+*/
+func (c *ETagCache) Enabled() bool {
+	return c.client != nil
+}
+
+/*
+Get returns the cached ETag of the plan, false when it is missing or Redis failed.
+*/
+func (c *ETagCache) Get(ctx context.Context, id string) (string, bool) {
+	if c.client == nil {
+		return "", false
+	}
+
+	etag, err := c.client.Get(ctx, etagKey(id)).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logger.Logger.Warn("ETagCache.Get: failed to read cached ETag", zap.String("id", id), zap.Error(err))
+		}
+		return "", false
+	}
+	return etag, true
+}
+
+func (c *ETagCache) Set(ctx context.Context, id, etag string) {
+	if c.client == nil {
+		return
+	}
+
+	if err := c.client.Set(ctx, etagKey(id), etag, etagCacheTTL).Err(); err != nil {
+		logger.Logger.Warn("ETagCache.Set: failed to cache ETag", zap.String("id", id), zap.Error(err))
+	}
+}
+
+/*
+Invalidate drops the cached ETags of the plans. A failure is logged, the entries then expire
+after etagCacheTTL.
+*/
+func (c *ETagCache) Invalidate(ctx context.Context, ids ...string) {
+	if c.client == nil || len(ids) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, etagKey(id))
+	}
+	if err := c.client.Del(ctx, keys...).Err(); err != nil {
+		logger.Logger.Warn("ETagCache.Invalidate: failed to drop cached ETags", zap.Strings("ids", ids), zap.Error(err))
+	}
+}
@@ -1,30 +1,34 @@
 package repositories
 
 import (
-	"eric-cw-hsu.github.io/internal/objectstore/graph"
-	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"context"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
 	"eric-cw-hsu.github.io/internal/shared/logger"
-	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
 )
 
 type PlanRepository struct {
-	collection *mongo.Collection
+	store nodestore.NodeStore
 }
 
-func NewPlanRepository(collection *mongo.Collection) *PlanRepository {
+func NewPlanRepository(store nodestore.NodeStore) *PlanRepository {
 	return &PlanRepository{
-		collection: collection,
+		store: store,
 	}
 }
 
 func (r *PlanRepository) IsPlanExists(id string) bool {
-	_, err := storage.GetNodeRaw(r.collection, id)
-	return err == nil
+	exists, err := r.store.Exists(context.Background(), id)
+	if err != nil {
+		logger.Logger.Error("PlanRepository.IsPlanExists failed", zap.String("id", id), zap.Error(err))
+	}
+	return exists
 }
 
 func (r *PlanRepository) GetPlan(id string) (map[string]interface{}, error) {
-	plan, err := storage.GetExpandedNode(r.collection, id)
+	plan, err := r.store.GetExpanded(context.Background(), id)
 	if err != nil {
 		logger.Logger.Error("PlanRepository.GetPlan failed", zap.String("id", id), zap.Error(err))
 		return nil, err
@@ -32,26 +36,116 @@ func (r *PlanRepository) GetPlan(id string) (map[string]interface{}, error) {
 	return plan, nil
 }
 
-func (r *PlanRepository) StorePlanNodes(nodes map[string]map[string]interface{}) error {
-	if err := storage.StoreExtractedGraphNodes(r.collection, nodes); err != nil {
+/*
+GetNodeRaw returns the stored node with its $refs, its parentId and fieldName, or nodestore.ErrNotFound.
+*/
+func (r *PlanRepository) GetNodeRaw(ctx context.Context, id string) (map[string]interface{}, error) {
+	return r.store.GetRaw(ctx, id)
+}
+
+/*
+ListPlanRoots returns the root nodes of the plans selected by query, with their $refs.
+*/
+func (r *PlanRepository) ListPlanRoots(ctx context.Context, query nodestore.ListQuery) ([]map[string]interface{}, error) {
+	roots, err := r.store.ListRoots(ctx, query)
+	if err != nil {
+		logger.Logger.Error("PlanRepository.ListPlanRoots failed", zap.Error(err))
+		return nil, err
+	}
+	return roots, nil
+}
+
+/*
+WithTransaction runs fn in a store transaction, repository calls made with its ctx are atomic.
+*/
+func (r *PlanRepository) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return r.store.WithTransaction(ctx, fn)
+}
+
+/*
+StorePlanNodes upserts the nodes of a plan and returns the nodes no longer referenced by any plan,
+which are removed.
+*/
+func (r *PlanRepository) StorePlanNodes(ctx context.Context, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	removed, err := r.store.UpsertNodes(ctx, nodes)
+	if err != nil {
 		logger.Logger.Error("PlanRepository.StorePlanNodes failed", zap.Error(err))
+		return nil, err
+	}
+	return removed, nil
+}
+
+/*
+InsertPlanRoot claims the id of a new plan, failing with nodestore.ErrExists when a node is
+stored with it.
+*/
+func (r *PlanRepository) InsertPlanRoot(ctx context.Context, id string) error {
+	if err := r.store.InsertRoot(ctx, id); err != nil {
+		logger.Logger.Warn("PlanRepository.InsertPlanRoot failed", zap.String("id", id), zap.Error(err))
 		return err
 	}
 	return nil
 }
 
-func (r *PlanRepository) DeletePlan(id string) (map[string]map[string]interface{}, error) {
-	obj, err := storage.GetExpandedNode(r.collection, id)
+/*
+SwapRevision bumps the revision of the plan from expected, failing with
+nodestore.ErrRevisionConflict when another write moved it.
+*/
+func (r *PlanRepository) SwapRevision(ctx context.Context, id string, expected int64) error {
+	if err := r.store.SwapRevision(ctx, id, expected); err != nil {
+		logger.Logger.Warn("PlanRepository.SwapRevision failed", zap.String("id", id), zap.Int64("expected", expected), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+/*
+DeletePlan deletes the plan and returns the removed nodes, nodes shared with other plans are kept.
+*/
+func (r *PlanRepository) DeletePlan(ctx context.Context, id string) (map[string]map[string]interface{}, error) {
+	removed, err := r.store.DeleteNodes(ctx, id)
 	if err != nil {
-		logger.Logger.Error("PlanRepository.DeletePlan: fetch failed", zap.String("id", id), zap.Error(err))
+		logger.Logger.Error("PlanRepository.DeletePlan: delete graph failed", zap.String("id", id), zap.Error(err))
+		return nil, err
+	}
+	return removed, nil
+}
+
+/*
+RecordVersion records the plan, as written in the transaction of ctx, as its next version.
+A delete version records no plan.
+*/
+func (r *PlanRepository) RecordVersion(ctx context.Context, id, action, author string) (*nodestore.Version, error) {
+	version := &nodestore.Version{PlanID: id, Action: action, Author: author}
+	if action != nodestore.VersionDelete {
+		plan, err := r.store.GetExpanded(ctx, id)
+		if err != nil {
+			logger.Logger.Error("PlanRepository.RecordVersion: failed to get plan", zap.String("id", id), zap.Error(err))
+			return nil, err
+		}
+		version.Plan = plan
+	}
+
+	if err := r.store.AddVersion(ctx, version); err != nil {
+		logger.Logger.Error("PlanRepository.RecordVersion failed", zap.String("id", id), zap.Error(err))
 		return nil, err
 	}
+	return version, nil
+}
 
-	nodes := graph.ExtractGraphNodes("plan", obj)
-	if err := storage.DeleteGraphNodes(r.collection, nodes); err != nil {
-		logger.Logger.Error("PlanRepository.DeletePlan: delete graph nodes failed", zap.String("id", id), zap.Error(err))
+func (r *PlanRepository) ListVersions(ctx context.Context, id string) ([]nodestore.Version, error) {
+	versions, err := r.store.ListVersions(ctx, id)
+	if err != nil {
+		logger.Logger.Error("PlanRepository.ListVersions failed", zap.String("id", id), zap.Error(err))
 		return nil, err
 	}
+	return versions, nil
+}
+
+func (r *PlanRepository) GetVersion(ctx context.Context, id string, number int) (*nodestore.Version, error) {
+	return r.store.GetVersion(ctx, id, number)
+}
 
-	return nodes, nil
+func (r *PlanRepository) GetVersionAsOf(ctx context.Context, id string, asOf time.Time) (*nodestore.Version, error) {
+	return r.store.GetVersionAsOf(ctx, id, asOf)
 }
@@ -5,19 +5,43 @@ import (
 	"eric-cw-hsu.github.io/internal/api/handlers"
 	"eric-cw-hsu.github.io/internal/api/repositories"
 	"eric-cw-hsu.github.io/internal/api/services"
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/oauth"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
 	"eric-cw-hsu.github.io/internal/shared/logger"
-	"eric-cw-hsu.github.io/internal/shared/messagequeue"
 	"eric-cw-hsu.github.io/internal/shared/middleware"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func NewRouter(collection *mongo.Collection, publisher *messagequeue.Publisher, redisClient *redis.Client, config *config.Config) *gin.Engine {
-	planRepository := repositories.NewPlanRepository(collection)
-	planService := services.NewPlanService(publisher, planRepository, redisClient)
-	planHandler := handlers.NewPlanHandler(planRepository, planService)
+func NewRouter(
+	nodeStore nodestore.NodeStore,
+	planOutbox outbox.Store,
+	relay *outbox.Relay,
+	redisClient *redis.Client,
+	esClient *elasticsearch.Client,
+	registry *resource.Registry,
+	config *config.Config,
+) *gin.Engine {
+	planRepository := repositories.NewPlanRepository(nodeStore)
+	etagCache := repositories.NewETagCache(redisClient)
+
+	// one service and handler per registered resource, the plan one also serves the plan-only routes
+	resourceHandlers := map[string]*handlers.PlanHandler{}
+	for _, res := range registry.All() {
+		service := services.NewPlanService(res, planOutbox, relay, planRepository, etagCache)
+		resourceHandlers[res.Name] = handlers.NewPlanHandler(planRepository, service)
+	}
+	planHandler, ok := resourceHandlers[resource.Plans]
+	if !ok {
+		panic("the plan resource is not registered")
+	}
+	resourceHandler := handlers.NewResourceHandler(resourceHandlers)
+	searchService := services.NewSearchService(esClient)
+	searchHandler := handlers.NewSearchHandler(searchService)
 
 	router := gin.New()
 	router.Use(gin.Logger())
@@ -25,13 +49,35 @@ func NewRouter(collection *mongo.Collection, publisher *messagequeue.Publisher,
 	router.Use(middleware.PrometheusMiddleware())
 
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.GET("/health/outbox", planHandler.OutboxHealthHandler)
 
-	// router.Use(oauth.GoogleAuthMiddleware(config.OAuth.GoogleClientID))
+	// the API routes require a Google ID token once a client id is configured
+	if config.OAuth.GoogleClientID != "" {
+		router.Use(oauth.GoogleAuthMiddleware(config.OAuth.GoogleClientID))
+	}
 
+	router.GET("/v1/plans/search", searchHandler.SearchPlansHandler)
+	router.GET("/v1/plans/search/:relation", searchHandler.SearchNodesHandler)
+	router.GET("/v1/plans", planHandler.ListPlansHandler)
 	router.GET("v1/plans/:id", planHandler.GetPlanHandler)
+	router.GET("/v1/plans/:id/versions", planHandler.GetPlanVersionsHandler)
+	router.GET("/v1/plans/:id/diff", planHandler.GetPlanDiffHandler)
+	router.GET("/v1/plans/:id/nodes/:nodeId", planHandler.GetPlanNodeHandler)
+	router.PATCH("/v1/plans/:id/nodes/:nodeId", planHandler.UpdatePlanNodeHandler)
+	router.DELETE("/v1/plans/:id/nodes/:nodeId", planHandler.DeletePlanNodeHandler)
+	router.GET("/v1/nodes/:id", planHandler.GetNodeHandler)
 	router.POST("/v1/plans", planHandler.StorePlanHandler)
 	router.DELETE("/v1/plans/:id", planHandler.DeletePlanHandler)
 	router.PATCH("/v1/plans/:id", planHandler.UpdatePlanHandler)
+	router.PUT("/v1/plans/:id", planHandler.PutPlanHandler)
+
+	// CRUD routes of the other registered resources, static routes above take precedence
+	router.GET("/v1/:resourceType", resourceHandler.Handle((*handlers.PlanHandler).ListPlansHandler))
+	router.POST("/v1/:resourceType", resourceHandler.Handle((*handlers.PlanHandler).StorePlanHandler))
+	router.GET("/v1/:resourceType/:id", resourceHandler.Handle((*handlers.PlanHandler).GetPlanHandler))
+	router.PATCH("/v1/:resourceType/:id", resourceHandler.Handle((*handlers.PlanHandler).UpdatePlanHandler))
+	router.PUT("/v1/:resourceType/:id", resourceHandler.Handle((*handlers.PlanHandler).PutPlanHandler))
+	router.DELETE("/v1/:resourceType/:id", resourceHandler.Handle((*handlers.PlanHandler).DeletePlanHandler))
 
 	return router
 }
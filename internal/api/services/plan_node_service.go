@@ -0,0 +1,206 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"eric-cw-hsu.github.io/internal/api/schema"
+	"eric-cw-hsu.github.io/internal/api/utils"
+	"eric-cw-hsu.github.io/internal/objectstore/graph"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/shared/apperror"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.uber.org/zap"
+)
+
+/*
+NodeParent is a node on the parent chain of a node: the parent and its field holding the child.
+*/
+type NodeParent struct {
+	ObjectID   string `json:"objectId"`
+	ObjectType string `json:"objectType"`
+	Field      string `json:"field"`
+}
+
+/*
+NodeETag returns the strong ETag of an expanded node, computed like the ETag of a plan.
+*/
+func (s *PlanService) NodeETag(node map[string]interface{}) (string, *apperror.AppError) {
+	etag, err := utils.CanonicalETag(node)
+	if err != nil {
+		logger.Logger.Error("PlanService.NodeETag: failed to compute ETag", zap.Error(err))
+		return "", apperror.NewStorageError("Failed to compute ETag", err)
+	}
+	return etag.String(), nil
+}
+
+/*
+loadPlanNode returns the plan as stored and a normalized copy of it holding the node, the node
+being the one found in the copy.
+*/
+func (s *PlanService) loadPlanNode(planId, nodeId string) (map[string]interface{}, map[string]interface{}, map[string]interface{}, *apperror.AppError) {
+	plan, err := s.planRepository.GetPlan(planId)
+	if errors.Is(err, nodestore.ErrNotFound) || (err == nil && !s.isRoot(plan)) {
+		return nil, nil, nil, apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", planId))
+	}
+	if err != nil {
+		return nil, nil, nil, apperror.NewStorageError("Failed to get plan", err)
+	}
+
+	normalized, err := graph.Normalize(plan)
+	if err != nil {
+		return nil, nil, nil, apperror.NewStorageError("Failed to read plan", err)
+	}
+	node, ok := graph.FindNode(normalized, nodeId)
+	if !ok {
+		return nil, nil, nil, apperror.NewPlanNodeNotFoundError(fmt.Errorf("Plan with ID %s has no node %s", planId, nodeId))
+	}
+	return plan, normalized, node, nil
+}
+
+/*
+GetNode returns the node of the plan, expanded.
+*/
+func (s *PlanService) GetNode(ctx context.Context, planId, nodeId string) (map[string]interface{}, *apperror.AppError) {
+	_, _, node, appErr := s.loadPlanNode(planId, nodeId)
+	return node, appErr
+}
+
+/*
+GetNodeWithParents returns any stored node, expanded, with its parent chain from its parent up
+to the plan root. A node shared between plans is listed under the parent that first stored it.
+*/
+func (s *PlanService) GetNodeWithParents(ctx context.Context, id string) (map[string]interface{}, []NodeParent, *apperror.AppError) {
+	node, err := s.planRepository.GetPlan(id)
+	if errors.Is(err, nodestore.ErrNotFound) {
+		return nil, nil, apperror.NewPlanNodeNotFoundError(fmt.Errorf("Node with ID %s not found", id))
+	}
+	if err != nil {
+		return nil, nil, apperror.NewStorageError("Failed to get node", err)
+	}
+
+	parents := []NodeParent{}
+	visited := map[string]bool{id: true}
+	field, _ := node["fieldName"].(string)
+	parentId, _ := node["parentId"].(string)
+	for parentId != "" && !visited[parentId] {
+		visited[parentId] = true
+
+		parent, err := s.planRepository.GetNodeRaw(ctx, parentId)
+		if errors.Is(err, nodestore.ErrNotFound) {
+			// the parent that stored the node is gone, the node is kept by another one
+			break
+		}
+		if err != nil {
+			logger.Logger.Error("PlanService.GetNodeWithParents: failed to get parent", zap.String("id", parentId), zap.Error(err))
+			return nil, nil, apperror.NewStorageError("Failed to get node parent", err)
+		}
+
+		objectType, _ := parent["objectType"].(string)
+		parents = append(parents, NodeParent{ObjectID: parentId, ObjectType: objectType, Field: field})
+		field, _ = parent["fieldName"].(string)
+		parentId, _ = parent["parentId"].(string)
+	}
+
+	return node, parents, nil
+}
+
+/*
+writePlanNode stores the plan after a change to one of its nodes, like Update: the plan must
+still validate, and the write only commits if no other write committed since the plan was read.
+The node events reach the search index through the outbox, like those of a plan write.
+*/
+func (s *PlanService) writePlanNode(ctx context.Context, planId string, previous, updated map[string]interface{}) (map[string]interface{}, *apperror.AppError) {
+	if err := schema.ValidateJsonSchema(updated, s.resource.Schema); err != nil {
+		logger.Logger.Error("PlanService.writePlanNode: invalid plan", zap.Error(err))
+		return nil, apperror.NewInvalidJSONError(err)
+	}
+
+	nodes := graph.ExtractGraphNodes(s.resource.RootField, updated)
+	if err := s.storeNodes(ctx, planId, nodes, nodestore.VersionUpdate, previous); err != nil {
+		logger.Logger.Error("PlanService.writePlanNode: failed to store nodes", zap.Error(err))
+		return nil, storeError(planId, err)
+	}
+
+	s.dispatchEvents()
+
+	plan, err := s.planRepository.GetPlan(planId)
+	if err != nil {
+		logger.Logger.Error("PlanService.writePlanNode: failed to re-fetch plan", zap.String("id", planId), zap.Error(err))
+		return nil, apperror.NewStorageError("Failed to get plan", err)
+	}
+	return plan, nil
+}
+
+/*
+UpdateNode patches a node of the plan with the body, interpreted according to contentType like
+Update, ifMatch being checked against the ETag of the node. It returns the updated plan and node.
+*/
+func (s *PlanService) UpdateNode(
+	ctx context.Context,
+	planId string,
+	nodeId string,
+	ifMatch string,
+	contentType string,
+	body []byte,
+) (map[string]interface{}, map[string]interface{}, *apperror.AppError) {
+	previous, updated, node, appErr := s.loadPlanNode(planId, nodeId)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	if appErr := checkIfMatch(node, ifMatch); appErr != nil {
+		return nil, nil, appErr
+	}
+
+	patched, appErr := patchPlan(node, contentType, body)
+	if appErr != nil {
+		logger.Logger.Error("PlanService.UpdateNode: failed to patch node", zap.String("contentType", contentType), zap.Error(appErr))
+		return nil, nil, appErr
+	}
+	if patched["objectId"] != nodeId {
+		return nil, nil, apperror.NewObjectIdChangedError(nodeId)
+	}
+
+	if nodeId == planId {
+		updated = patched
+	} else {
+		graph.ReplaceNode(updated, nodeId, patched)
+	}
+
+	plan, appErr := s.writePlanNode(ctx, planId, previous, updated)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	normalized, err := graph.Normalize(plan)
+	if err != nil {
+		return nil, nil, apperror.NewStorageError("Failed to read plan", err)
+	}
+	node, _ = graph.FindNode(normalized, nodeId)
+	return plan, node, nil
+}
+
+/*
+DeleteNode removes a node from the plan: the field holding it is deleted, or the array item
+dropped. The node itself is deleted once no plan references it. ifMatch is required and checked
+against the ETag of the node, like for UpdateNode. It returns the updated plan.
+*/
+func (s *PlanService) DeleteNode(ctx context.Context, planId, nodeId, ifMatch string) (map[string]interface{}, *apperror.AppError) {
+	if nodeId == planId {
+		return nil, apperror.NewRootNodeDeleteError(planId)
+	}
+	if ifMatch == "" {
+		return nil, apperror.NewETagRequiredError()
+	}
+
+	previous, updated, node, appErr := s.loadPlanNode(planId, nodeId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if appErr := checkIfMatch(node, ifMatch); appErr != nil {
+		return nil, appErr
+	}
+
+	graph.RemoveNode(updated, nodeId)
+	return s.writePlanNode(ctx, planId, previous, updated)
+}
@@ -2,75 +2,266 @@ package services
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"time"
 
 	"eric-cw-hsu.github.io/internal/api/repositories"
 	"eric-cw-hsu.github.io/internal/api/schema"
 	"eric-cw-hsu.github.io/internal/api/utils"
+	"eric-cw-hsu.github.io/internal/oauth"
 	"eric-cw-hsu.github.io/internal/objectstore/graph"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
 	"eric-cw-hsu.github.io/internal/shared/apperror"
 	"eric-cw-hsu.github.io/internal/shared/logger"
 	"eric-cw-hsu.github.io/internal/shared/messagequeue"
 	"eric-cw-hsu.github.io/internal/shared/messagequeue/messages"
-	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
 )
 
+/*
+PlanService stores the documents of one resource type, the plans unless another resource is
+given (see resource.Registry): its schema validates them, its root field names their root node
+and its index is named by their node events.
+*/
 type PlanService struct {
-	publisher      *messagequeue.Publisher
+	resource       *resource.Resource
+	outbox         outbox.Store
+	relay          *outbox.Relay
 	planRepository *repositories.PlanRepository
-	redisClient    *redis.Client
+	etagCache      *repositories.ETagCache
 }
 
-func NewPlanService(publisher *messagequeue.Publisher, planRepository *repositories.PlanRepository, redisClient *redis.Client) *PlanService {
+func NewPlanService(
+	resource *resource.Resource,
+	outbox outbox.Store,
+	relay *outbox.Relay,
+	planRepository *repositories.PlanRepository,
+	etagCache *repositories.ETagCache,
+) *PlanService {
 	return &PlanService{
-		publisher:      publisher,
+		resource:       resource,
+		outbox:         outbox,
+		relay:          relay,
 		planRepository: planRepository,
-		redisClient:    redisClient,
+		etagCache:      etagCache,
 	}
 }
 
-func (s *PlanService) publishNodes(nodes map[string]map[string]interface{}, action string) error {
+/*
+ResourceName returns the name of the resource the service stores, e.g. plans.
+*/
+func (s *PlanService) ResourceName() string {
+	return s.resource.Name
+}
+
+/*
+nodeMessages builds the events of the nodes, with the change of each node when diff is not nil.
+*/
+func nodeMessages(index string, nodes map[string]map[string]interface{}, action string, diff *graph.GraphDiff) []messagequeue.Message {
+	msgs := make([]messagequeue.Message, 0, len(nodes))
 	for _, node := range nodes {
 		msg := messages.PlanNodeMessage{
 			Action: action,
-			Index:  "plans",
+			Index:  index,
 			Key:    node["objectId"].(string),
 			Data:   node,
 		}
+		if diff != nil {
+			msg.Changes = diff.Node(msg.Key)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+/*
+changedNodeMessages builds the events of the nodes the diff reports: create for an added node and
+update for a modified one. Unchanged nodes get no event.
+*/
+func changedNodeMessages(index string, nodes map[string]map[string]interface{}, diff *graph.GraphDiff) []messagequeue.Message {
+	msgs := []messagequeue.Message{}
+	for id, node := range nodes {
+		change := diff.Node(id)
+		if change == nil {
+			continue
+		}
 
-		if err := s.publisher.PublishMessage(context.Background(), msg.Type(), msg); err != nil {
-			logger.Logger.Error("PlanService.publishNodes: failed to publish message", zap.String("action", action), zap.Error(err))
+		action := "update"
+		if change.Change == graph.NodeAdded {
+			action = "create"
+		}
+		msgs = append(msgs, messages.PlanNodeMessage{
+			Action:  action,
+			Index:   index,
+			Key:     id,
+			Data:    node,
+			Changes: change,
+		})
+	}
+	return msgs
+}
+
+/*
+storeNodes upserts the nodes of the plan, records the written plan as a new version and writes
+the node events, plus the delete events of the nodes the new graph no longer references, to the
+outbox in one transaction. When the plan replaces a previous one, the node events carry the
+changes from it, and a replace only publishes the events of the nodes it added or changed.
+
+A write over a previous plan first swaps the plan revision read with it, so it fails with
+nodestore.ErrRevisionConflict, and commits nothing, when another write committed in between.
+A create first inserts the plan root, so it fails with nodestore.ErrExists when the plan exists.
+Once committed, the cached ETags of the plans sharing the written nodes are dropped.
+*/
+func (s *PlanService) storeNodes(
+	ctx context.Context,
+	id string,
+	nodes map[string]map[string]interface{},
+	action string,
+	previous map[string]interface{},
+) error {
+	err := s.planRepository.WithTransaction(ctx, func(txCtx context.Context) error {
+		switch {
+		case previous != nil:
+			if err := s.planRepository.SwapRevision(txCtx, id, storage.Revision(previous)); err != nil {
+				return err
+			}
+		case action == nodestore.VersionCreate:
+			if err := s.planRepository.InsertPlanRoot(txCtx, id); err != nil {
+				return err
+			}
+		}
+
+		removed, err := s.planRepository.StorePlanNodes(txCtx, nodes)
+		if err != nil {
+			return err
+		}
+		version, err := s.planRepository.RecordVersion(txCtx, id, action, oauth.Author(ctx))
+		if err != nil {
 			return err
 		}
+
+		var events []messagequeue.Message
+		switch {
+		case action == nodestore.VersionReplace:
+			events = changedNodeMessages(s.resource.Index, nodes, graph.Diff(previous, version.Plan))
+		case previous != nil:
+			events = nodeMessages(s.resource.Index, nodes, action, graph.Diff(previous, version.Plan))
+		default:
+			events = nodeMessages(s.resource.Index, nodes, action, nil)
+		}
+		events = append(events, nodeMessages(s.resource.Index, removed, "delete", nil)...)
+		return s.outbox.Enqueue(txCtx, events...)
+	})
+	if err != nil {
+		return err
 	}
+
+	s.etagCache.Invalidate(ctx, s.affectedPlans(ctx, id, nodes)...)
 	return nil
 }
 
+/*
+affectedPlans returns the plan and the other plans whose graph holds one of its written nodes,
+found by walking the referencedBy edges of the nodes up to the plan roots. Only needed to keep
+the ETag cache right, so nothing is read when it is disabled.
+*/
+func (s *PlanService) affectedPlans(ctx context.Context, id string, nodes map[string]map[string]interface{}) []string {
+	plans := []string{id}
+	if !s.etagCache.Enabled() {
+		return plans
+	}
+
+	visited := map[string]bool{}
+	queue := []string{}
+	for nodeId := range nodes {
+		visited[nodeId] = true
+		queue = append(queue, nodeId)
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		node, err := s.planRepository.GetNodeRaw(ctx, current)
+		if err != nil {
+			continue
+		}
+		for _, parent := range storage.ReferencedBy(node) {
+			switch {
+			case parent == storage.RootEdge:
+				if current != id {
+					plans = append(plans, current)
+				}
+			case !visited[parent]:
+				visited[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	return plans
+}
+
+/*
+dispatchEvents wakes the relay up once a write committed its outbox entries, so they are published
+right away instead of at the next poll. The write is committed at this point: publish failures are
+logged and retried by the relay, never returned to the client.
+*/
+func (s *PlanService) dispatchEvents() {
+	s.relay.Notify()
+}
+
+/*
+EventsFailure returns the publish failure that stopped the outbox relay, with the entry it stopped
+at, nil while the relay publishes the committed events. The writes behind the failed events are
+committed, so the failure is reported here (see PlanHandler.OutboxHealthHandler) rather than to
+their clients.
+*/
+func (s *PlanService) EventsFailure() (*outbox.PublishFailure, *apperror.AppError) {
+	failure := s.relay.LastFailure()
+	if failure == nil {
+		return nil, nil
+	}
+	return failure, publishError(failure.Err)
+}
+
+func publishError(err error) *apperror.AppError {
+	switch {
+	case errors.Is(err, messagequeue.ErrPublishNacked):
+		return apperror.NewRabbitMQNackError(err)
+	case errors.Is(err, messagequeue.ErrPublishUnroutable):
+		return apperror.NewRabbitMQUnroutableError(err)
+	case errors.Is(err, messagequeue.ErrConfirmTimeout):
+		return apperror.NewRabbitMQConfirmTimeoutError(err)
+	default:
+		return apperror.NewRabbitMQFailPublishError(err)
+	}
+}
+
 func (s *PlanService) Create(ctx context.Context, payload map[string]interface{}) (map[string]interface{}, *apperror.AppError) {
-	if err := schema.ValidateJsonSchema(payload, schema.GetPlanJsonSchema()); err != nil {
+	if err := schema.ValidateJsonSchema(payload, s.resource.Schema); err != nil {
 		logger.Logger.Error("PlanService.Create: invalid JSON payload", zap.Error(err))
 		return nil, apperror.NewInvalidJSONError(err)
 	}
 
-	// check if the plan already exists
+	// the plan root is inserted in the transaction, see storeNodes
 	planId, _ := payload["objectId"].(string)
-	if s.planRepository.IsPlanExists(planId) {
-		logger.Logger.Warn("PlanService.Create: plan already exists", zap.String("id", planId))
-		return nil, apperror.NewPlanExistsError()
-	}
-
-	nodes := graph.ExtractGraphNodes("plan", payload)
+	nodes := graph.ExtractGraphNodes(s.resource.RootField, payload)
 
-	if err := s.planRepository.StorePlanNodes(nodes); err != nil {
+	if err := s.storeNodes(ctx, planId, nodes, nodestore.VersionCreate, nil); err != nil {
+		if errors.Is(err, nodestore.ErrExists) {
+			logger.Logger.Warn("PlanService.Create: plan already exists", zap.String("id", planId))
+			return nil, apperror.NewPlanExistsError()
+		}
 		logger.Logger.Error("PlanService.Create: failed to store nodes", zap.Error(err))
 		return nil, apperror.NewStorageError("Failed to store plan", err)
 	}
 
-	if err := s.publishNodes(nodes, "create"); err != nil {
-		logger.Logger.Error("PlanService.Create: publish create failed", zap.Error(err))
-		return nil, apperror.NewRabbitMQFailPublishError(err)
-	}
+	s.dispatchEvents()
 
 	plan, err := s.planRepository.GetPlan(planId)
 	if err != nil {
@@ -87,16 +278,332 @@ func (s *PlanService) Get(ctx context.Context, id string) (map[string]interface{
 		logger.Logger.Error("PlanService.Get: failed to get plan", zap.String("id", id), zap.Error(err))
 		return nil, apperror.NewStorageError("Failed to get plan", err)
 	}
+	if !s.isRoot(plan) {
+		return nil, apperror.NewPlanNotFoundError(fmt.Errorf("%s with ID %s not found", s.resource.Name, id))
+	}
 
 	return plan, nil
 }
 
+/*
+isRoot reports whether the node is the root of a document of the resource, so the routes of a
+resource never serve another resource or a child node.
+*/
+func (s *PlanService) isRoot(node map[string]interface{}) bool {
+	return node["fieldName"] == s.resource.RootField
+}
+
+/*
+exists reports whether a document of the resource is stored with the id.
+*/
+func (s *PlanService) exists(ctx context.Context, id string) bool {
+	root, err := s.planRepository.GetNodeRaw(ctx, id)
+	return err == nil && s.isRoot(root)
+}
+
+/*
+PlanListOptions selects a page of plans: Query picks the roots, Fields keeps only the listed
+top-level fields of each plan (objectId and objectType are always kept), and Expand returns the
+expanded plans instead of their root nodes with $ref stubs for the children.
+*/
+type PlanListOptions struct {
+	Query  nodestore.ListQuery
+	Fields []string
+	Expand bool
+}
+
+/*
+PlanPage is a page of plans. NextCursor resumes the listing after it, empty on the last page.
+*/
+type PlanPage struct {
+	Plans      []map[string]interface{} `json:"plans"`
+	NextCursor string                   `json:"nextCursor,omitempty"`
+}
+
+/*
+listCursor is the opaque cursor of a listing, base64url-encoded JSON. It keeps the sort it was
+made for, so it cannot resume a listing in another order.
+*/
+type listCursor struct {
+	Sort       string `json:"sort"`
+	Descending bool   `json:"desc,omitempty"`
+	SortValue  string `json:"value"`
+	ObjectID   string `json:"id"`
+}
+
+func encodeListCursor(query nodestore.ListQuery, position nodestore.ListPosition) string {
+	encoded, _ := json.Marshal(listCursor{
+		Sort:       query.Sort,
+		Descending: query.Descending,
+		SortValue:  position.SortValue,
+		ObjectID:   position.ObjectID,
+	})
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+func decodeListCursor(query nodestore.ListQuery, cursor string) (*nodestore.ListPosition, error) {
+	encoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var decoded listCursor
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	if decoded.Sort != query.Sort || decoded.Descending != query.Descending {
+		return nil, errors.New("the cursor was made for another sort order")
+	}
+	return &nodestore.ListPosition{SortValue: decoded.SortValue, ObjectID: decoded.ObjectID}, nil
+}
+
+/*
+projectFields returns the plan with only the given top-level fields, plus objectId and objectType.
+*/
+func projectFields(plan map[string]interface{}, fields []string) map[string]interface{} {
+	projected := map[string]interface{}{
+		"objectId":   plan["objectId"],
+		"objectType": plan["objectType"],
+	}
+	for _, field := range fields {
+		if value, ok := plan[field]; ok {
+			projected[field] = value
+		}
+	}
+	return projected
+}
+
+/*
+List returns a page of plans from the node store, cursor being the NextCursor of the previous
+page or empty for the first one. It reads one more root than the page holds to tell whether
+another page follows.
+*/
+func (s *PlanService) List(ctx context.Context, opts PlanListOptions, cursor string) (*PlanPage, *apperror.AppError) {
+	query := opts.Query
+	query.Root = s.resource.RootField
+	if cursor != "" {
+		after, err := decodeListCursor(query, cursor)
+		if err != nil {
+			return nil, apperror.NewInvalidListQueryError(err)
+		}
+		query.After = after
+	}
+	limit := query.Limit
+	query.Limit = limit + 1
+
+	roots, err := s.planRepository.ListPlanRoots(ctx, query)
+	if err != nil {
+		return nil, apperror.NewStorageError("Failed to list plans", err)
+	}
+
+	page := &PlanPage{Plans: []map[string]interface{}{}}
+	if len(roots) > limit {
+		roots = roots[:limit]
+		page.NextCursor = encodeListCursor(query, nodestore.PositionOf(roots[limit-1], query.Sort))
+	}
+
+	for _, root := range roots {
+		// the root node keeps its $ref stubs, without the stored-only fields
+		plan := utils.PublicDocument(root).(map[string]interface{})
+		if opts.Expand {
+			id, _ := root["objectId"].(string)
+			expanded, err := s.planRepository.GetPlan(id)
+			if errors.Is(err, nodestore.ErrNotFound) {
+				// deleted since it was listed
+				continue
+			}
+			if err != nil {
+				return nil, apperror.NewStorageError("Failed to get plan", err)
+			}
+			plan = expanded
+		}
+		if len(opts.Fields) > 0 {
+			plan = projectFields(plan, opts.Fields)
+		}
+		page.Plans = append(page.Plans, plan)
+	}
+
+	return page, nil
+}
+
+/*
+ListVersions returns the versions of the plan, oldest first. A plan stored before versions were
+recorded has none until its next write.
+*/
+func (s *PlanService) ListVersions(ctx context.Context, id string) ([]nodestore.Version, *apperror.AppError) {
+	versions, err := s.planRepository.ListVersions(ctx, id)
+	if err != nil {
+		return nil, apperror.NewStorageError("Failed to list plan versions", err)
+	}
+	if len(versions) == 0 && !s.planRepository.IsPlanExists(id) {
+		return nil, apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", id))
+	}
+	return versions, nil
+}
+
+/*
+GetVersion returns the plan as it was written in the given version.
+*/
+func (s *PlanService) GetVersion(ctx context.Context, id string, number int) (map[string]interface{}, *nodestore.Version, *apperror.AppError) {
+	version, err := s.planRepository.GetVersion(ctx, id, number)
+	return versionedPlan(id, version, err)
+}
+
+/*
+GetAsOf returns the plan as it was at asOf, from the latest version written at or before it.
+*/
+func (s *PlanService) GetAsOf(ctx context.Context, id string, asOf time.Time) (map[string]interface{}, *nodestore.Version, *apperror.AppError) {
+	version, err := s.planRepository.GetVersionAsOf(ctx, id, asOf)
+	return versionedPlan(id, version, err)
+}
+
+/*
+Diff compares the plan between two of its versions, to being the latest version when 0.
+A deleted plan compares as an empty graph.
+*/
+func (s *PlanService) Diff(ctx context.Context, id string, from, to int) (*graph.GraphDiff, int, *apperror.AppError) {
+	if to == 0 {
+		versions, appErr := s.ListVersions(ctx, id)
+		if appErr != nil {
+			return nil, 0, appErr
+		}
+		if len(versions) == 0 {
+			return nil, 0, apperror.NewPlanVersionNotFoundError(fmt.Errorf("Plan with ID %s has no versions", id))
+		}
+		to = versions[len(versions)-1].Number
+	}
+
+	plans := make([]map[string]interface{}, 2)
+	for i, number := range []int{from, to} {
+		version, err := s.planRepository.GetVersion(ctx, id, number)
+		if errors.Is(err, nodestore.ErrNotFound) {
+			return nil, 0, apperror.NewPlanVersionNotFoundError(fmt.Errorf("Plan with ID %s has no version %d", id, number))
+		}
+		if err != nil {
+			logger.Logger.Error("PlanService.Diff: failed to get plan version", zap.String("id", id), zap.Int("version", number), zap.Error(err))
+			return nil, 0, apperror.NewStorageError("Failed to get plan version", err)
+		}
+		plans[i] = version.Plan
+	}
+
+	return graph.Diff(plans[0], plans[1]), to, nil
+}
+
+func versionedPlan(id string, version *nodestore.Version, err error) (map[string]interface{}, *nodestore.Version, *apperror.AppError) {
+	if errors.Is(err, nodestore.ErrNotFound) {
+		return nil, nil, apperror.NewPlanVersionNotFoundError(fmt.Errorf("No such version of plan with ID %s", id))
+	}
+	if err != nil {
+		logger.Logger.Error("PlanService: failed to get plan version", zap.String("id", id), zap.Error(err))
+		return nil, nil, apperror.NewStorageError("Failed to get plan version", err)
+	}
+	if version.Plan == nil {
+		return nil, version, apperror.NewPlanVersionNotFoundError(fmt.Errorf("Plan with ID %s was deleted in version %d", id, version.Number))
+	}
+	return version.Plan, version, nil
+}
+
+const (
+	// ContentTypePartial is the partial plan merged by graph.Merge, nodes matched by objectId
+	ContentTypePartial    = "application/json"
+	ContentTypeMergePatch = "application/merge-patch+json"
+	ContentTypeJSONPatch  = "application/json-patch+json"
+)
+
+var PatchContentTypes = []string{ContentTypePartial, ContentTypeMergePatch, ContentTypeJSONPatch}
+
+/*
+patchPlan applies the PATCH body to a copy of the plan according to its content type: a partial
+plan (application/json), an RFC 7396 JSON Merge Patch or an RFC 6902 JSON Patch.
+*/
+func patchPlan(plan map[string]interface{}, contentType string, body []byte) (map[string]interface{}, *apperror.AppError) {
+	patched, err := graph.Normalize(plan)
+	if err != nil {
+		return nil, apperror.NewJSONMergeError(err)
+	}
+
+	switch contentType {
+	case ContentTypeMergePatch:
+		var patch interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, apperror.NewInvalidJSONError(err)
+		}
+		merged, ok := graph.MergePatch(patched, patch).(map[string]interface{})
+		if !ok {
+			return nil, apperror.NewInvalidJSONError(errors.New("a merge patch must be a JSON object to patch a plan"))
+		}
+		return merged, nil
+
+	case ContentTypeJSONPatch:
+		var ops []graph.PatchOperation
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, apperror.NewInvalidJSONError(err)
+		}
+		result, err := graph.ApplyPatch(patched, ops)
+		if errors.Is(err, graph.ErrPatchTestFailed) {
+			return nil, apperror.NewJSONPatchTestFailedError(err)
+		}
+		if err != nil {
+			return nil, apperror.NewJSONPatchError(err)
+		}
+		merged, ok := result.(map[string]interface{})
+		if !ok {
+			return nil, apperror.NewJSONPatchError(errors.New("the patched plan is not a JSON object"))
+		}
+		return merged, nil
+
+	default:
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return nil, apperror.NewInvalidJSONError(err)
+		}
+		// replaced nodes are removed by the storage once nothing references them
+		merged, _, err := graph.Merge(patched, payload)
+		if err != nil {
+			return nil, apperror.NewJSONMergeError(err)
+		}
+		return merged, nil
+	}
+}
+
+/*
+checkIfMatch checks an If-Match header against the ETag of the plan read for a write, with the
+strong comparison. The header may list several tags, or be "*" to match any existing plan.
+*/
+func checkIfMatch(plan map[string]interface{}, ifMatch string) *apperror.AppError {
+	etag, err := utils.CanonicalETag(plan)
+	if err != nil {
+		logger.Logger.Error("PlanService.checkIfMatch: failed to compute ETag", zap.Error(err))
+		return apperror.NewStorageError("Failed to compute ETag", err)
+	}
+	if !utils.MatchIfMatch(ifMatch, etag) {
+		return apperror.NewETagNotMatchError()
+	}
+	return nil
+}
+
+/*
+storeError maps a failed write of the plan to its error, a revision conflict being a failed precondition.
+*/
+func storeError(id string, err error) *apperror.AppError {
+	if errors.Is(err, nodestore.ErrRevisionConflict) {
+		return apperror.NewPlanModifiedError(id)
+	}
+	return apperror.NewStorageError("Failed to store plan", err)
+}
+
+/*
+Update patches the plan with the body, interpreted according to contentType (see patchPlan),
+and stores the result once it validates against the plan schema. ifMatch is checked against the
+plan the patch applies to, and the write only commits if no other write committed since.
+*/
 func (s *PlanService) Update(
 	ctx context.Context,
 	id string,
-	payload map[string]interface{},
+	ifMatch string,
+	contentType string,
+	body []byte,
 ) (map[string]interface{}, *apperror.AppError) {
-	if !s.planRepository.IsPlanExists(id) {
+	if !s.exists(ctx, id) {
 		logger.Logger.Warn("PlanService.Update: plan not found", zap.String("id", id))
 		return nil, apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", id))
 	}
@@ -106,33 +613,31 @@ func (s *PlanService) Update(
 		logger.Logger.Error("PlanService.Update: failed to get existing plan", zap.String("id", id), zap.Error(err))
 		return nil, apperror.NewStorageError("Failed to get plan", err)
 	}
+	if appErr := checkIfMatch(plan, ifMatch); appErr != nil {
+		return nil, appErr
+	}
 
-	mergedPayload, toDeleteObjects, err := graph.Merge(plan, payload)
-	if err != nil {
-		logger.Logger.Error("PlanService.Update: merge error", zap.Error(err))
-		return nil, apperror.NewJSONMergeError(err)
+	mergedPayload, appErr := patchPlan(plan, contentType, body)
+	if appErr != nil {
+		logger.Logger.Error("PlanService.Update: failed to patch plan", zap.String("contentType", contentType), zap.Error(appErr))
+		return nil, appErr
+	}
+	if mergedPayload["objectId"] != id {
+		return nil, apperror.NewObjectIdChangedError(id)
 	}
 
-	if err := schema.ValidateJsonSchema(mergedPayload, schema.GetPlanJsonSchema()); err != nil {
+	if err := schema.ValidateJsonSchema(mergedPayload, s.resource.Schema); err != nil {
 		logger.Logger.Error("PlanService.Update: invalid merged JSON", zap.Error(err))
 		return nil, apperror.NewInvalidJSONError(err)
 	}
 
-	nodes := graph.ExtractGraphNodes("plan", mergedPayload)
-	if err := s.planRepository.StorePlanNodes(nodes); err != nil {
+	nodes := graph.ExtractGraphNodes(s.resource.RootField, mergedPayload)
+	if err := s.storeNodes(ctx, id, nodes, nodestore.VersionUpdate, plan); err != nil {
 		logger.Logger.Error("PlanService.Update: failed to store nodes", zap.Error(err))
-		return nil, apperror.NewStorageError("Failed to store plan", err)
-	}
-
-	if err := s.publishNodes(nodes, "update"); err != nil {
-		logger.Logger.Error("PlanService.Update: publish update failed", zap.Error(err))
-		return nil, apperror.NewRabbitMQFailPublishError(err)
+		return nil, storeError(id, err)
 	}
 
-	if err := s.publishNodes(toDeleteObjects, "delete"); err != nil {
-		logger.Logger.Error("PlanService.Update: publish delete failed", zap.Error(err))
-		return nil, apperror.NewRabbitMQFailPublishError(err)
-	}
+	s.dispatchEvents()
 
 	plan, err = s.planRepository.GetPlan(id)
 	if err != nil {
@@ -143,76 +648,108 @@ func (s *PlanService) Update(
 	return plan, nil
 }
 
-func (s *PlanService) Delete(ctx context.Context, id string) *apperror.AppError {
-	// check if the plan exists
-	if !s.planRepository.IsPlanExists(id) {
-		logger.Logger.Warn("PlanService.Delete: plan not found", zap.String("id", id))
-		return apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", id))
+/*
+Replace replaces the whole plan with the payload. Nodes are matched by objectId against the stored
+graph: only added and changed nodes are written to the events, and nodes the plan no longer
+references are deleted unless another plan shares them. ifMatch is checked like for Update.
+*/
+func (s *PlanService) Replace(ctx context.Context, id string, ifMatch string, payload map[string]interface{}) (map[string]interface{}, *apperror.AppError) {
+	if payload["objectId"] != id {
+		return nil, apperror.NewObjectIdChangedError(id)
 	}
 
-	// delete the plan
-	nodes, err := s.planRepository.DeletePlan(id)
-	if err != nil {
-		logger.Logger.Error("PlanService.Delete: failed to delete plan", zap.String("id", id), zap.Error(err))
-		return apperror.NewStorageError("Failed to delete plan", err)
+	if err := schema.ValidateJsonSchema(payload, s.resource.Schema); err != nil {
+		logger.Logger.Error("PlanService.Replace: invalid JSON payload", zap.Error(err))
+		return nil, apperror.NewInvalidJSONError(err)
 	}
 
-	if err := s.publishNodes(nodes, "delete"); err != nil {
-		logger.Logger.Error("PlanService.Delete: publish delete failed", zap.Error(err))
-		return apperror.NewRabbitMQFailPublishError(err)
+	if !s.exists(ctx, id) {
+		logger.Logger.Warn("PlanService.Replace: plan not found", zap.String("id", id))
+		return nil, apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", id))
 	}
 
-	// delete the plan from Redis
-	if err := s.redisClient.Del(ctx, id).Err(); err != nil {
-		logger.Logger.Error("PlanService.Delete: failed to delete ETag", zap.String("id", id), zap.Error(err))
-		return apperror.NewStorageError("Failed to delete plan from Redis", err)
+	previous, err := s.planRepository.GetPlan(id)
+	if err != nil {
+		logger.Logger.Error("PlanService.Replace: failed to get existing plan", zap.String("id", id), zap.Error(err))
+		return nil, apperror.NewStorageError("Failed to get plan", err)
+	}
+	if appErr := checkIfMatch(previous, ifMatch); appErr != nil {
+		return nil, appErr
 	}
 
-	return nil
-}
-
-func (s *PlanService) GenerateETag(ctx context.Context, plan map[string]interface{}) (string, *apperror.AppError) {
-	etag := utils.GenerateETag([]byte(fmt.Sprintf("%v", plan)))
-	if err := s.redisClient.Set(ctx, plan["objectId"].(string), etag, 0).Err(); err != nil {
-		logger.Logger.Error("PlanService.GenerateETag: failed to set ETag", zap.String("id", plan["objectId"].(string)), zap.Error(err))
-		return "", apperror.NewRedisError("Failed to set ETag in Redis", err)
+	nodes := graph.ExtractGraphNodes(s.resource.RootField, payload)
+	if err := s.storeNodes(ctx, id, nodes, nodestore.VersionReplace, previous); err != nil {
+		logger.Logger.Error("PlanService.Replace: failed to store nodes", zap.Error(err))
+		return nil, storeError(id, err)
 	}
 
-	return etag, nil
-}
+	s.dispatchEvents()
 
-func (s *PlanService) GetETag(ctx context.Context, id string) (string, *apperror.AppError) {
-	etag, err := s.redisClient.Get(ctx, id).Result()
+	plan, err := s.planRepository.GetPlan(id)
 	if err != nil {
-		logger.Logger.Warn("PlanService.GetETag: failed to get ETag", zap.String("id", id), zap.Error(err))
-		if err == redis.Nil {
-			return "", apperror.NewPlanNotFoundError(fmt.Errorf("ETag not found for plan with ID %s", id))
-		}
-
-		return "", apperror.NewRedisError("Failed to get ETag from Redis", err)
+		logger.Logger.Error("PlanService.Replace: failed to re-fetch plan", zap.String("id", id), zap.Error(err))
+		return nil, apperror.NewStorageError("Failed to get plan", err)
 	}
 
-	return etag, nil
+	return plan, nil
 }
 
-func (s *PlanService) CheckETag(ctx context.Context, id string, ifMatch string) *apperror.AppError {
-	etag, err := s.GetETag(ctx, id)
-	if err != nil {
-		return err
+func (s *PlanService) Delete(ctx context.Context, id string) *apperror.AppError {
+	// check if the plan exists
+	if !s.exists(ctx, id) {
+		logger.Logger.Warn("PlanService.Delete: plan not found", zap.String("id", id))
+		return apperror.NewPlanNotFoundError(fmt.Errorf("Plan with ID %s not found", id))
 	}
 
-	if etag != ifMatch {
-		return apperror.NewETagNotMatchError()
+	// delete the plan together with its delete version and events
+	err := s.planRepository.WithTransaction(ctx, func(txCtx context.Context) error {
+		nodes, err := s.planRepository.DeletePlan(txCtx, id)
+		if err != nil {
+			return err
+		}
+		if _, err := s.planRepository.RecordVersion(txCtx, id, nodestore.VersionDelete, oauth.Author(ctx)); err != nil {
+			return err
+		}
+		return s.outbox.Enqueue(txCtx, nodeMessages(s.resource.Index, nodes, "delete", nil)...)
+	})
+	if err != nil {
+		logger.Logger.Error("PlanService.Delete: failed to delete plan", zap.String("id", id), zap.Error(err))
+		return apperror.NewStorageError("Failed to delete plan", err)
 	}
+
+	s.etagCache.Invalidate(ctx, id)
+	s.dispatchEvents()
 	return nil
 }
 
-func (s *PlanService) DeleteETag(ctx context.Context, id string) *apperror.AppError {
-	err := s.redisClient.Del(ctx, id).Err()
+/*
+GenerateETag computes the canonical ETag of the plan and refreshes its cached one, see GetETag.
+*/
+func (s *PlanService) GenerateETag(ctx context.Context, plan map[string]interface{}) (string, *apperror.AppError) {
+	etag, err := utils.CanonicalETag(plan)
 	if err != nil {
-		logger.Logger.Error("PlanService.DeleteETag: failed to delete ETag", zap.String("id", id), zap.Error(err))
-		return apperror.NewRedisError("Failed to delete ETag from Redis", err)
+		logger.Logger.Error("PlanService.GenerateETag: failed to compute ETag", zap.Error(err))
+		return "", apperror.NewStorageError("Failed to compute ETag", err)
 	}
 
-	return nil
+	id, _ := plan["objectId"].(string)
+	s.etagCache.Set(ctx, id, etag.String())
+	return etag.String(), nil
+}
+
+/*
+GetETag returns the ETag of the stored plan from the Redis cache, rebuilding it from the plan
+when it is missing. Every committed write drops the cached ETags of the plans it changed, a
+write to a node shared by several plans those of each of them.
+*/
+func (s *PlanService) GetETag(ctx context.Context, id string) (string, *apperror.AppError) {
+	if etag, ok := s.etagCache.Get(ctx, id); ok {
+		return etag, nil
+	}
+
+	plan, appErr := s.Get(ctx, id)
+	if appErr != nil {
+		return "", appErr
+	}
+	return s.GenerateETag(ctx, plan)
 }
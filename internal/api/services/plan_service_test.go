@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+
+	"eric-cw-hsu.github.io/internal/api/repositories"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/resource/resourcetest"
+	"eric-cw-hsu.github.io/internal/shared/apperror"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue/messages"
+	"go.uber.org/zap"
+)
+
+/*
+take returns the sorted keys of the pending node events with the action, and marks every
+pending event as sent. The relay of the tests is never started.
+*/
+func take(t *testing.T, events *outbox.MemoryStore, action string) []string {
+	t.Helper()
+	ctx := context.Background()
+	entries, err := events.FetchPending(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{}
+	for _, entry := range entries {
+		var base messagequeue.BaseMessage
+		var event messages.PlanNodeMessage
+		if err := json.Unmarshal(entry.Payload, &base); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(base.Body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Action == action {
+			keys = append(keys, event.Key)
+		}
+		if err := events.MarkSent(ctx, entry.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func newTestPlanService(t *testing.T, store nodestore.NodeStore) (*PlanService, *outbox.MemoryStore) {
+	t.Helper()
+	logger.Logger = zap.NewNop()
+
+	plans, ok := resource.NewDefaultRegistry().Get(resource.Plans)
+	if !ok {
+		t.Fatal("the plan resource is not registered")
+	}
+	events := outbox.NewMemoryStore()
+	relay := outbox.NewRelay(events, messagequeue.NewPublisher("plans", 0), 0, 0)
+	return NewPlanService(plans, events, relay, repositories.NewPlanRepository(store), repositories.NewETagCache(nil)), events
+}
+
+func planNodeIds(id, serviceId string) []string {
+	ids := []string{id, id + "-cost", id + "-planservice", id + "-service-cost", serviceId}
+	sort.Strings(ids)
+	return ids
+}
+
+func createPlan(t *testing.T, service *PlanService, id, serviceId string) map[string]interface{} {
+	t.Helper()
+	plan, appErr := service.Create(context.Background(), resourcetest.Plan(id, serviceId))
+	if appErr != nil {
+		t.Fatalf("Create(%s): %v", id, appErr)
+	}
+	return plan
+}
+
+func etagOf(t *testing.T, service *PlanService, plan map[string]interface{}) string {
+	t.Helper()
+	etag, appErr := service.GenerateETag(context.Background(), plan)
+	if appErr != nil {
+		t.Fatal(appErr)
+	}
+	return etag
+}
+
+func assertKeys(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("%s = %s, want %s", what, gotJSON, wantJSON)
+	}
+}
+
+func TestPlanServiceCreateAndGet(t *testing.T) {
+	ctx := context.Background()
+	service, events := newTestPlanService(t, nodestore.NewMemoryStore())
+
+	createPlan(t, service, "plan-1", "service-1")
+	assertKeys(t, "create events", take(t, events, "create"), planNodeIds("plan-1", "service-1"))
+
+	plan, appErr := service.Get(ctx, "plan-1")
+	if appErr != nil {
+		t.Fatalf("Get: %v", appErr)
+	}
+	services, _ := plan["linkedPlanServices"].([]interface{})
+	if len(services) != 1 {
+		t.Fatalf("plan has %d linked plan services, want 1", len(services))
+	}
+	linked, _ := services[0].(map[string]interface{})["linkedService"].(map[string]interface{})
+	if linked["name"] != "Yearly physical" {
+		t.Errorf("linkedService = %v, want the expanded service", linked)
+	}
+
+	if _, appErr := service.Create(ctx, resourcetest.Plan("plan-1", "service-1")); appErr == nil || appErr.Code != "PLAN_EXISTS" {
+		t.Errorf("second Create: %v, want PLAN_EXISTS", appErr)
+	}
+	if _, appErr := service.Create(ctx, map[string]interface{}{"objectId": "plan-2", "objectType": "plan"}); appErr == nil || appErr.Code != "INVALID_JSON" {
+		t.Errorf("Create of an invalid plan: %v, want INVALID_JSON", appErr)
+	}
+
+	// a child node is not served as a plan
+	if _, appErr := service.Get(ctx, "plan-1-cost"); appErr == nil || appErr.StatusCode != 404 {
+		t.Errorf("Get of a child node: %v, want a 404", appErr)
+	}
+}
+
+func TestPlanServiceUpdate(t *testing.T) {
+	ctx := context.Background()
+	service, events := newTestPlanService(t, nodestore.NewMemoryStore())
+	plan := createPlan(t, service, "plan-1", "service-1")
+	take(t, events, "create")
+
+	patch := []byte(`{"planType": "outOfNetwork"}`)
+	if _, appErr := service.Update(ctx, "plan-1", `"stale"`, ContentTypeMergePatch, patch); appErr == nil || appErr.Code != "ETAG_NOT_MATCH" {
+		t.Fatalf("Update with a stale ETag: %v, want ETAG_NOT_MATCH", appErr)
+	}
+
+	updated, appErr := service.Update(ctx, "plan-1", etagOf(t, service, plan), ContentTypeMergePatch, patch)
+	if appErr != nil {
+		t.Fatalf("Update: %v", appErr)
+	}
+	if updated["planType"] != "outOfNetwork" {
+		t.Errorf("planType = %v, want outOfNetwork", updated["planType"])
+	}
+	if etagOf(t, service, updated) == etagOf(t, service, plan) {
+		t.Error("the ETag did not change with the plan")
+	}
+	if keys := take(t, events, "update"); len(keys) == 0 {
+		t.Error("the update enqueued no event")
+	}
+
+	// the ETag read before the update no longer matches
+	if _, appErr := service.Update(ctx, "plan-1", etagOf(t, service, plan), ContentTypeMergePatch, patch); appErr == nil || appErr.StatusCode != 412 {
+		t.Errorf("Update with the previous ETag: %v, want a 412", appErr)
+	}
+
+	versions, appErr := service.ListVersions(ctx, "plan-1")
+	if appErr != nil {
+		t.Fatalf("ListVersions: %v", appErr)
+	}
+	if len(versions) != 2 || versions[1].Action != nodestore.VersionUpdate {
+		t.Errorf("versions = %+v, want create then update", versions)
+	}
+}
+
+func TestPlanServiceUpdateCollectsReplacedNodes(t *testing.T) {
+	ctx := context.Background()
+	store := nodestore.NewMemoryStore()
+	service, events := newTestPlanService(t, store)
+	plan := createPlan(t, service, "plan-1", "service-1")
+	take(t, events, "create")
+
+	// a cost share with another objectId replaces the stored one
+	patch := []byte(`{"planCostShares": {"deductible": 1000, "_org": "example.com", "copay": 10, "objectId": "plan-1-cost-2", "objectType": "membercostshare"}}`)
+	if _, appErr := service.Update(ctx, "plan-1", etagOf(t, service, plan), ContentTypeMergePatch, patch); appErr != nil {
+		t.Fatalf("Update: %v", appErr)
+	}
+
+	assertKeys(t, "delete events", take(t, events, "delete"), []string{"plan-1-cost"})
+	if exists, _ := store.Exists(ctx, "plan-1-cost"); exists {
+		t.Error("the replaced cost share is still stored")
+	}
+}
+
+func TestPlanServiceDeleteCollectsUnreferencedNodes(t *testing.T) {
+	ctx := context.Background()
+	store := nodestore.NewMemoryStore()
+	service, events := newTestPlanService(t, store)
+	createPlan(t, service, "plan-1", "service-shared")
+	createPlan(t, service, "plan-2", "service-shared")
+	take(t, events, "create")
+
+	// the linked service is shared with plan-2 and kept
+	if appErr := service.Delete(ctx, "plan-1"); appErr != nil {
+		t.Fatalf("Delete(plan-1): %v", appErr)
+	}
+	assertKeys(t, "delete events of plan-1", take(t, events, "delete"), []string{"plan-1", "plan-1-cost", "plan-1-planservice", "plan-1-service-cost"})
+	if exists, _ := store.Exists(ctx, "service-shared"); !exists {
+		t.Fatal("the service shared with plan-2 was removed")
+	}
+	if _, appErr := service.Get(ctx, "plan-2"); appErr != nil {
+		t.Errorf("Get(plan-2) after deleting plan-1: %v", appErr)
+	}
+
+	if appErr := service.Delete(ctx, "plan-2"); appErr != nil {
+		t.Fatalf("Delete(plan-2): %v", appErr)
+	}
+	assertKeys(t, "delete events of plan-2", take(t, events, "delete"), planNodeIds("plan-2", "service-shared"))
+
+	if appErr := service.Delete(ctx, "plan-2"); appErr == nil || appErr.StatusCode != 404 {
+		t.Errorf("second Delete: %v, want a 404", appErr)
+	}
+}
+
+/*
+barrierStore holds every transaction until the writers added to arrived reached it, so they all
+read the plan before any of them commits.
+*/
+type barrierStore struct {
+	nodestore.NodeStore
+	arrived sync.WaitGroup
+}
+
+func (s *barrierStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	s.arrived.Done()
+	s.arrived.Wait()
+	return s.NodeStore.WithTransaction(ctx, fn)
+}
+
+func TestPlanServiceConcurrentCreates(t *testing.T) {
+	barrier := &barrierStore{NodeStore: nodestore.NewMemoryStore()}
+	barrier.arrived.Add(2)
+	service, events := newTestPlanService(t, barrier)
+
+	// both creates pass validation before either commits
+	results := make(chan *apperror.AppError, 2)
+	for i := 0; i < 2; i++ {
+		plan := resourcetest.Plan("plan-1", "service-1")
+		go func() {
+			_, appErr := service.Create(context.Background(), plan)
+			results <- appErr
+		}()
+	}
+
+	var conflicts []*apperror.AppError
+	for i := 0; i < 2; i++ {
+		if appErr := <-results; appErr != nil {
+			conflicts = append(conflicts, appErr)
+		}
+	}
+	if len(conflicts) != 1 || conflicts[0].Code != "PLAN_EXISTS" || conflicts[0].StatusCode != 409 {
+		t.Fatalf("failed creates = %v, want exactly one 409 PLAN_EXISTS", conflicts)
+	}
+
+	versions, appErr := service.ListVersions(context.Background(), "plan-1")
+	if appErr != nil {
+		t.Fatalf("ListVersions: %v", appErr)
+	}
+	if len(versions) != 1 {
+		t.Errorf("plan has %d versions, want the one create", len(versions))
+	}
+	if keys := take(t, events, "create"); len(keys) != len(planNodeIds("plan-1", "service-1")) {
+		t.Errorf("create events = %v, want the events of one create", keys)
+	}
+}
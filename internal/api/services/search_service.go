@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/shared/apperror"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.uber.org/zap"
+)
+
+type SearchService struct {
+	esClient *elasticsearch.Client
+}
+
+func NewSearchService(esClient *elasticsearch.Client) *SearchService {
+	return &SearchService{
+		esClient: esClient,
+	}
+}
+
+func (s *SearchService) SearchPlans(ctx context.Context, filter elasticsearch.PlanSearchFilter) (*elasticsearch.SearchResult, *apperror.AppError) {
+	result, err := s.esClient.Search(ctx, elasticsearch.BuildPlanSearchQuery(filter))
+	if err != nil {
+		logger.Logger.Error("SearchService.SearchPlans: search failed", zap.Error(err))
+		return nil, apperror.NewSearchError(err)
+	}
+
+	return result, nil
+}
+
+func (s *SearchService) SearchNodes(ctx context.Context, search elasticsearch.JoinSearch) (*elasticsearch.SearchResult, *apperror.AppError) {
+	query, err := elasticsearch.BuildJoinQuery(search)
+	if err != nil {
+		logger.Logger.Warn("SearchService.SearchNodes: invalid join search", zap.Error(err))
+		return nil, apperror.NewInvalidSearchQueryError(err)
+	}
+
+	result, err := s.esClient.Search(ctx, query)
+	if err != nil {
+		logger.Logger.Error("SearchService.SearchNodes: search failed", zap.Error(err))
+		return nil, apperror.NewSearchError(err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// storedFields are kept by the node stores on each node and are not part of the public document
+var storedFields = []string{"_id", "parentId", "fieldName", "referencedBy", "refCount", "_rev", "_creationDate"}
+
+/*
+ETag is an entity tag, formatted "<value>" when strong and W/"<value>" when weak.
+*/
+type ETag struct {
+	Value string
+	Weak  bool
+}
+
+func (e ETag) String() string {
+	if e.Weak {
+		return `W/"` + e.Value + `"`
+	}
+	return `"` + e.Value + `"`
+}
+
+/*
+PublicDocument returns a copy of an expanded node without the fields the stores keep on every
+node, at any depth.
+*/
+func PublicDocument(doc interface{}) interface{} {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		public := make(map[string]interface{}, len(d))
+		for k, v := range d {
+			public[k] = PublicDocument(v)
+		}
+		for _, field := range storedFields {
+			delete(public, field)
+		}
+		return public
+	case []interface{}:
+		public := make([]interface{}, len(d))
+		for i, v := range d {
+			public[i] = PublicDocument(v)
+		}
+		return public
+	default:
+		return doc
+	}
+}
+
+/*
+CanonicalETag returns the strong ETag of an expanded node (a whole plan or any node in it): the
+hash of the canonical JSON of its public document, with object keys sorted and values normalized
+through JSON, so equal content gets equal tags whatever store it was read from.
+*/
+func CanonicalETag(doc map[string]interface{}) (ETag, error) {
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return ETag{}, err
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return ETag{}, err
+	}
+
+	// encoding/json writes map keys in sorted order
+	canonical, err := json.Marshal(PublicDocument(normalized))
+	if err != nil {
+		return ETag{}, err
+	}
+	return ETag{Value: GenerateETag(canonical)}, nil
+}
+
+/*
+ParseETags parses an If-Match or If-None-Match header: a comma-separated list of strong or weak
+entity tags, or "*" (wildcard reported true). Malformed entries are skipped.
+*/
+func ParseETags(header string) (tags []ETag, wildcard bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return nil, true
+	}
+
+	for header != "" {
+		weak := false
+		if strings.HasPrefix(header, "W/") {
+			weak = true
+			header = header[2:]
+		}
+
+		if !strings.HasPrefix(header, `"`) {
+			// not an entity tag, skip to the next entry
+			next := strings.IndexByte(header, ',')
+			if next < 0 {
+				break
+			}
+			header = strings.TrimSpace(header[next+1:])
+			continue
+		}
+		end := strings.IndexByte(header[1:], '"')
+		if end < 0 {
+			break
+		}
+		tags = append(tags, ETag{Value: header[1 : end+1], Weak: weak})
+
+		header = strings.TrimSpace(header[end+2:])
+		header = strings.TrimSpace(strings.TrimPrefix(header, ","))
+	}
+	return tags, false
+}
+
+/*
+MatchIfMatch reports whether the current ETag satisfies an If-Match header, using the strong
+comparison: weak tags never match.
+*/
+func MatchIfMatch(header string, current ETag) bool {
+	tags, wildcard := ParseETags(header)
+	if wildcard {
+		return true
+	}
+	for _, tag := range tags {
+		if !tag.Weak && !current.Weak && tag.Value == current.Value {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+MatchIfNoneMatch reports whether the current ETag matches an If-None-Match header, using the
+weak comparison: the W/ prefix is ignored.
+*/
+func MatchIfNoneMatch(header string, current ETag) bool {
+	tags, wildcard := ParseETags(header)
+	if wildcard {
+		return true
+	}
+	for _, tag := range tags {
+		if tag.Value == current.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseETags(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		tags     []ETag
+		wildcard bool
+	}{
+		{"empty", ``, nil, false},
+		{"strong", `"abc"`, []ETag{{Value: "abc"}}, false},
+		{"weak", `W/"abc"`, []ETag{{Value: "abc", Weak: true}}, false},
+		{"empty tag", `""`, []ETag{{Value: ""}}, false},
+		{"multi-value", `"a", W/"b" ,"c"`, []ETag{{Value: "a"}, {Value: "b", Weak: true}, {Value: "c"}}, false},
+		{"comma inside a tag", `"a,b", "c"`, []ETag{{Value: "a,b"}, {Value: "c"}}, false},
+		{"wildcard", `*`, nil, true},
+		{"wildcard with spaces", `  * `, nil, true},
+		{"wildcard in a list", `*, "a"`, []ETag{{Value: "a"}}, false},
+		{"unquoted entry skipped", `abc, "a"`, []ETag{{Value: "a"}}, false},
+		{"lowercase weak prefix skipped", `w/"a", "b"`, []ETag{{Value: "b"}}, false},
+		{"space after the weak prefix skipped", `W/ "a", "b"`, []ETag{{Value: "b"}}, false},
+		{"unterminated tag", `"a", "b`, []ETag{{Value: "a"}}, false},
+		{"unquoted only", `abc`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, wildcard := ParseETags(tt.header)
+			if fmt.Sprint(tags) != fmt.Sprint(tt.tags) || wildcard != tt.wildcard {
+				t.Errorf("ParseETags(%q) = %v, %v, want %v, %v", tt.header, tags, wildcard, tt.tags, tt.wildcard)
+			}
+		})
+	}
+}
+
+func TestMatchETags(t *testing.T) {
+	strong := ETag{Value: "abc"}
+	weak := ETag{Value: "abc", Weak: true}
+
+	tests := []struct {
+		name        string
+		header      string
+		current     ETag
+		ifMatch     bool
+		ifNoneMatch bool
+	}{
+		{"same strong tag", `"abc"`, strong, true, true},
+		{"other tag", `"abd"`, strong, false, false},
+		{"weak header tag", `W/"abc"`, strong, false, true},
+		{"weak current tag", `"abc"`, weak, false, true},
+		{"both weak", `W/"abc"`, weak, false, true},
+		{"one of several", `"x", "abc", "y"`, strong, true, true},
+		{"weak one of several", `"x", W/"abc"`, strong, false, true},
+		{"none of several", `"x", "y"`, strong, false, false},
+		{"wildcard", `*`, strong, true, true},
+		{"empty header", ``, strong, false, false},
+		{"malformed header", `abc`, strong, false, false},
+		{"unterminated tag", `"abc`, strong, false, false},
+		{"case-sensitive", `"ABC"`, strong, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchIfMatch(tt.header, tt.current); got != tt.ifMatch {
+				t.Errorf("MatchIfMatch(%q, %s) = %v, want %v", tt.header, tt.current, got, tt.ifMatch)
+			}
+			if got := MatchIfNoneMatch(tt.header, tt.current); got != tt.ifNoneMatch {
+				t.Errorf("MatchIfNoneMatch(%q, %s) = %v, want %v", tt.header, tt.current, got, tt.ifNoneMatch)
+			}
+		})
+	}
+}
+
+func TestETagString(t *testing.T) {
+	for _, tt := range []struct {
+		tag  ETag
+		want string
+	}{
+		{ETag{Value: "abc"}, `"abc"`},
+		{ETag{Value: "abc", Weak: true}, `W/"abc"`},
+	} {
+		if got := tt.tag.String(); got != tt.want {
+			t.Errorf("%+v.String() = %s, want %s", tt.tag, got, tt.want)
+		}
+		// a formatted tag parses back to itself
+		if tags, _ := ParseETags(tt.tag.String()); len(tags) != 1 || tags[0] != tt.tag {
+			t.Errorf("ParseETags(%s) = %v, want %+v", tt.tag, tags, tt.tag)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+type SQLService struct {
+	db *sql.DB
+}
+
+/*
+NewSQLService opens a SQLite (driver "sqlite", dsn a file path) or PostgreSQL (driver "postgres",
+dsn a connection URL) database. Queries use $n placeholders, which both understand.
+*/
+func NewSQLService(driver, dsn string) (*SQLService, error) {
+	if driver != DriverSQLite && driver != DriverPostgres {
+		return nil, fmt.Errorf("unsupported SQL driver %q", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverSQLite {
+		// SQLite has a single writer, one connection avoids "database is locked" errors
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLService{
+		db: db,
+	}, nil
+}
+
+func (s *SQLService) GetDB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLService) Close() {
+	if err := s.db.Close(); err != nil {
+		log.Printf("Failed to close SQL database: %v", err)
+	}
+}
+
+/*
+SQLExecutor is implemented by *sql.DB and *sql.Tx.
+*/
+type SQLExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type sqlTxKey struct{}
+
+type sqlTx struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+/*
+WithSQLTransaction runs fn in a transaction of db, committed when fn succeeds. Queries made
+through SQLExecutorFrom with the ctx passed to fn join it, and a call made with a ctx already
+inside a transaction of db runs fn in that transaction.
+*/
+func WithSQLTransaction(ctx context.Context, db *sql.DB, fn func(ctx context.Context) error) error {
+	if current, ok := ctx.Value(sqlTxKey{}).(sqlTx); ok && current.db == db {
+		return fn(ctx)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+
+	if err := fn(context.WithValue(ctx, sqlTxKey{}, sqlTx{db: db, tx: tx})); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Printf("Failed to roll back transaction: %v", rollbackErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+SQLExecutorFrom returns the transaction of db carried by ctx, or db itself outside a transaction.
+*/
+func SQLExecutorFrom(ctx context.Context, db *sql.DB) SQLExecutor {
+	if current, ok := ctx.Value(sqlTxKey{}).(sqlTx); ok && current.db == db {
+		return current.tx
+	}
+	return db
+}
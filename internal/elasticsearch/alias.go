@@ -0,0 +1,176 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+/*
+The configured index name is an alias. Documents live in versioned physical indices
+(plans_v1, plans_v2, ...) and the alias points to the current one as its write index,
+so a new mapping is rolled out by building the next version and swapping the alias.
+*/
+
+func VersionedIndexName(alias string, version int) string {
+	return fmt.Sprintf("%s_v%d", alias, version)
+}
+
+/*
+IndexVersion returns the version of a physical index of the alias, or 0 when the name
+is not one of its versioned indices.
+*/
+func IndexVersion(alias, index string) int {
+	suffix, ok := strings.CutPrefix(index, alias+"_v")
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(suffix)
+	if err != nil || version <= 0 {
+		return 0
+	}
+	return version
+}
+
+/*
+AliasIndices returns the physical indices the alias points to, none when the alias does not exist.
+*/
+func (c *Client) AliasIndices(alias string) ([]string, error) {
+	res, err := c.es.Indices.GetAlias(c.es.Indices.GetAlias.WithName(alias))
+	if err != nil {
+		return nil, fmt.Errorf("alias lookup failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
+	}
+
+	var indices map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return nil, fmt.Errorf("failed to decode alias response: %w", err)
+	}
+
+	names := make([]string, 0, len(indices))
+	for name := range indices {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+/*
+LatestIndexVersion returns the highest version among the existing physical indices of the alias,
+whether the alias points to it or not, and 0 when there is none.
+*/
+func (c *Client) LatestIndexVersion(alias string) (int, error) {
+	res, err := c.es.Indices.Get([]string{alias + "_v*"})
+	if err != nil {
+		return 0, fmt.Errorf("index lookup failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return 0, &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
+	}
+
+	var indices map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return 0, fmt.Errorf("failed to decode index response: %w", err)
+	}
+
+	latest := 0
+	for name := range indices {
+		if version := IndexVersion(alias, name); version > latest {
+			latest = version
+		}
+	}
+	return latest, nil
+}
+
+/*
+SwapAlias points the alias to index in a single _aliases request, removing it from the previous
+indices. A concrete index named like the alias (created before indices were versioned) is
+deleted in the same request, so readers and writers never see the alias missing.
+*/
+func (c *Client) SwapAlias(alias, index string, previous []string) error {
+	actions := []map[string]interface{}{
+		{"add": map[string]interface{}{"index": index, "alias": alias, "is_write_index": true}},
+	}
+	for _, old := range previous {
+		if old != index {
+			actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": old, "alias": alias}})
+		}
+	}
+
+	if len(previous) == 0 {
+		exists, err := c.IndexExists(alias)
+		if err != nil {
+			return err
+		}
+		if exists {
+			actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": alias}})
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return fmt.Errorf("failed to encode alias actions: %w", err)
+	}
+
+	res, err := c.es.Indices.UpdateAliases(strings.NewReader(string(body)))
+	if err != nil {
+		return fmt.Errorf("alias swap failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
+	}
+
+	log.Printf("Alias %s now points to %s (previously %v)", alias, index, previous)
+	return nil
+}
+
+/*
+SetWriteBlock sets or lifts index.blocks.write on the indices. While it is set, Elasticsearch
+rejects writes to them with a cluster_block_exception, which IsClientError reports as retryable.
+*/
+func (c *Client) SetWriteBlock(indices []string, blocked bool) error {
+	if len(indices) == 0 {
+		return nil
+	}
+
+	body := fmt.Sprintf(`{"index":{"blocks":{"write":%t}}}`, blocked)
+	res, err := c.es.Indices.PutSettings(strings.NewReader(body), c.es.Indices.PutSettings.WithIndex(indices...))
+	if err != nil {
+		return fmt.Errorf("write block update failed: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
+	}
+
+	log.Printf("Write block of %v set to %t", indices, blocked)
+	return nil
+}
+
+/*
+withAlias adds the alias, as write index, to an index creation body.
+*/
+func withAlias(mapping, alias string) (string, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+		return "", fmt.Errorf("invalid index mapping: %w", err)
+	}
+	body["aliases"] = map[string]interface{}{
+		alias: map[string]interface{}{"is_write_index": true},
+	}
+
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
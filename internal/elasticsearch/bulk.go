@@ -0,0 +1,247 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	BulkActionIndex  = "index"
+	BulkActionDelete = "delete"
+
+	// bulkActionFlush is a marker queued by Flush behind the operations added before it
+	bulkActionFlush = "flush"
+
+	defaultBulkFlushSize     = 500
+	defaultBulkFlushBytes    = 5 * 1024 * 1024
+	defaultBulkFlushInterval = time.Second
+)
+
+type BulkConfig struct {
+	FlushSize     int           `mapstructure:"flush_size"`
+	FlushBytes    int           `mapstructure:"flush_bytes"`
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+}
+
+/*
+BulkOperation is one index or delete of a document, in Index or the index of the client when empty.
+Done is called once with the outcome of the operation's bulk item, or with the request error when
+the whole bulk request failed.
+*/
+type BulkOperation struct {
+	Action   string
+	Index    string
+	ID       string
+	Routing  string
+	Document map[string]interface{}
+	Done     func(error)
+}
+
+/*
+BulkIndexer buffers operations and sends them through the _bulk API when FlushSize operations
+or FlushBytes bytes are buffered, or FlushInterval has elapsed. A single worker sends the
+requests so operations on the same document are applied in the order they were added.
+*/
+type BulkIndexer struct {
+	client *Client
+	config BulkConfig
+	ops    chan BulkOperation
+	closed chan struct{}
+
+	buf     bytes.Buffer
+	pending []BulkOperation
+}
+
+func NewBulkIndexer(client *Client, config BulkConfig) *BulkIndexer {
+	if config.FlushSize <= 0 {
+		config.FlushSize = defaultBulkFlushSize
+	}
+	if config.FlushBytes <= 0 {
+		config.FlushBytes = defaultBulkFlushBytes
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultBulkFlushInterval
+	}
+
+	b := &BulkIndexer{
+		client: client,
+		config: config,
+		ops:    make(chan BulkOperation, config.FlushSize),
+		closed: make(chan struct{}),
+	}
+	go b.run()
+
+	return b
+}
+
+/*
+FlushSize returns the number of buffered operations that triggers a flush.
+*/
+func (b *BulkIndexer) FlushSize() int {
+	return b.config.FlushSize
+}
+
+func (b *BulkIndexer) Add(op BulkOperation) {
+	b.ops <- op
+}
+
+/*
+Flush sends the operations added so far and returns once all of them are settled.
+*/
+func (b *BulkIndexer) Flush() {
+	flushed := make(chan struct{})
+	b.ops <- BulkOperation{Action: bulkActionFlush, Done: func(error) { close(flushed) }}
+	<-flushed
+}
+
+/*
+Close flushes the buffered operations and stops the worker.
+*/
+func (b *BulkIndexer) Close() {
+	close(b.ops)
+	<-b.closed
+}
+
+func (b *BulkIndexer) run() {
+	defer close(b.closed)
+
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case op, ok := <-b.ops:
+			if !ok {
+				b.flush()
+				return
+			}
+			if op.Action == bulkActionFlush {
+				b.flush()
+				op.Done(nil)
+				continue
+			}
+			b.buffer(op)
+			if len(b.pending) >= b.config.FlushSize || b.buf.Len() >= b.config.FlushBytes {
+				b.flush()
+			}
+		case <-ticker.C:
+			b.flush()
+		}
+	}
+}
+
+func (b *BulkIndexer) buffer(op BulkOperation) {
+	meta := map[string]interface{}{"_id": op.ID}
+	if op.Index != "" {
+		meta["_index"] = op.Index
+	}
+	if op.Routing != "" {
+		meta["routing"] = op.Routing
+	}
+
+	header, err := json.Marshal(map[string]interface{}{op.Action: meta})
+	if err != nil {
+		op.Done(fmt.Errorf("failed to encode bulk metadata of %s: %w", op.ID, err))
+		return
+	}
+
+	var source []byte
+	if op.Action == BulkActionIndex {
+		if source, err = json.Marshal(op.Document); err != nil {
+			op.Done(fmt.Errorf("failed to encode document %s: %w", op.ID, err))
+			return
+		}
+	}
+
+	b.buf.Write(header)
+	b.buf.WriteByte('\n')
+	if source != nil {
+		b.buf.Write(source)
+		b.buf.WriteByte('\n')
+	}
+	b.pending = append(b.pending, op)
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+func (b *BulkIndexer) flush() {
+	if len(b.pending) == 0 {
+		return
+	}
+
+	ops := b.pending
+	body := bytes.NewReader(b.buf.Bytes())
+	defer func() {
+		b.pending = nil
+		b.buf.Reset()
+	}()
+
+	res, err := b.client.es.Bulk(body, b.client.es.Bulk.WithIndex(b.client.index))
+	if err != nil {
+		log.Printf("Bulk request of %d operations failed: %v", len(ops), err)
+		failAll(ops, fmt.Errorf("bulk request failed: %w", err))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		log.Printf("Bulk request of %d operations failed: %s", len(ops), res.String())
+		failAll(ops, &ResponseError{StatusCode: res.StatusCode, Body: res.String()})
+		return
+	}
+
+	var parsed bulkResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		log.Printf("Failed to decode bulk response: %v", err)
+		failAll(ops, fmt.Errorf("failed to decode bulk response: %w", err))
+		return
+	}
+	if len(parsed.Items) != len(ops) {
+		log.Printf("Bulk response has %d items for %d operations", len(parsed.Items), len(ops))
+		failAll(ops, fmt.Errorf("bulk response has %d items for %d operations", len(parsed.Items), len(ops)))
+		return
+	}
+
+	failed := 0
+	for i, op := range ops {
+		item := parsed.Items[i][op.Action]
+		switch {
+		case item.Status >= 200 && item.Status < 300:
+			op.Done(nil)
+		case op.Action == BulkActionDelete && item.Status == 404:
+			// the document is already gone, deleting it again is a no-op
+			op.Done(nil)
+		default:
+			failed++
+			reason := ""
+			if item.Error != nil {
+				reason = item.Error.Type + ": " + item.Error.Reason
+			}
+			log.Printf("Bulk %s of document %s failed [%d]: %s", op.Action, op.ID, item.Status, reason)
+			op.Done(&ResponseError{StatusCode: item.Status, Body: reason})
+		}
+	}
+
+	log.Printf("Bulk request flushed %d operations, %d failed", len(ops), failed)
+}
+
+func failAll(ops []BulkOperation, err error) {
+	for _, op := range ops {
+		op.Done(err)
+	}
+}
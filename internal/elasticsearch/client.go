@@ -3,6 +3,7 @@ package elasticsearch
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -28,18 +29,31 @@ func NewElasticSearchClient(address, username, password, index string) (*Client,
 	return &Client{es: es, index: index}, nil
 }
 
-func (c *Client) InitIndex(mapping string) error {
-	res, err := c.es.Indices.Exists([]string{c.index})
+/*
+WithIndex returns a client sharing the connection but targeting another index.
+*/
+func (c *Client) WithIndex(index string) *Client {
+	return &Client{es: c.es, index: index}
+}
+
+func (c *Client) Index() string {
+	return c.index
+}
+
+func (c *Client) IndexExists(index string) (bool, error) {
+	res, err := c.es.Indices.Exists([]string{index})
 	if err != nil {
-		return fmt.Errorf("index check failed: %w", err)
+		return false, fmt.Errorf("index check failed: %w", err)
 	}
 	defer res.Body.Close()
-	if res.StatusCode == 200 {
-		log.Printf("Index %s already exists", c.index)
-		return nil
-	}
+	return res.StatusCode == 200, nil
+}
 
-	res, err = c.es.Indices.Create(c.index, c.es.Indices.Create.WithBody(strings.NewReader(mapping)))
+/*
+CreateIndex creates the index with the mapping, failing if it already exists.
+*/
+func (c *Client) CreateIndex(index, mapping string) error {
+	res, err := c.es.Indices.Create(index, c.es.Indices.Create.WithBody(strings.NewReader(mapping)))
 	if err != nil {
 		return fmt.Errorf("index creation failed: %w", err)
 	}
@@ -47,13 +61,80 @@ func (c *Client) InitIndex(mapping string) error {
 	if res.IsError() {
 		return fmt.Errorf("index creation error: %s", res.String())
 	}
-	log.Printf("Index %s created successfully", c.index)
-
+	log.Printf("Index %s created successfully", index)
 	return nil
 }
 
-func (c *Client) IndexDocument(id string, doc map[string]interface{}, routing string) {
+/*
+InitIndex makes sure the configured alias exists. The first start creates the index version 1
+with the mapping behind the alias, later starts keep the current version: mapping changes are
+rolled out with the reindex -migrate command.
+*/
+func (c *Client) InitIndex(mapping string) error {
+	indices, err := c.AliasIndices(c.index)
+	if err != nil {
+		return err
+	}
+	if len(indices) > 0 {
+		log.Printf("Index alias %s points to %v", c.index, indices)
+		return nil
+	}
+
+	exists, err := c.IndexExists(c.index)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("Index %s is a concrete index, run the reindex -migrate command to move it behind an alias", c.index)
+		return nil
+	}
+
+	body, err := withAlias(mapping, c.index)
+	if err != nil {
+		return err
+	}
+	return c.CreateIndex(VersionedIndexName(c.index, 1), body)
+}
+
+/*
+ResponseError is returned when Elasticsearch answers a request with an error status.
+*/
+type ResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("elasticsearch error [%d]: %s", e.StatusCode, e.Body)
+}
+
+/*
+IsClientError reports whether Elasticsearch rejected the request itself (bad document,
+mapping conflict...), which retrying will not fix. 429 Too Many Requests is not one, nor is a
+write to an index blocked while the reindex -migrate command swaps its alias (see SetWriteBlock).
+*/
+func IsClientError(err error) bool {
+	var responseErr *ResponseError
+	return errors.As(err, &responseErr) &&
+		responseErr.StatusCode >= 400 && responseErr.StatusCode < 500 && responseErr.StatusCode != 429 &&
+		!strings.Contains(responseErr.Body, "cluster_block_exception")
+}
+
+/*
+BuildDocument converts a graph node into the indexed document: the parentId and fieldName
+bookkeeping fields become the join_field and the store internals (edges, plan revision, sortable
+creation date) are dropped.
+*/
+func BuildDocument(node map[string]interface{}) map[string]interface{} {
+	doc := make(map[string]interface{}, len(node))
+	for k, v := range node {
+		doc[k] = v
+	}
 	delete(doc, "_id")
+	delete(doc, "refCount")
+	delete(doc, "referencedBy")
+	delete(doc, "_rev")
+	delete(doc, "_creationDate")
 
 	doc["join_field"] = map[string]interface{}{
 		"name":   doc["fieldName"],
@@ -62,7 +143,24 @@ func (c *Client) IndexDocument(id string, doc map[string]interface{}, routing st
 	delete(doc, "parentId")
 	delete(doc, "fieldName")
 
-	body, _ := json.Marshal(doc)
+	return doc
+}
+
+/*
+DocumentRouting returns the routing of a node's document, children are routed by their parent.
+*/
+func DocumentRouting(node map[string]interface{}) string {
+	parentId, _ := node["parentId"].(string)
+	return parentId
+}
+
+func (c *Client) IndexDocument(id string, node map[string]interface{}, routing string) error {
+	doc := BuildDocument(node)
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to encode document %s: %w", id, err)
+	}
 	res, err := c.es.Index(
 		c.index, bytes.NewReader(body),
 		c.es.Index.WithDocumentID(id),
@@ -70,30 +168,38 @@ func (c *Client) IndexDocument(id string, doc map[string]interface{}, routing st
 	)
 	if err != nil {
 		log.Printf("Failed to index document: %v", err)
-		return
+		return fmt.Errorf("index request failed: %w", err)
 	}
 	defer res.Body.Close()
 
 	if res.IsError() {
 		log.Printf("Error indexing document: %s", res.String())
-		return
+		return &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
 	}
 
 	log.Printf("Document %s indexed successfully", id)
+	return nil
 }
 
-func (c *Client) DeleteDocument(id string) {
+func (c *Client) DeleteDocument(id string) error {
 	res, err := c.es.Delete(c.index, id)
 	if err != nil {
 		log.Printf("Failed to delete document: %v", err)
-		return
+		return fmt.Errorf("delete request failed: %w", err)
 	}
 	defer res.Body.Close()
 
+	// the document is already gone, deleting it again is a no-op
+	if res.StatusCode == 404 {
+		log.Printf("Document %s not found, nothing to delete", id)
+		return nil
+	}
+
 	if res.IsError() {
 		log.Printf("Error deleting document: %s", res.String())
-		return
+		return &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
 	}
 
 	log.Printf("Document %s deleted successfully", id)
+	return nil
 }
@@ -5,22 +5,34 @@ import (
 	"os"
 	"path"
 
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
 	"github.com/spf13/viper"
 )
 
+/*
+ElasticSearch is the elastic_search section shared by the configs of every service talking to
+Elasticsearch. HealthCheckerPort is only read by the Elasticsearch service, Bulk by the services
+indexing documents.
+*/
+type ElasticSearch struct {
+	Addr              string
+	Index             string
+	Username          string
+	Password          string
+	HealthCheckerPort string `mapstructure:"health_checker_port"`
+	Bulk              elasticsearch.BulkConfig
+}
+
 type Config struct {
 	RabbitMQ struct {
 		URI      string
 		Queue    string
 		Exchange string
+		Prefetch int
+		Retry    messagequeue.RetryPolicy
 	}
-	ElasticSearch struct {
-		Addr              string
-		Index             string
-		Username          string
-		Password          string
-		HealthCheckerPort string `mapstructure:"health_checker_port"`
-	}
+	ElasticSearch ElasticSearch
 }
 
 func Load() Config {
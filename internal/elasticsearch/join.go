@@ -0,0 +1,215 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Relation names of the plan join_field, see mappings.GetPlanMapping.
+const (
+	RelationPlan                  = "plan"
+	RelationPlanCostShares        = "planCostShares"
+	RelationLinkedPlanServices    = "linkedPlanServices"
+	RelationLinkedService         = "linkedService"
+	RelationPlanserviceCostShares = "planserviceCostShares"
+)
+
+// parentRelations maps every relation to its parent relation in the join_field.
+var parentRelations = map[string]string{
+	RelationPlan:                  "",
+	RelationPlanCostShares:        RelationPlan,
+	RelationLinkedPlanServices:    RelationPlan,
+	RelationLinkedService:         RelationLinkedPlanServices,
+	RelationPlanserviceCostShares: RelationLinkedPlanServices,
+}
+
+func IsRelation(name string) bool {
+	_, ok := parentRelations[name]
+	return ok
+}
+
+func HasChild(childType string, query map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"has_child": map[string]interface{}{
+			"type":  childType,
+			"query": query,
+		},
+	}
+}
+
+func HasParent(parentType string, query map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"has_parent": map[string]interface{}{
+			"parent_type": parentType,
+			"query":       query,
+		},
+	}
+}
+
+/*
+DescendantQuery matches documents of relation `from` that have a descendant of relation `to`
+matching the query, chaining has_child queries through the intermediate relations.
+*/
+func DescendantQuery(from, to string, query map[string]interface{}) (map[string]interface{}, error) {
+	path, err := relationPath(to, from)
+	if err != nil {
+		return nil, err
+	}
+
+	// path runs from the descendant up to (excluding) the ancestor
+	for _, relation := range path {
+		query = HasChild(relation, query)
+	}
+	return query, nil
+}
+
+/*
+AncestorQuery matches documents of relation `from` that have an ancestor of relation `to`
+matching the query, chaining has_parent queries through the intermediate relations.
+*/
+func AncestorQuery(from, to string, query map[string]interface{}) (map[string]interface{}, error) {
+	path, err := relationPath(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// has_parent names the parent type, so walk the path from the ancestor down
+	parents := append(path[1:], to)
+	for i := len(parents) - 1; i >= 0; i-- {
+		query = HasParent(parents[i], query)
+	}
+	return query, nil
+}
+
+/*
+relationPath returns the relations from descendant up to ancestor, excluding the ancestor itself.
+*/
+func relationPath(descendant, ancestor string) ([]string, error) {
+	if !IsRelation(descendant) {
+		return nil, fmt.Errorf("unknown relation %q", descendant)
+	}
+	if !IsRelation(ancestor) {
+		return nil, fmt.Errorf("unknown relation %q", ancestor)
+	}
+
+	path := []string{}
+	for current := descendant; current != ancestor; current = parentRelations[current] {
+		if current == "" {
+			return nil, fmt.Errorf("%q is not an ancestor of %q", ancestor, descendant)
+		}
+		path = append(path, current)
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%q and %q are the same relation", descendant, ancestor)
+	}
+	return path, nil
+}
+
+type Condition struct {
+	Field string
+	Op    string
+	Value string
+}
+
+/*
+Query converts the condition into a leaf query. Supported operators are
+eq, gt, gte, lt, lte (range operators require a numeric value) and match.
+*/
+func (c Condition) Query() (map[string]interface{}, error) {
+	switch c.Op {
+	case "eq":
+		return map[string]interface{}{"term": map[string]interface{}{c.Field: c.Value}}, nil
+	case "match":
+		return map[string]interface{}{"match": map[string]interface{}{c.Field: c.Value}}, nil
+	case "gt", "gte", "lt", "lte":
+		value, err := strconv.ParseFloat(c.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("condition on %s: %q is not a number", c.Field, c.Value)
+		}
+		return map[string]interface{}{
+			"range": map[string]interface{}{c.Field: map[string]interface{}{c.Op: value}},
+		}, nil
+	default:
+		return nil, fmt.Errorf("condition on %s: unsupported operator %q", c.Field, c.Op)
+	}
+}
+
+func conditionsQuery(conditions []Condition) (map[string]interface{}, error) {
+	clauses := []interface{}{}
+	for _, condition := range conditions {
+		q, err := condition.Query()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, q)
+	}
+
+	if len(clauses) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{"must": clauses}}, nil
+}
+
+/*
+JoinSearch describes a graph-shaped question on the plans index: return nodes of Relation
+matching Where, that have a descendant of relation Has matching HasWhere and/or an
+ancestor of relation Under matching UnderWhere.
+*/
+type JoinSearch struct {
+	Relation   string
+	Where      []Condition
+	Has        string
+	HasWhere   []Condition
+	Under      string
+	UnderWhere []Condition
+	From       int
+	Size       int
+}
+
+func BuildJoinQuery(search JoinSearch) (map[string]interface{}, error) {
+	if !IsRelation(search.Relation) {
+		return nil, fmt.Errorf("unknown relation %q", search.Relation)
+	}
+
+	filters := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{"join_field": search.Relation}},
+	}
+
+	where, err := conditionsQuery(search.Where)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, where)
+
+	if search.Has != "" {
+		hasWhere, err := conditionsQuery(search.HasWhere)
+		if err != nil {
+			return nil, err
+		}
+		q, err := DescendantQuery(search.Relation, search.Has, hasWhere)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, q)
+	}
+
+	if search.Under != "" {
+		underWhere, err := conditionsQuery(search.UnderWhere)
+		if err != nil {
+			return nil, err
+		}
+		q, err := AncestorQuery(search.Relation, search.Under, underWhere)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, q)
+	}
+
+	return map[string]interface{}{
+		"from": search.From,
+		"size": search.Size,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{"filter": filters},
+		},
+	}, nil
+}
@@ -0,0 +1,108 @@
+package elasticsearch
+
+type PlanSearchFilter struct {
+	Org           string
+	PlanType      string
+	MinCopay      *int
+	MaxCopay      *int
+	MinDeductible *int
+	MaxDeductible *int
+	ServiceName   string
+	From          int
+	Size          int
+}
+
+/*
+BuildPlanSearchQuery translates the filter into a query on plan documents.
+Cost shares and linked services are stored as child documents of the plan, so those
+filters are expressed through the join_field relations with has_child queries. A copay or
+deductible range matches a plan when one cost share document, the plan's own or a linked plan
+service's, is within all the ranges.
+*/
+func BuildPlanSearchQuery(filter PlanSearchFilter) map[string]interface{} {
+	filters := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{"join_field": RelationPlan}},
+	}
+	must := []interface{}{}
+
+	if filter.Org != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"_org": filter.Org}})
+	}
+	if filter.PlanType != "" {
+		filters = append(filters, map[string]interface{}{"term": map[string]interface{}{"planType": filter.PlanType}})
+	}
+
+	costShareFilters := []interface{}{}
+	if r := rangeQuery("copay", filter.MinCopay, filter.MaxCopay); r != nil {
+		costShareFilters = append(costShareFilters, r)
+	}
+	if r := rangeQuery("deductible", filter.MinDeductible, filter.MaxDeductible); r != nil {
+		costShareFilters = append(costShareFilters, r)
+	}
+	if len(costShareFilters) > 0 {
+		// the cost shares of the plan itself or of one of its linked plan services
+		costShares := map[string]interface{}{
+			"bool": map[string]interface{}{"filter": costShareFilters},
+		}
+		filters = append(filters, map[string]interface{}{
+			"bool": map[string]interface{}{
+				"should": []interface{}{
+					HasChild(RelationPlanCostShares, costShares),
+					HasChild(RelationLinkedPlanServices, HasChild(RelationPlanserviceCostShares, costShares)),
+				},
+				"minimum_should_match": 1,
+			},
+		})
+	}
+
+	if filter.ServiceName != "" {
+		linkedService := HasChild(RelationLinkedService, map[string]interface{}{
+			"match": map[string]interface{}{"name": filter.ServiceName},
+		})
+		withInnerHits(linkedService, "has_child", map[string]interface{}{
+			"name":      RelationLinkedService,
+			"_source":   false,
+			"highlight": map[string]interface{}{"fields": map[string]interface{}{"name": map[string]interface{}{}}},
+		})
+
+		linkedPlanServices := HasChild(RelationLinkedPlanServices, linkedService)
+		withInnerHits(linkedPlanServices, "has_child", map[string]interface{}{
+			"name":    RelationLinkedPlanServices,
+			"_source": false,
+		})
+		linkedPlanServices["has_child"].(map[string]interface{})["score_mode"] = "max"
+
+		must = append(must, linkedPlanServices)
+	}
+
+	return map[string]interface{}{
+		"from":    filter.From,
+		"size":    filter.Size,
+		"_source": false,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": filters,
+				"must":   must,
+			},
+		},
+	}
+}
+
+func withInnerHits(query map[string]interface{}, kind string, innerHits map[string]interface{}) {
+	query[kind].(map[string]interface{})["inner_hits"] = innerHits
+}
+
+func rangeQuery(field string, min, max *int) map[string]interface{} {
+	if min == nil && max == nil {
+		return nil
+	}
+
+	bounds := map[string]interface{}{}
+	if min != nil {
+		bounds["gte"] = *min
+	}
+	if max != nil {
+		bounds["lte"] = *max
+	}
+	return map[string]interface{}{"range": map[string]interface{}{field: bounds}}
+}
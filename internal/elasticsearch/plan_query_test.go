@@ -0,0 +1,36 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBuildPlanSearchQueryCostShares(t *testing.T) {
+	minCopay, maxDeductible := 10, 500
+	query := BuildPlanSearchQuery(PlanSearchFilter{MinCopay: &minCopay, MaxDeductible: &maxDeductible, Size: 10})
+
+	filters := query["query"].(map[string]interface{})["bool"].(map[string]interface{})["filter"].([]interface{})
+	if len(filters) != 2 {
+		t.Fatalf("filters = %v, want the plan relation and the cost shares", filters)
+	}
+	encoded, err := json.Marshal(filters[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both ranges apply to one cost share document, of the plan or of a linked plan service
+	ranges := `{"bool":{"filter":[{"range":{"copay":{"gte":10}}},{"range":{"deductible":{"lte":500}}}]}}`
+	want := `{"bool":{"minimum_should_match":1,"should":[` +
+		`{"has_child":{"query":` + ranges + `,"type":"planCostShares"}},` +
+		`{"has_child":{"query":{"has_child":{"query":` + ranges + `,"type":"planserviceCostShares"}},"type":"linkedPlanServices"}}` +
+		`]}}`
+	if string(encoded) != want {
+		t.Errorf("cost shares filter =\n%s\nwant\n%s", encoded, want)
+	}
+
+	unfiltered, _ := json.Marshal(BuildPlanSearchQuery(PlanSearchFilter{Size: 10}))
+	if strings.Contains(string(unfiltered), "CostShares") {
+		t.Errorf("query without ranges = %s, want no cost shares filter", unfiltered)
+	}
+}
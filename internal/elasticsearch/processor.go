@@ -2,6 +2,7 @@ package elasticsearch
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 
 	"eric-cw-hsu.github.io/internal/rabbitmq/types"
@@ -13,34 +14,78 @@ func ParseRabbitMQPlanMessage(body json.RawMessage) (types.PlanMessage, error) {
 	if err := json.Unmarshal(body, &msg); err != nil {
 		return msg, err
 	}
+	if msg.Key == "" {
+		return msg, fmt.Errorf("message has no key")
+	}
 	return msg, nil
 }
 
-func ProcessCreatePlanNode(client *Client) messagequeue.HandlerFunc {
-	return func(body json.RawMessage) error {
-		planMessage, err := ParseRabbitMQPlanMessage(body)
-		if err != nil {
-			log.Printf("Failed to parse message: %v", err)
-		}
+/*
+classifyError marks client errors (bad document, mapping conflict...) as permanent so the
+consumer dead-letters them, while connection errors and 429/5xx responses are retried.
+*/
+func classifyError(err error) error {
+	if IsClientError(err) {
+		return messagequeue.NewPermanentError(err)
+	}
+	return err
+}
 
-		parentId, ok := planMessage.Data["parentId"].(string)
-		if !ok {
-			parentId = ""
+/*
+parseNodeMessage parses a node event and resolves the index of its resource, failing
+permanently for a malformed event or an unknown index.
+*/
+func parseNodeMessage(body json.RawMessage, indices ResourceIndices) (types.PlanMessage, string, error) {
+	planMessage, err := ParseRabbitMQPlanMessage(body)
+	if err != nil {
+		log.Printf("Failed to parse message: %v", err)
+		return planMessage, "", messagequeue.NewPermanentError(err)
+	}
+	index, err := indices.Resolve(planMessage.Index)
+	if err != nil {
+		log.Printf("Failed to route message %s: %v", planMessage.Key, err)
+		return planMessage, "", messagequeue.NewPermanentError(err)
+	}
+	return planMessage, index, nil
+}
+
+/*
+ProcessCreatePlanNode queues the node in the bulk indexer, in the index of its resource.
+The delivery is acknowledged once its bulk item succeeded.
+*/
+func ProcessCreatePlanNode(indexer *BulkIndexer, indices ResourceIndices) messagequeue.AsyncHandlerFunc {
+	return func(body json.RawMessage, done func(error)) {
+		planMessage, index, err := parseNodeMessage(body, indices)
+		if err != nil {
+			done(err)
+			return
 		}
 
-		client.IndexDocument(planMessage.Key, planMessage.Data, parentId)
-		return nil
+		indexer.Add(BulkOperation{
+			Action:   BulkActionIndex,
+			Index:    index,
+			ID:       planMessage.Key,
+			Routing:  DocumentRouting(planMessage.Data),
+			Document: BuildDocument(planMessage.Data),
+			Done:     func(err error) { done(classifyError(err)) },
+		})
 	}
 }
 
-func ProcessDeletePlanNode(client *Client) messagequeue.HandlerFunc {
-	return func(body json.RawMessage) error {
-		planMessage, err := ParseRabbitMQPlanMessage(body)
+func ProcessDeletePlanNode(indexer *BulkIndexer, indices ResourceIndices) messagequeue.AsyncHandlerFunc {
+	return func(body json.RawMessage, done func(error)) {
+		planMessage, index, err := parseNodeMessage(body, indices)
 		if err != nil {
-			log.Printf("Failed to parse message: %v", err)
+			done(err)
+			return
 		}
 
-		client.DeleteDocument(planMessage.Key)
-		return nil
+		indexer.Add(BulkOperation{
+			Action:  BulkActionDelete,
+			Index:   index,
+			ID:      planMessage.Key,
+			Routing: DocumentRouting(planMessage.Data),
+			Done:    func(err error) { done(classifyError(err)) },
+		})
 	}
 }
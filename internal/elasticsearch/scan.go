@@ -0,0 +1,69 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+type StoredDocument struct {
+	ID      string
+	Routing string
+	Source  map[string]interface{}
+}
+
+type scanResponse struct {
+	Hits struct {
+		Hits []struct {
+			ID      string                 `json:"_id"`
+			Routing string                 `json:"_routing"`
+			Source  map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+/*
+ScanDocuments returns up to size documents whose objectId is greater than afterId, in objectId
+order, so the index can be walked alongside the Mongo nodes (see storage.ScanNodes).
+*/
+func (c *Client) ScanDocuments(ctx context.Context, afterId string, size int) ([]StoredDocument, error) {
+	query := map[string]interface{}{
+		"size":  size,
+		"query": map[string]interface{}{"match_all": map[string]interface{}{}},
+		"sort":  []interface{}{map[string]interface{}{"objectId": "asc"}},
+	}
+	if afterId != "" {
+		query["search_after"] = []interface{}{afterId}
+	}
+
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode scan query: %w", err)
+	}
+
+	res, err := c.es.Search(
+		c.es.Search.WithContext(ctx),
+		c.es.Search.WithIndex(c.index),
+		c.es.Search.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("scan request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, &ResponseError{StatusCode: res.StatusCode, Body: res.String()}
+	}
+
+	var parsed scanResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("failed to decode scan response: %w", err)
+	}
+
+	docs := make([]StoredDocument, 0, len(parsed.Hits.Hits))
+	for _, hit := range parsed.Hits.Hits {
+		docs = append(docs, StoredDocument{ID: hit.ID, Routing: hit.Routing, Source: hit.Source})
+	}
+	return docs, nil
+}
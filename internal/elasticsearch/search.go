@@ -0,0 +1,101 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+type SearchHit struct {
+	ID         string                 `json:"objectId"`
+	Score      float64                `json:"score"`
+	Highlights map[string][]string    `json:"highlights,omitempty"`
+	Source     map[string]interface{} `json:"source,omitempty"`
+}
+
+type SearchResult struct {
+	Total int64       `json:"total"`
+	Hits  []SearchHit `json:"hits"`
+}
+
+type searchResponse struct {
+	Hits searchHits `json:"hits"`
+}
+
+type searchHits struct {
+	Total struct {
+		Value int64 `json:"value"`
+	} `json:"total"`
+	Hits []rawSearchHit `json:"hits"`
+}
+
+type rawSearchHit struct {
+	ID        string                       `json:"_id"`
+	Score     float64                      `json:"_score"`
+	Source    map[string]interface{}       `json:"_source"`
+	Highlight map[string][]string          `json:"highlight"`
+	InnerHits map[string]innerHitsResponse `json:"inner_hits"`
+}
+
+type innerHitsResponse struct {
+	Hits searchHits `json:"hits"`
+}
+
+/*
+Search runs the given query DSL against the plans index and returns the matched document ids.
+Highlights found in inner hits are flattened into the hit, keyed by "<inner hit name>.<field>".
+*/
+func (c *Client) Search(ctx context.Context, query map[string]interface{}) (*SearchResult, error) {
+	body, err := json.Marshal(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode search query: %w", err)
+	}
+
+	res, err := c.es.Search(
+		c.es.Search.WithContext(ctx),
+		c.es.Search.WithIndex(c.index),
+		c.es.Search.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("search request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, fmt.Errorf("search error: %s", res.String())
+	}
+
+	var parsed searchResponse
+	if err := json.NewDecoder(res.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("failed to decode search response: %w", err)
+	}
+
+	result := &SearchResult{
+		Total: parsed.Hits.Total.Value,
+		Hits:  make([]SearchHit, 0, len(parsed.Hits.Hits)),
+	}
+	for _, hit := range parsed.Hits.Hits {
+		highlights := make(map[string][]string)
+		collectHighlights("", hit, highlights)
+		result.Hits = append(result.Hits, SearchHit{
+			ID:         hit.ID,
+			Score:      hit.Score,
+			Highlights: highlights,
+			Source:     hit.Source,
+		})
+	}
+
+	return result, nil
+}
+
+func collectHighlights(prefix string, hit rawSearchHit, highlights map[string][]string) {
+	for field, fragments := range hit.Highlight {
+		highlights[prefix+field] = append(highlights[prefix+field], fragments...)
+	}
+	for name, inner := range hit.InnerHits {
+		for _, innerHit := range inner.Hits.Hits {
+			collectHighlights(prefix+name+".", innerHit, highlights)
+		}
+	}
+}
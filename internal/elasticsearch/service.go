@@ -1,20 +1,66 @@
 package elasticsearch
 
 import (
+	"fmt"
 	"log"
 
-	"eric-cw-hsu.github.io/internal/elasticsearch/mappings"
+	"eric-cw-hsu.github.io/internal/resource"
 	"eric-cw-hsu.github.io/internal/shared/messagequeue"
 )
 
-func Start(consumer *messagequeue.Consumer, client *Client) {
-	if err := client.InitIndex(mappings.GetPlanMapping()); err != nil {
-		log.Fatalf("Failed to initialize index: %v", err)
+/*
+ResourceIndices maps the index named by the node events (see resource.Resource) to the index
+they are written to: the plan events go to the configured index, an alias (see InitIndex), and
+the events of another resource to the index of the resource. Events without an index were
+enqueued before resources were registered and are plan events.
+*/
+type ResourceIndices map[string]string
+
+func NewResourceIndices(registry *resource.Registry) ResourceIndices {
+	indices := ResourceIndices{"": ""}
+	for _, res := range registry.All() {
+		if res.Name == resource.Plans {
+			indices[res.Index] = ""
+			continue
+		}
+		indices[res.Index] = res.Index
+	}
+	return indices
+}
+
+/*
+Resolve returns the index to write the events naming index to, empty for the configured index.
+*/
+func (i ResourceIndices) Resolve(index string) (string, error) {
+	target, ok := i[index]
+	if !ok {
+		return "", fmt.Errorf("no resource is indexed in %s", index)
+	}
+	return target, nil
+}
+
+/*
+ForResource returns the client of the index alias of the resource: the configured index for the
+plans, the index of the resource otherwise.
+*/
+func (c *Client) ForResource(res *resource.Resource) *Client {
+	if res.Name == resource.Plans {
+		return c
+	}
+	return c.WithIndex(res.Index)
+}
+
+func Start(consumer *messagequeue.Consumer, client *Client, indexer *BulkIndexer, registry *resource.Registry) {
+	for _, res := range registry.All() {
+		if err := client.ForResource(res).InitIndex(res.Mapping); err != nil {
+			log.Fatalf("Failed to initialize index of %s: %v", res.Name, err)
+		}
 	}
 
-	consumer.RegisterHandler("plan.node.create", ProcessCreatePlanNode(client))
-	consumer.RegisterHandler("plan.node.update", ProcessCreatePlanNode(client))
-	consumer.RegisterHandler("plan.node.delete", ProcessDeletePlanNode(client))
+	indices := NewResourceIndices(registry)
+	consumer.RegisterAsyncHandler("plan.node.create", ProcessCreatePlanNode(indexer, indices))
+	consumer.RegisterAsyncHandler("plan.node.update", ProcessCreatePlanNode(indexer, indices))
+	consumer.RegisterAsyncHandler("plan.node.delete", ProcessDeletePlanNode(indexer, indices))
 
 	if err := consumer.Start(); err != nil {
 		log.Fatalf("Failed to start consumer: %v", err)
@@ -1,6 +1,7 @@
 package oauth
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
@@ -31,3 +32,23 @@ func GoogleAuthMiddleware(expectedClientId string) gin.HandlerFunc {
 		c.Next()
 	}
 }
+
+/*
+Author returns the email of the user authenticated by GoogleAuthMiddleware for the request
+carried by ctx (the *gin.Context or a context derived from it), or "anonymous" when the request
+was not authenticated.
+*/
+func Author(ctx context.Context) string {
+	c, ok := ctx.(*gin.Context)
+	if !ok {
+		c, ok = ctx.Value(gin.ContextKey).(*gin.Context)
+	}
+	if !ok {
+		return "anonymous"
+	}
+
+	if email := c.GetString("email"); email != "" {
+		return email
+	}
+	return "anonymous"
+}
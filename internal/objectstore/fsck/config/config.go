@@ -0,0 +1,37 @@
+package config
+
+import (
+	"log"
+	"os"
+	"path"
+
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Mongo struct {
+		URI      string
+		Database string
+	}
+}
+
+func Load() Config {
+	dir, _ := os.Getwd()
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath(path.Join(dir, "cmd/graph-fsck"))
+	viper.AddConfigPath("config/")
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+
+	var cfg Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		log.Fatalf("Unable to decode config into struct: %v", err)
+	}
+
+	return cfg
+}
@@ -0,0 +1,292 @@
+package fsck
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue/messages"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const scanBatchSize = 500
+
+const (
+	IssueDanglingRef   = "dangling_ref"
+	IssueMissingParent = "missing_parent"
+	IssueParentLink    = "parent_link"
+	IssueEdgeMismatch  = "edge_mismatch"
+	IssueUnreachable   = "unreachable"
+)
+
+type Issue struct {
+	Kind   string `json:"kind"`
+	NodeID string `json:"nodeId"`
+	Detail string `json:"detail"`
+}
+
+type Report struct {
+	Nodes  int     `json:"nodes"`
+	Roots  int     `json:"roots"`
+	Issues []Issue `json:"issues"`
+
+	// edges holds the stored and the derived edge set of the nodes with an edge mismatch
+	edges map[string]edgeFix
+	// unreachable lists the nodes no plan root leads to
+	unreachable []string
+}
+
+type edgeFix struct {
+	stored  []string
+	derived []string
+}
+
+/*
+Count returns the number of issues of the kind.
+*/
+func (r *Report) Count(kind string) int {
+	count := 0
+	for _, issue := range r.Issues {
+		if issue.Kind == kind {
+			count++
+		}
+	}
+	return count
+}
+
+type node struct {
+	parentId string
+	refs     []string
+	edges    []string
+}
+
+/*
+Check walks all the nodes of the collection and verifies that:
+  - every $ref points to an existing node
+  - a node no other node references has an existing parentId that references it; the parentId
+    of a referenced node only names its first owner, a shared node outlives it
+  - the referencedBy edge set matches the $refs pointing to the node (and the root edge of plan roots)
+  - every node is reachable from the root of a plan
+*/
+func Check(ctx context.Context, collection *mongo.Collection) (*Report, error) {
+	nodes, err := loadNodes(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Nodes: len(nodes), Issues: []Issue{}, edges: map[string]edgeFix{}}
+	derived := map[string][]string{}
+	roots := []string{}
+
+	for _, id := range sortedIds(nodes) {
+		n := nodes[id]
+		if n.parentId == "" {
+			roots = append(roots, id)
+			derived[id] = append(derived[id], "")
+		}
+
+		for _, ref := range n.refs {
+			if _, ok := nodes[ref]; !ok {
+				report.Issues = append(report.Issues, Issue{IssueDanglingRef, id, fmt.Sprintf("$ref %s points to no node", ref)})
+				continue
+			}
+			if !contains(derived[ref], id) {
+				derived[ref] = append(derived[ref], id)
+			}
+		}
+	}
+	report.Roots = len(roots)
+
+	for _, id := range sortedIds(nodes) {
+		parentId := nodes[id].parentId
+		if parentId == "" || len(derived[id]) > 0 {
+			continue
+		}
+		if _, ok := nodes[parentId]; !ok {
+			report.Issues = append(report.Issues, Issue{IssueMissingParent, id, fmt.Sprintf("parent %s does not exist", parentId)})
+		} else {
+			report.Issues = append(report.Issues, Issue{IssueParentLink, id, fmt.Sprintf("parent %s does not reference it", parentId)})
+		}
+	}
+
+	for _, id := range sortedIds(nodes) {
+		stored := nodes[id].edges
+		expected := derived[id]
+		if expected == nil {
+			expected = []string{}
+		}
+		if stored == nil || !sameSet(stored, expected) {
+			report.edges[id] = edgeFix{stored: stored, derived: expected}
+			detail := fmt.Sprintf("referencedBy %v, expected %v", stored, expected)
+			if stored == nil {
+				detail = fmt.Sprintf("no referencedBy, expected %v", expected)
+			}
+			report.Issues = append(report.Issues, Issue{IssueEdgeMismatch, id, detail})
+		}
+	}
+
+	reachable := map[string]bool{}
+	queue := roots
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if reachable[id] {
+			continue
+		}
+		reachable[id] = true
+		for _, ref := range nodes[id].refs {
+			if _, ok := nodes[ref]; ok && !reachable[ref] {
+				queue = append(queue, ref)
+			}
+		}
+	}
+	for _, id := range sortedIds(nodes) {
+		if !reachable[id] {
+			report.unreachable = append(report.unreachable, id)
+			report.Issues = append(report.Issues, Issue{IssueUnreachable, id, "no plan root leads to it"})
+		}
+	}
+
+	return report, nil
+}
+
+type FixResult struct {
+	EdgesRepaired int
+	Removed       map[string]map[string]interface{}
+	// Skipped lists the nodes left alone because a concurrent write changed them since the check
+	Skipped []string
+}
+
+/*
+Fix repairs the edge sets of the report, then removes the unreachable nodes. Both steps re-check
+the stored state first: an edge set changed since the check is kept, and a node is removed only
+when its current edge sets do not lead to a plan root. Each removal enqueues the delete event of
+the node in every index in the same transaction, like a plan delete, so the search index drops it;
+an unreachable node no longer tells which resource it belonged to, and a delete of a missing
+document is ignored by the Elasticsearch service.
+Dangling $refs and broken parent links change plan content and are only reported.
+*/
+func Fix(ctx context.Context, collection *mongo.Collection, events outbox.Store, indices []string, report *Report) (*FixResult, error) {
+	result := &FixResult{Removed: map[string]map[string]interface{}{}, Skipped: []string{}}
+
+	for _, id := range sortedKeys(report.edges) {
+		fix := report.edges[id]
+		updated, err := storage.ReplaceNodeEdges(ctx, collection, id, fix.stored, fix.derived)
+		if err != nil {
+			return result, err
+		}
+		if !updated {
+			result.Skipped = append(result.Skipped, id)
+			continue
+		}
+		result.EdgesRepaired++
+	}
+
+	for _, id := range report.unreachable {
+		var removed map[string]interface{}
+		reachable := false
+		err := storage.WithTransaction(ctx, collection, func(txCtx context.Context) error {
+			var err error
+			if reachable, err = storage.IsReachable(txCtx, collection, id); err != nil || reachable {
+				return err
+			}
+			if removed, err = storage.DeleteNode(txCtx, collection, id); err != nil || removed == nil {
+				return err
+			}
+			return events.Enqueue(txCtx, deleteMessages(id, removed, indices)...)
+		})
+		if err != nil {
+			return result, err
+		}
+		if reachable {
+			result.Skipped = append(result.Skipped, id)
+			continue
+		}
+		if removed != nil {
+			result.Removed[id] = removed
+		}
+	}
+
+	logger.Logger.Info("fsck: repair completed",
+		zap.Int("edgesRepaired", result.EdgesRepaired),
+		zap.Int("removed", len(result.Removed)),
+		zap.Int("skipped", len(result.Skipped)),
+	)
+	return result, nil
+}
+
+func deleteMessages(id string, node map[string]interface{}, indices []string) []messagequeue.Message {
+	msgs := make([]messagequeue.Message, 0, len(indices))
+	for _, index := range indices {
+		msgs = append(msgs, messages.PlanNodeMessage{Action: "delete", Index: index, Key: id, Data: node})
+	}
+	return msgs
+}
+
+func loadNodes(ctx context.Context, collection *mongo.Collection) (map[string]node, error) {
+	nodes := map[string]node{}
+	for afterId := ""; ; {
+		page, err := storage.ScanNodes(ctx, collection, afterId, scanBatchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return nodes, nil
+		}
+
+		for _, raw := range page {
+			id, _ := raw["_id"].(string)
+			parentId, _ := raw["parentId"].(string)
+			nodes[id] = node{
+				parentId: parentId,
+				refs:     storage.NodeRefs(raw),
+				edges:    storage.ReferencedBy(raw),
+			}
+			afterId = id
+		}
+	}
+}
+
+func sortedIds(nodes map[string]node) []string {
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedKeys(edges map[string]edgeFix) []string {
+	ids := make([]string, 0, len(edges))
+	for id := range edges {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, v := range a {
+		if !contains(b, v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package fsck
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/objectstore/graph"
+	"eric-cw-hsu.github.io/internal/objectstore/nodestore"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource/resourcetest"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue/messages"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+The checks run against a MongoDB server at MONGO_URI (default mongodb://localhost:27017) and are
+skipped without one.
+*/
+
+func testCollection(t *testing.T) *mongo.Collection {
+	t.Helper()
+	logger.Logger = zap.NewNop()
+
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		uri = "mongodb://localhost:27017"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(2*time.Second))
+	if err != nil {
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+
+	database := client.Database(fmt.Sprintf("fsck_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return database.Collection("plans")
+}
+
+func TestCheckAndFix(t *testing.T) {
+	ctx := context.Background()
+	collection := testCollection(t)
+
+	store := nodestore.NewMongoStore(collection, collection.Database().Collection("plan_versions"))
+	if _, err := store.UpsertNodes(ctx, graph.ExtractGraphNodes("plan", resourcetest.Plan("plan-2", "service-shared"))); err != nil {
+		t.Fatal(err)
+	}
+	// the shared service was first written by plan-1, deleted since
+	if _, err := collection.UpdateByID(ctx, "service-shared", bson.M{"$set": bson.M{"parentId": "plan-1-planservice"}}); err != nil {
+		t.Fatal(err)
+	}
+	// a node left behind by plan-1, which nothing references anymore
+	if _, err := collection.InsertOne(ctx, bson.M{
+		"_id": "plan-1-cost", "objectId": "plan-1-cost", "objectType": "membercostshare",
+		"parentId": "plan-1", "fieldName": "planCostShares", "referencedBy": bson.A{"plan-1"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(ctx, collection)
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	issues := []string{}
+	for _, issue := range report.Issues {
+		issues = append(issues, issue.Kind+" "+issue.NodeID)
+	}
+	want := "[missing_parent plan-1-cost edge_mismatch plan-1-cost unreachable plan-1-cost]"
+	if fmt.Sprint(issues) != want {
+		t.Fatalf("issues = %v, want %s", issues, want)
+	}
+
+	events := outbox.NewMemoryStore()
+	result, err := Fix(ctx, collection, events, []string{"plans", "contracts"}, report)
+	if err != nil {
+		t.Fatalf("Fix: %v", err)
+	}
+	if result.EdgesRepaired != 1 || len(result.Removed) != 1 || result.Removed["plan-1-cost"] == nil {
+		t.Fatalf("Fix = %+v, want the edges of plan-1-cost repaired, then the node removed", result)
+	}
+
+	// the removal enqueued the delete event of the node in every index
+	pending, err := events.FetchPending(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletes := []string{}
+	for _, entry := range pending {
+		var base messagequeue.BaseMessage
+		var event messages.PlanNodeMessage
+		if err := json.Unmarshal(entry.Payload, &base); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(base.Body, &event); err != nil {
+			t.Fatal(err)
+		}
+		deletes = append(deletes, event.Action+" "+event.Index+"/"+event.Key)
+	}
+	sort.Strings(deletes)
+	if fmt.Sprint(deletes) != "[delete contracts/plan-1-cost delete plans/plan-1-cost]" {
+		t.Errorf("events = %v, want a delete of plan-1-cost in each index", deletes)
+	}
+
+	report, err = Check(ctx, collection)
+	if err != nil {
+		t.Fatalf("Check after Fix: %v", err)
+	}
+	if len(report.Issues) != 0 {
+		t.Errorf("issues after Fix = %+v, want none", report.Issues)
+	}
+}
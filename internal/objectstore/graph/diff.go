@@ -0,0 +1,159 @@
+package graph
+
+import (
+	"reflect"
+	"sort"
+)
+
+const (
+	NodeAdded    = "added"
+	NodeRemoved  = "removed"
+	NodeModified = "modified"
+)
+
+/*
+FieldChange is a changed field of a node. From is absent for an added field and To for a removed
+one. A child node shows as its {"$ref": id}, its own changes are reported with that node.
+*/
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from,omitempty"`
+	To    interface{} `json:"to,omitempty"`
+}
+
+type NodeChange struct {
+	ObjectID   string        `json:"objectId"`
+	ObjectType string        `json:"objectType"`
+	Change     string        `json:"change"`
+	Fields     []FieldChange `json:"fields,omitempty"`
+}
+
+/*
+GraphDiff lists the nodes added, removed and modified between two versions of a graph,
+each sorted by objectId.
+*/
+type GraphDiff struct {
+	Added    []NodeChange `json:"added"`
+	Removed  []NodeChange `json:"removed"`
+	Modified []NodeChange `json:"modified"`
+}
+
+/*
+Diff compares two expanded graphs node by node, nodes being identified by their objectId.
+A node whose fields differ is modified, including when it moved under another parent or field.
+Either graph may be nil, for a graph that does not exist.
+*/
+func Diff(from, to map[string]interface{}) *GraphDiff {
+	fromNodes := diffNodes(from)
+	toNodes := diffNodes(to)
+
+	diff := &GraphDiff{
+		Added:    []NodeChange{},
+		Removed:  []NodeChange{},
+		Modified: []NodeChange{},
+	}
+	for _, id := range sortedIds(toNodes) {
+		fromNode, exists := fromNodes[id]
+		if !exists {
+			diff.Added = append(diff.Added, nodeChange(id, toNodes[id], NodeAdded, nil))
+			continue
+		}
+		if fields := diffFields(fromNode, toNodes[id]); len(fields) > 0 {
+			diff.Modified = append(diff.Modified, nodeChange(id, toNodes[id], NodeModified, fields))
+		}
+	}
+	for _, id := range sortedIds(fromNodes) {
+		if _, exists := toNodes[id]; !exists {
+			diff.Removed = append(diff.Removed, nodeChange(id, fromNodes[id], NodeRemoved, nil))
+		}
+	}
+
+	return diff
+}
+
+/*
+IsEmpty reports whether both graphs are the same.
+*/
+func (d *GraphDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+/*
+Node returns the change of the node, nil when the node is unchanged.
+*/
+func (d *GraphDiff) Node(id string) *NodeChange {
+	for _, changes := range [][]NodeChange{d.Added, d.Removed, d.Modified} {
+		for i := range changes {
+			if changes[i].ObjectID == id {
+				return &changes[i]
+			}
+		}
+	}
+	return nil
+}
+
+/*
+diffNodes extracts the nodes of an expanded graph without their stored-only fields (_id, the
+referencedBy edge set, the _rev revision of the root and the derived _creationDate). The graph is
+first normalized through JSON, so numbers and arrays compare alike whatever store they come from.
+*/
+func diffNodes(graph map[string]interface{}) map[string]map[string]interface{} {
+	normalized, _ := Normalize(graph)
+	nodes := ExtractGraphNodes("", normalized)
+	for _, node := range nodes {
+		delete(node, "_id")
+		delete(node, "referencedBy")
+		delete(node, "_rev")
+		delete(node, "_creationDate")
+	}
+	return nodes
+}
+
+func diffFields(from, to map[string]interface{}) []FieldChange {
+	keys := map[string]bool{}
+	for k := range from {
+		keys[k] = true
+	}
+	for k := range to {
+		keys[k] = true
+	}
+
+	fields := []FieldChange{}
+	for _, k := range sortedKeys(keys) {
+		fromVal, inFrom := from[k]
+		toVal, inTo := to[k]
+		if inFrom && inTo && reflect.DeepEqual(fromVal, toVal) {
+			continue
+		}
+		fields = append(fields, FieldChange{Field: k, From: fromVal, To: toVal})
+	}
+	return fields
+}
+
+func nodeChange(id string, node map[string]interface{}, change string, fields []FieldChange) NodeChange {
+	objectType, _ := node["objectType"].(string)
+	return NodeChange{
+		ObjectID:   id,
+		ObjectType: objectType,
+		Change:     change,
+		Fields:     fields,
+	}
+}
+
+func sortedIds(nodes map[string]map[string]interface{}) []string {
+	ids := make([]string, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,183 @@
+package graph
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"eric-cw-hsu.github.io/internal/resource/resourcetest"
+)
+
+// summary lists the changes of the diff as "<change> <objectId> <fields>", in diff order
+func summary(diff *GraphDiff) []string {
+	changes := []string{}
+	for _, group := range [][]NodeChange{diff.Added, diff.Removed, diff.Modified} {
+		for _, change := range group {
+			fields := []string{}
+			for _, field := range change.Fields {
+				fields = append(fields, field.Field)
+			}
+			changes = append(changes, strings.TrimSpace(change.Change+" "+change.ObjectID+" "+strings.Join(fields, ",")))
+		}
+	}
+	return changes
+}
+
+func planService(plan map[string]interface{}) map[string]interface{} {
+	return plan["linkedPlanServices"].([]interface{})[0].(map[string]interface{})
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		from map[string]interface{}
+		to   func(plan map[string]interface{}) map[string]interface{}
+		want []string
+	}{
+		{
+			name: "unchanged",
+			from: resourcetest.Plan("plan-1", "service-1"),
+			to:   func(plan map[string]interface{}) map[string]interface{} { return plan },
+			want: []string{},
+		},
+		{
+			name: "modified field",
+			from: resourcetest.Plan("plan-1", "service-1"),
+			to: func(plan map[string]interface{}) map[string]interface{} {
+				plan["planCostShares"].(map[string]interface{})["copay"] = 30
+				plan["planType"] = "outOfNetwork"
+				return plan
+			},
+			want: []string{"modified plan-1 planType", "modified plan-1-cost copay"},
+		},
+		{
+			name: "added and removed nodes",
+			from: resourcetest.Plan("plan-1", "service-1"),
+			to: func(plan map[string]interface{}) map[string]interface{} {
+				planService(plan)["linkedService"].(map[string]interface{})["objectId"] = "service-2"
+				plan["linkedPlanServices"] = append(plan["linkedPlanServices"].([]interface{}), map[string]interface{}{
+					"objectId": "plan-1-planservice-2", "objectType": "planservice", "_org": "example.com",
+				})
+				return plan
+			},
+			want: []string{
+				"added plan-1-planservice-2",
+				"added service-2",
+				"removed service-1",
+				"modified plan-1 linkedPlanServices",
+				"modified plan-1-planservice linkedService",
+			},
+		},
+		{
+			name: "node moved under another parent",
+			from: resourcetest.Plan("plan-1", "service-1"),
+			to: func(plan map[string]interface{}) map[string]interface{} {
+				// the cost shares of the plan service become those of the plan
+				plan["planCostShares"] = planService(plan)["planserviceCostShares"]
+				delete(planService(plan), "planserviceCostShares")
+				return plan
+			},
+			want: []string{
+				"removed plan-1-cost",
+				"modified plan-1 planCostShares",
+				"modified plan-1-planservice planserviceCostShares",
+				"modified plan-1-service-cost fieldName,parentId",
+			},
+		},
+		{
+			name: "nil from",
+			from: nil,
+			to:   func(plan map[string]interface{}) map[string]interface{} { return plan },
+			want: []string{
+				"added plan-1",
+				"added plan-1-cost",
+				"added plan-1-planservice",
+				"added plan-1-service-cost",
+				"added service-1",
+			},
+		},
+		{
+			name: "nil to",
+			from: resourcetest.Plan("plan-1", "service-1"),
+			to:   func(plan map[string]interface{}) map[string]interface{} { return nil },
+			want: []string{
+				"removed plan-1",
+				"removed plan-1-cost",
+				"removed plan-1-planservice",
+				"removed plan-1-service-cost",
+				"removed service-1",
+			},
+		},
+		{
+			name: "nil from and to",
+			from: nil,
+			to:   func(plan map[string]interface{}) map[string]interface{} { return nil },
+			want: []string{},
+		},
+		{
+			name: "int32 and float64 numbers",
+			from: func() map[string]interface{} {
+				// numbers as decoded from BSON
+				plan := resourcetest.Plan("plan-1", "service-1")
+				plan["planCostShares"].(map[string]interface{})["copay"] = int32(23)
+				plan["planCostShares"].(map[string]interface{})["deductible"] = int64(2000)
+				return plan
+			}(),
+			to:   func(plan map[string]interface{}) map[string]interface{} { return plan },
+			want: []string{},
+		},
+		{
+			name: "stored-only fields",
+			from: func() map[string]interface{} {
+				plan := resourcetest.Plan("plan-1", "service-1")
+				plan["_id"] = "plan-1"
+				plan["_rev"] = int32(3)
+				plan["referencedBy"] = []interface{}{""}
+				plan["_creationDate"] = "2017-12-12T00:00:00Z"
+				return plan
+			}(),
+			to:   func(plan map[string]interface{}) map[string]interface{} { return plan },
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := Diff(tt.from, tt.to(resourcetest.Plan("plan-1", "service-1")))
+			if got := summary(diff); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("Diff = %q, want %q", got, tt.want)
+			}
+			if diff.IsEmpty() != (len(tt.want) == 0) {
+				t.Errorf("IsEmpty = %v with changes %q", diff.IsEmpty(), tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffFieldValues(t *testing.T) {
+	from := resourcetest.Plan("plan-1", "service-1")
+	to := resourcetest.Plan("plan-1", "service-1")
+	delete(to, "creationDate")
+	to["planStatus"] = "active"
+	to["planCostShares"].(map[string]interface{})["copay"] = 30
+
+	diff := Diff(from, to)
+	plan := diff.Node("plan-1")
+	if plan == nil || len(plan.Fields) != 2 {
+		t.Fatalf("plan-1 change = %+v, want creationDate removed and planStatus added", plan)
+	}
+	if removed := plan.Fields[0]; removed.Field != "creationDate" || removed.From != "12-12-2017" || removed.To != nil {
+		t.Errorf("removed field = %+v", removed)
+	}
+	if added := plan.Fields[1]; added.Field != "planStatus" || added.From != nil || added.To != "active" {
+		t.Errorf("added field = %+v", added)
+	}
+
+	// numbers come out of the normalization as float64
+	cost := diff.Node("plan-1-cost")
+	if cost == nil || cost.ObjectType != "membercostshare" || cost.Fields[0].From != float64(23) || cost.Fields[0].To != float64(30) {
+		t.Errorf("plan-1-cost change = %+v, want copay 23 to 30", cost)
+	}
+	if diff.Node("service-1") != nil {
+		t.Error("the unchanged service-1 has a change")
+	}
+}
@@ -99,8 +99,16 @@ func mergeArray(
 		delete(originalMap, id)
 	}
 
-	for _, item := range originalMap {
-		mergedArray = append(mergedArray, item)
+	// originals left out of the update follow, in their original order
+	for _, item := range originalArray {
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if id, ok := itemMap["objectId"].(string); ok && originalMap[id] != nil {
+			mergedArray = append(mergedArray, originalMap[id])
+			delete(originalMap, id)
+		}
 	}
 
 	return mergedArray, nil
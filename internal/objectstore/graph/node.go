@@ -0,0 +1,91 @@
+package graph
+
+/*
+FindNode returns the first node with the objectId in the expanded document, searched depth-first,
+the document itself included.
+*/
+func FindNode(doc map[string]interface{}, id string) (map[string]interface{}, bool) {
+	if isNode(doc) && doc["objectId"] == id {
+		return doc, true
+	}
+
+	for _, v := range doc {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if node, ok := FindNode(vv, id); ok {
+				return node, true
+			}
+		case []interface{}:
+			for _, item := range vv {
+				if itemMap, ok := item.(map[string]interface{}); ok {
+					if node, ok := FindNode(itemMap, id); ok {
+						return node, true
+					}
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+/*
+ReplaceNode replaces every occurrence of the node with the objectId below the root of the
+expanded document, which is modified in place, and returns how many were replaced.
+*/
+func ReplaceNode(doc map[string]interface{}, id string, replacement map[string]interface{}) int {
+	return rewriteNode(doc, id, func() (interface{}, bool) { return replacement, true })
+}
+
+/*
+RemoveNode removes every occurrence of the node with the objectId below the root of the expanded
+document, which is modified in place: a field holding it is deleted and an array item is dropped.
+It returns how many were removed.
+*/
+func RemoveNode(doc map[string]interface{}, id string) int {
+	return rewriteNode(doc, id, func() (interface{}, bool) { return nil, false })
+}
+
+/*
+rewriteNode walks the document and calls rewrite for each occurrence of the node, which
+returns the value to put in its place, or false to drop it.
+*/
+func rewriteNode(doc map[string]interface{}, id string, rewrite func() (interface{}, bool)) int {
+	matches := func(v interface{}) bool {
+		m, ok := v.(map[string]interface{})
+		return ok && isNode(m) && m["objectId"] == id
+	}
+
+	count := 0
+	for k, v := range doc {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if !matches(vv) {
+				count += rewriteNode(vv, id, rewrite)
+				continue
+			}
+			count++
+			if value, keep := rewrite(); keep {
+				doc[k] = value
+			} else {
+				delete(doc, k)
+			}
+		case []interface{}:
+			items := make([]interface{}, 0, len(vv))
+			for _, item := range vv {
+				if !matches(item) {
+					if itemMap, ok := item.(map[string]interface{}); ok {
+						count += rewriteNode(itemMap, id, rewrite)
+					}
+					items = append(items, item)
+					continue
+				}
+				count++
+				if value, keep := rewrite(); keep {
+					items = append(items, value)
+				}
+			}
+			doc[k] = items
+		}
+	}
+	return count
+}
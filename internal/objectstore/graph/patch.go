@@ -0,0 +1,344 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+/*
+ErrPatchTestFailed is returned by ApplyPatch when a test operation does not match the document.
+*/
+var ErrPatchTestFailed = errors.New("test operation failed")
+
+/*
+PatchOperation is an RFC 6902 JSON Patch operation. Value is kept raw so an explicit null
+can be told apart from a missing value.
+*/
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+/*
+Normalize returns a copy of the document made of plain JSON values (map[string]interface{},
+[]interface{}, float64, ...), whatever store it was decoded from.
+*/
+func Normalize(doc map[string]interface{}) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized map[string]interface{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized, nil
+}
+
+/*
+MergePatch applies an RFC 7396 JSON Merge Patch to target: object members of the patch are merged
+recursively, null members remove the field, and any other value (arrays included) replaces it.
+target must be a normalized document, it is modified in place.
+*/
+func MergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+			continue
+		}
+		targetObj[k] = MergePatch(targetObj[k], v)
+	}
+	return targetObj
+}
+
+/*
+ApplyPatch applies the RFC 6902 JSON Patch operations in order to a copy of doc, a normalized
+document, and returns the patched copy. The patch is atomic: on error doc is left untouched.
+*/
+func ApplyPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	doc = deepCopy(doc)
+	for i, op := range ops {
+		var err error
+		if doc, err = applyOperation(doc, op); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyOperation(doc interface{}, op PatchOperation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, errors.New("missing value")
+		}
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, fmt.Errorf("invalid value: %v", err)
+		}
+
+		switch op.Op {
+		case "add":
+			return addValue(doc, path, value)
+		case "replace":
+			return replaceValue(doc, path, value)
+		default:
+			current, err := getValue(doc, path)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(current, value) {
+				return nil, ErrPatchTestFailed
+			}
+			return doc, nil
+		}
+
+	case "remove":
+		doc, _, err = removeValue(doc, path)
+		return doc, err
+
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %v", err)
+		}
+
+		if op.Op == "copy" {
+			value, err := getValue(doc, from)
+			if err != nil {
+				return nil, err
+			}
+			return addValue(doc, path, deepCopy(value))
+		}
+
+		if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+			return nil, errors.New("cannot move a value into one of its children")
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, value)
+
+	default:
+		return nil, fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+/*
+parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens.
+*/
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+/*
+arrayIndex parses an array index token, size being the largest index accepted.
+*/
+func arrayIndex(token string, size int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') || strings.HasPrefix(token, "+") {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > size {
+		return 0, fmt.Errorf("array index %d out of bounds", index)
+	}
+	return index, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch d := doc.(type) {
+		case map[string]interface{}:
+			value, ok := d[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %q", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(d)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[index]
+		default:
+			return nil, fmt.Errorf("path not found at %q", token)
+		}
+	}
+	return doc, nil
+}
+
+/*
+updateValue walks the path down to the container of its last token and returns doc with that
+container replaced by fn's result, since inserting into or removing from a slice reallocates it.
+*/
+func updateValue(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		child, ok := d[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path not found at %q", path[0])
+		}
+		updated, err := updateValue(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[path[0]] = updated
+		return d, nil
+	case []interface{}:
+		index, err := arrayIndex(path[0], len(d)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateValue(d[index], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[index] = updated
+		return d, nil
+	default:
+		return nil, fmt.Errorf("path not found at %q", path[0])
+	}
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateValue(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			index, err := arrayIndex(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[index+1:], c[index:])
+			c[index] = value
+			return c, nil
+		default:
+			return nil, fmt.Errorf("cannot add %q to a scalar", token)
+		}
+	})
+}
+
+func replaceValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return updateValue(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("path not found at %q", token)
+			}
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			c[index] = value
+			return c, nil
+		default:
+			return nil, fmt.Errorf("path not found at %q", token)
+		}
+	})
+}
+
+/*
+removeValue removes the value at path and returns the document and the removed value.
+*/
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+
+	var removed interface{}
+	doc, err := updateValue(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			value, ok := c[token]
+			if !ok {
+				return nil, fmt.Errorf("path not found at %q", token)
+			}
+			removed = value
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[index]
+			return append(c[:index], c[index+1:]...), nil
+		default:
+			return nil, fmt.Errorf("path not found at %q", token)
+		}
+	})
+	return doc, removed, err
+}
+
+func deepCopy(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(vv))
+		for k, item := range vv {
+			copied[k] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(vv))
+		for i, item := range vv {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
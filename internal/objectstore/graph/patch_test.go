@@ -0,0 +1,158 @@
+package graph
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, value string) interface{} {
+	t.Helper()
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil {
+		t.Fatalf("invalid JSON %s: %v", value, err)
+	}
+	return decoded
+}
+
+func encodeJSON(t *testing.T, value interface{}) string {
+	t.Helper()
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(encoded)
+}
+
+/*
+The vectors of RFC 6902 appendix A (A.13, a duplicated member, is left to the JSON decoder),
+then the cases of RFC 6901 pointers and array indexes. An empty want expects an error.
+*/
+func TestApplyPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"A.1 add an object member", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"A.2 add an array element", `{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"A.3 remove an object member", `{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo":"bar"}`},
+		{"A.4 remove an array element", `{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"A.5 replace a value", `{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{
+			"A.6 move a value",
+			`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`,
+		},
+		{"A.7 move an array element", `{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{
+			"A.8 test a value, success",
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz":"qux","foo":["a",2,"c"]}`,
+		},
+		{"A.9 test a value, error", `{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, ``},
+		{"A.10 add a nested member object", `{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{"A.11 ignore unrecognized elements", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`, `{"baz":"qux","foo":"bar"}`},
+		{"A.12 add to a nonexistent target", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, ``},
+		{"A.14 ~ escape ordering", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`, `{"/":9,"~1":10}`},
+		{"A.15 compare strings and numbers", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": "10"}]`, ``},
+		{"A.16 add an array value", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+
+		{"~1 and ~0 escapes", `{"a/b": 1, "m~n": 8}`, `[{"op": "replace", "path": "/a~1b", "value": 2}, {"op": "remove", "path": "/m~0n"}]`, `{"a/b":2}`},
+		{"- index of a remove", `{"foo": ["bar"]}`, `[{"op": "remove", "path": "/foo/-"}]`, ``},
+		{"index past the end", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/2", "value": "baz"}]`, ``},
+		{"index of the end", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/1", "value": "baz"}]`, `{"foo":["bar","baz"]}`},
+		{"leading zero", `{"foo": ["bar", "baz"]}`, `[{"op": "remove", "path": "/foo/01"}]`, ``},
+		{"sign", `{"foo": ["bar", "baz"]}`, `[{"op": "remove", "path": "/foo/+1"}]`, ``},
+		{"move into a child", `{"foo": {"bar": {}}}`, `[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`, ``},
+		{"move into a sibling", `{"foo": {"bar": 1}, "foobar": {}}`, `[{"op": "move", "from": "/foo", "path": "/foobar/foo"}]`, `{"foobar":{"foo":{"bar":1}}}`},
+		{"copy is deep", `{"foo": {"bar": 1}}`, `[{"op": "copy", "from": "/foo", "path": "/baz"}, {"op": "replace", "path": "/baz/bar", "value": 2}]`, `{"baz":{"bar":2},"foo":{"bar":1}}`},
+		{"replace the document", `{"foo": "bar"}`, `[{"op": "replace", "path": "", "value": {"baz": 1}}]`, `{"baz":1}`},
+		{"replace a missing member", `{"foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": 1}]`, ``},
+		{"add without a value", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz"}]`, ``},
+		{"add a null value", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": null}]`, `{"baz":null,"foo":"bar"}`},
+		{"unknown operation", `{"foo": "bar"}`, `[{"op": "merge", "path": "/foo", "value": 1}]`, ``},
+		{"pointer without a slash", `{"foo": "bar"}`, `[{"op": "remove", "path": "foo"}]`, ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ops []PatchOperation
+			if err := json.Unmarshal([]byte(tt.patch), &ops); err != nil {
+				t.Fatal(err)
+			}
+
+			doc := decodeJSON(t, tt.doc)
+			before := encodeJSON(t, doc)
+			patched, err := ApplyPatch(doc, ops)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("ApplyPatch = %s, want an error", encodeJSON(t, patched))
+				}
+			} else if err != nil {
+				t.Errorf("ApplyPatch: %v", err)
+			} else if got := encodeJSON(t, patched); got != tt.want {
+				t.Errorf("ApplyPatch = %s, want %s", got, tt.want)
+			}
+
+			if after := encodeJSON(t, doc); after != before {
+				t.Errorf("ApplyPatch modified the document to %s", after)
+			}
+		})
+	}
+}
+
+func TestApplyPatchFailedTestIsAtomic(t *testing.T) {
+	doc := decodeJSON(t, `{"foo": ["bar"], "baz": "qux"}`)
+	var ops []PatchOperation
+	if err := json.Unmarshal([]byte(`[
+		{"op": "add", "path": "/foo/-", "value": "added"},
+		{"op": "remove", "path": "/baz"},
+		{"op": "test", "path": "/foo/0", "value": "other"}
+	]`), &ops); err != nil {
+		t.Fatal(err)
+	}
+
+	patched, err := ApplyPatch(doc, ops)
+	if !errors.Is(err, ErrPatchTestFailed) || patched != nil {
+		t.Fatalf("ApplyPatch = %v, %v, want ErrPatchTestFailed", patched, err)
+	}
+	if got := encodeJSON(t, doc); got != `{"baz":"qux","foo":["bar"]}` {
+		t.Errorf("document after the failed patch = %s, want it untouched", got)
+	}
+}
+
+/*
+The vectors of RFC 7396 appendix A.
+*/
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.patch, func(t *testing.T) {
+			merged := MergePatch(decodeJSON(t, tt.target), decodeJSON(t, tt.patch))
+			if got := encodeJSON(t, merged); got != tt.want {
+				t.Errorf("MergePatch = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package nodestore
+
+import (
+	"fmt"
+	"sort"
+
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+)
+
+const (
+	SortObjectID     = "objectId"
+	SortCreationDate = "creationDate"
+)
+
+/*
+ListQuery selects a page of the roots whose fieldName is Root (see graph.ExtractGraphNodes).
+Roots are ordered by Sort, then by objectId to break ties: creationDate sorts chronologically on
+its sortable form (storage.CreationDateField). Filter holds field values the roots must have.
+After resumes the listing past the last root of the previous page.
+*/
+type ListQuery struct {
+	Root       string
+	Sort       string
+	Descending bool
+	Filter     map[string]string
+	After      *ListPosition
+	Limit      int
+}
+
+/*
+ListPosition is the position of a root in a listing: its value of the sort field and its objectId.
+*/
+type ListPosition struct {
+	SortValue string
+	ObjectID  string
+}
+
+/*
+PositionOf returns the position of the root in a listing sorted by sort.
+*/
+func PositionOf(root map[string]interface{}, sort string) ListPosition {
+	objectId, _ := root["objectId"].(string)
+	return ListPosition{SortValue: sortValue(root, sortField(sort)), ObjectID: objectId}
+}
+
+/*
+sortField returns the stored field a sort orders the roots by.
+*/
+func sortField(sort string) string {
+	if sort == SortCreationDate {
+		return storage.CreationDateField
+	}
+	return sort
+}
+
+func sortValue(root map[string]interface{}, field string) string {
+	switch v := root[field].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+/*
+comesAfter reports whether position a is listed after position b.
+*/
+func (q ListQuery) comesAfter(a, b ListPosition) bool {
+	if a.SortValue == b.SortValue {
+		if q.Descending {
+			return a.ObjectID < b.ObjectID
+		}
+		return a.ObjectID > b.ObjectID
+	}
+	if q.Descending {
+		return a.SortValue < b.SortValue
+	}
+	return a.SortValue > b.SortValue
+}
+
+/*
+sortRoots orders the roots as listed by the query.
+*/
+func sortRoots(roots []map[string]interface{}, query ListQuery) {
+	sort.Slice(roots, func(i, j int) bool {
+		return query.comesAfter(PositionOf(roots[j], query.Sort), PositionOf(roots[i], query.Sort))
+	})
+}
+
+/*
+pageRoots filters, sorts and pages the roots in memory, for the stores that cannot query
+the fields of the nodes.
+*/
+func pageRoots(roots []map[string]interface{}, query ListQuery) []map[string]interface{} {
+	selected := []map[string]interface{}{}
+	for _, root := range roots {
+		matches := true
+		for field, value := range query.Filter {
+			if sortValue(root, field) != value {
+				matches = false
+				break
+			}
+		}
+		if matches && (query.After == nil || query.comesAfter(PositionOf(root, query.Sort), *query.After)) {
+			selected = append(selected, root)
+		}
+	}
+
+	sortRoots(selected, query)
+	if query.Limit > 0 && len(selected) > query.Limit {
+		selected = selected[:query.Limit]
+	}
+	return selected
+}
@@ -0,0 +1,385 @@
+package nodestore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+)
+
+type memoryTxKey struct{}
+
+/*
+MemoryStore keeps the nodes in memory with the same edge set semantics as the Mongo store.
+It is safe for concurrent use: transactions are serialized and rolled back on error, and
+writes outside a transaction wait for the running one.
+*/
+type MemoryStore struct {
+	txMu     sync.Mutex
+	mu       sync.RWMutex
+	nodes    map[string]map[string]interface{}
+	versions map[string][]Version
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		nodes:    make(map[string]map[string]interface{}),
+		versions: make(map[string][]Version),
+	}
+}
+
+func (s *MemoryStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ctx.Value(memoryTxKey{}) == s {
+		return fn(ctx)
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	// stored nodes and versions are never modified in place, a copy of the indexes is a snapshot
+	s.mu.RLock()
+	snapshot := make(map[string]map[string]interface{}, len(s.nodes))
+	for id, node := range s.nodes {
+		snapshot[id] = node
+	}
+	versionsSnapshot := make(map[string][]Version, len(s.versions))
+	for planId, versions := range s.versions {
+		versionsSnapshot[planId] = versions
+	}
+	s.mu.RUnlock()
+
+	if err := fn(context.WithValue(ctx, memoryTxKey{}, s)); err != nil {
+		s.mu.Lock()
+		s.nodes = snapshot
+		s.versions = versionsSnapshot
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryStore) Exists(ctx context.Context, id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.nodes[id]
+	return ok, nil
+}
+
+func (s *MemoryStore) GetRaw(ctx context.Context, id string) (map[string]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	node, ok := s.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return copyValue(node).(map[string]interface{}), nil
+}
+
+func (s *MemoryStore) GetExpanded(ctx context.Context, id string) (map[string]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// like the Mongo store, a $ref pointing nowhere fails the expansion
+	subgraph := map[string]map[string]interface{}{}
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, loaded := subgraph[current]; loaded {
+			continue
+		}
+		node, ok := s.nodes[current]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, current)
+		}
+		subgraph[current] = node
+		queue = append(queue, storage.NodeRefs(node)...)
+	}
+
+	expanded, err := storage.ExpandNode(subgraph, id)
+	if err != nil {
+		return nil, err
+	}
+	return copyValue(expanded).(map[string]interface{}), nil
+}
+
+func (s *MemoryStore) ListRoots(ctx context.Context, query ListQuery) ([]map[string]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	roots := []map[string]interface{}{}
+	for _, node := range s.nodes {
+		if node["fieldName"] == query.Root {
+			roots = append(roots, node)
+		}
+	}
+
+	page := pageRoots(roots, query)
+	for i, root := range page {
+		page[i] = copyValue(root).(map[string]interface{})
+	}
+	return page, nil
+}
+
+func (s *MemoryStore) UpsertNodes(ctx context.Context, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	var removed map[string]map[string]interface{}
+	err := s.write(ctx, func() {
+		edges := storage.GraphEdges(nodes)
+
+		// edges to the stored children from nodes of this graph, before the upsert
+		previous := map[string][]string{}
+		for id, stored := range s.nodes {
+			for _, parent := range storage.ReferencedBy(stored) {
+				if _, inGraph := nodes[parent]; inGraph {
+					previous[id] = append(previous[id], parent)
+				}
+			}
+		}
+
+		for id, node := range nodes {
+			parents := storage.ReferencedBy(s.nodes[id])
+			for _, parent := range edges[id] {
+				parents = appendUnique(parents, parent)
+			}
+			s.put(id, storage.NodeFields(node), parents)
+		}
+
+		released := []string{}
+		for id, parents := range previous {
+			stale := []string{}
+			for _, parent := range parents {
+				if !contains(edges[id], parent) {
+					stale = append(stale, parent)
+				}
+			}
+			if len(stale) > 0 {
+				s.pullEdges(id, stale...)
+				released = append(released, id)
+			}
+		}
+
+		removed = s.collectUnreferenced(released)
+	})
+	return removed, err
+}
+
+func (s *MemoryStore) DeleteNodes(ctx context.Context, id string) (map[string]map[string]interface{}, error) {
+	var removed map[string]map[string]interface{}
+	var err error
+	writeErr := s.write(ctx, func() {
+		if _, ok := s.nodes[id]; !ok {
+			err = fmt.Errorf("%w: %s", ErrNotFound, id)
+			return
+		}
+		s.pullEdges(id, storage.RootEdge)
+		removed = s.collectUnreferenced([]string{id})
+	})
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	return removed, err
+}
+
+func (s *MemoryStore) InsertRoot(ctx context.Context, id string) error {
+	var err error
+	writeErr := s.write(ctx, func() {
+		if _, ok := s.nodes[id]; ok {
+			err = fmt.Errorf("%w: %s", ErrExists, id)
+			return
+		}
+		s.nodes[id] = map[string]interface{}{}
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func (s *MemoryStore) SwapRevision(ctx context.Context, id string, expected int64) error {
+	var err error
+	writeErr := s.write(ctx, func() {
+		stored, ok := s.nodes[id]
+		if !ok || storage.Revision(stored) != expected {
+			err = fmt.Errorf("%w: plan %s is no longer at revision %d", ErrRevisionConflict, id, expected)
+			return
+		}
+		node := copyValue(stored).(map[string]interface{})
+		node[storage.RevisionField] = expected + 1
+		s.nodes[id] = node
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+func (s *MemoryStore) AddVersion(ctx context.Context, version *Version) error {
+	return s.write(ctx, func() {
+		versions := s.versions[version.PlanID]
+		version.Number = len(versions) + 1
+		version.CreatedAt = time.Now().UTC()
+
+		stored := *version
+		if version.Plan != nil {
+			stored.Plan = copyValue(version.Plan).(map[string]interface{})
+		}
+		s.versions[version.PlanID] = append(versions, stored)
+	})
+}
+
+func (s *MemoryStore) ListVersions(ctx context.Context, planId string) ([]Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := make([]Version, 0, len(s.versions[planId]))
+	for _, version := range s.versions[planId] {
+		version.Plan = nil
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func (s *MemoryStore) GetVersion(ctx context.Context, planId string, number int) (*Version, error) {
+	return s.findVersion(planId, func(version Version) bool { return version.Number == number })
+}
+
+func (s *MemoryStore) GetVersionAsOf(ctx context.Context, planId string, asOf time.Time) (*Version, error) {
+	return s.findVersion(planId, func(version Version) bool { return !version.CreatedAt.After(asOf) })
+}
+
+/*
+findVersion returns the latest version of the plan matching match.
+*/
+func (s *MemoryStore) findVersion(planId string, match func(Version) bool) (*Version, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	versions := s.versions[planId]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if match(versions[i]) {
+			version := versions[i]
+			if version.Plan != nil {
+				version.Plan = copyValue(version.Plan).(map[string]interface{})
+			}
+			return &version, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no version of plan %s", ErrNotFound, planId)
+}
+
+/*
+write runs fn under the write lock, outside a transaction it also waits for the running one.
+*/
+func (s *MemoryStore) write(ctx context.Context, fn func()) error {
+	if ctx.Value(memoryTxKey{}) != s {
+		s.txMu.Lock()
+		defer s.txMu.Unlock()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn()
+	return nil
+}
+
+// put, pullEdges and collectUnreferenced must be called with s.mu held
+
+func (s *MemoryStore) put(id string, fields map[string]interface{}, parents []string) {
+	node := copyValue(fields).(map[string]interface{})
+	edges := make([]interface{}, 0, len(parents))
+	for _, parent := range parents {
+		edges = append(edges, parent)
+	}
+	node["_id"] = id
+	node[storage.ReferencedByField] = edges
+	// the revision is only changed by SwapRevision
+	delete(node, storage.RevisionField)
+	if stored, ok := s.nodes[id]; ok {
+		if revision, ok := stored[storage.RevisionField]; ok {
+			node[storage.RevisionField] = revision
+		}
+	}
+	s.nodes[id] = node
+}
+
+func (s *MemoryStore) pullEdges(id string, parents ...string) {
+	stored, ok := s.nodes[id]
+	if !ok {
+		return
+	}
+
+	kept := []string{}
+	for _, parent := range storage.ReferencedBy(stored) {
+		if !contains(parents, parent) {
+			kept = append(kept, parent)
+		}
+	}
+	s.put(id, stored, kept)
+}
+
+func (s *MemoryStore) collectUnreferenced(candidates []string) map[string]map[string]interface{} {
+	removed := map[string]map[string]interface{}{}
+	for len(candidates) > 0 {
+		id := candidates[0]
+		candidates = candidates[1:]
+
+		node, ok := s.nodes[id]
+		if !ok || len(storage.ReferencedBy(node)) > 0 {
+			continue
+		}
+		delete(s.nodes, id)
+		removed[id] = node
+
+		for _, child := range storage.NodeRefs(node) {
+			s.pullEdges(child, id)
+			candidates = append(candidates, child)
+		}
+	}
+	return removed
+}
+
+/*
+copyValue deep-copies the maps and slices of a JSON-like value, so callers never share
+the stored nodes.
+*/
+func copyValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(vv))
+		for k, item := range vv {
+			copied[k] = copyValue(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(vv))
+		for i, item := range vv {
+			copied[i] = copyValue(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(values []string, value string) []string {
+	if contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
@@ -0,0 +1,223 @@
+package nodestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+MongoStore keeps the nodes in a MongoDB collection through the storage package,
+and the plan versions in a second collection of the same database.
+*/
+type MongoStore struct {
+	collection *mongo.Collection
+	versions   *mongo.Collection
+}
+
+func NewMongoStore(collection, versions *mongo.Collection) *MongoStore {
+	return &MongoStore{
+		collection: collection,
+		versions:   versions,
+	}
+}
+
+/*
+EnsureIndexes creates the node indexes, the indexes listing the plan roots in each sort order,
+and the unique (planId, version) index of the versions, which also rejects a concurrent write
+taking the same version number.
+*/
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	if err := storage.EnsureIndexes(ctx, s.collection); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := s.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "fieldName", Value: 1}, {Key: SortObjectID, Value: 1}}},
+		{Keys: bson.D{{Key: "fieldName", Value: 1}, {Key: storage.CreationDateField, Value: 1}, {Key: SortObjectID, Value: 1}}},
+	})
+	if err != nil {
+		logger.Logger.Error("MongoStore.EnsureIndexes failed", zap.Error(err))
+		return fmt.Errorf("failed to create plan list indexes: %v", err)
+	}
+
+	_, err = s.versions.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "planId", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		logger.Logger.Error("MongoStore.EnsureIndexes failed", zap.Error(err))
+		return fmt.Errorf("failed to create version indexes: %v", err)
+	}
+	return nil
+}
+
+func (s *MongoStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return storage.WithTransaction(ctx, s.collection, fn)
+}
+
+func (s *MongoStore) Exists(ctx context.Context, id string) (bool, error) {
+	_, err := s.GetRaw(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *MongoStore) GetRaw(ctx context.Context, id string) (map[string]interface{}, error) {
+	node, err := storage.GetNodeRaw(ctx, s.collection, id)
+	return node, notFound(err)
+}
+
+func (s *MongoStore) GetExpanded(ctx context.Context, id string) (map[string]interface{}, error) {
+	node, err := storage.GetExpandedNode(ctx, s.collection, id)
+	return node, notFound(err)
+}
+
+func (s *MongoStore) ListRoots(ctx context.Context, query ListQuery) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"fieldName": query.Root}
+	for field, value := range query.Filter {
+		filter[field] = value
+	}
+
+	// keyset pagination on (sort field, objectId)
+	field := sortField(query.Sort)
+	order, next := 1, "$gt"
+	if query.Descending {
+		order, next = -1, "$lt"
+	}
+	if query.After != nil {
+		if query.Sort == SortObjectID {
+			filter["objectId"] = bson.M{next: query.After.ObjectID}
+		} else {
+			filter["$or"] = bson.A{
+				bson.M{field: bson.M{next: query.After.SortValue}},
+				bson.M{field: query.After.SortValue, "objectId": bson.M{next: query.After.ObjectID}},
+			}
+		}
+	}
+	sort := bson.D{{Key: field, Value: order}}
+	if query.Sort != SortObjectID {
+		sort = append(sort, bson.E{Key: "objectId", Value: order})
+	}
+
+	opts := options.Find().SetSort(sort)
+	if query.Limit > 0 {
+		opts.SetLimit(int64(query.Limit))
+	}
+	cursor, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		logger.Logger.Error("MongoStore.ListRoots failed", zap.Error(err))
+		return nil, fmt.Errorf("failed to list plans: %v", err)
+	}
+
+	roots := []map[string]interface{}{}
+	if err := cursor.All(ctx, &roots); err != nil {
+		return nil, fmt.Errorf("failed to decode plans: %v", err)
+	}
+	return roots, nil
+}
+
+func (s *MongoStore) UpsertNodes(ctx context.Context, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	return storage.StoreExtractedGraphNodes(ctx, s.collection, nodes)
+}
+
+func (s *MongoStore) DeleteNodes(ctx context.Context, id string) (map[string]map[string]interface{}, error) {
+	removed, err := storage.DeleteGraphRoot(ctx, s.collection, id)
+	return removed, notFound(err)
+}
+
+func (s *MongoStore) InsertRoot(ctx context.Context, id string) error {
+	inserted, err := storage.InsertNode(ctx, s.collection, id)
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return fmt.Errorf("%w: %s", ErrExists, id)
+	}
+	return nil
+}
+
+func (s *MongoStore) SwapRevision(ctx context.Context, id string, expected int64) error {
+	swapped, err := storage.SwapRevision(ctx, s.collection, id, expected)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return fmt.Errorf("%w: plan %s is no longer at revision %d", ErrRevisionConflict, id, expected)
+	}
+	return nil
+}
+
+func (s *MongoStore) AddVersion(ctx context.Context, version *Version) error {
+	latest := Version{}
+	err := s.versions.FindOne(ctx, bson.M{"planId": version.PlanID},
+		options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}}).SetProjection(bson.M{"plan": 0}),
+	).Decode(&latest)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("failed to get the latest version of plan %s: %v", version.PlanID, err)
+	}
+
+	version.Number = latest.Number + 1
+	version.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	if _, err := s.versions.InsertOne(ctx, version); err != nil {
+		logger.Logger.Error("MongoStore.AddVersion failed", zap.String("planId", version.PlanID), zap.Error(err))
+		return fmt.Errorf("failed to add version %d of plan %s: %v", version.Number, version.PlanID, err)
+	}
+	return nil
+}
+
+func (s *MongoStore) ListVersions(ctx context.Context, planId string) ([]Version, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "version", Value: 1}}).SetProjection(bson.M{"plan": 0})
+	cursor, err := s.versions.Find(ctx, bson.M{"planId": planId}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of plan %s: %v", planId, err)
+	}
+
+	versions := []Version{}
+	if err := cursor.All(ctx, &versions); err != nil {
+		return nil, fmt.Errorf("failed to decode versions of plan %s: %v", planId, err)
+	}
+	return versions, nil
+}
+
+func (s *MongoStore) GetVersion(ctx context.Context, planId string, number int) (*Version, error) {
+	return s.findVersion(ctx, bson.M{"planId": planId, "version": number})
+}
+
+func (s *MongoStore) GetVersionAsOf(ctx context.Context, planId string, asOf time.Time) (*Version, error) {
+	return s.findVersion(ctx, bson.M{"planId": planId, "createdAt": bson.M{"$lte": asOf}})
+}
+
+func (s *MongoStore) findVersion(ctx context.Context, filter bson.M) (*Version, error) {
+	var version Version
+	err := s.versions.FindOne(ctx, filter, options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})).Decode(&version)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &version, nil
+}
+
+/*
+notFound translates mongo.ErrNoDocuments into ErrNotFound, keeping the message.
+*/
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
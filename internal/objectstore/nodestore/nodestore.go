@@ -0,0 +1,101 @@
+package nodestore
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("node not found")
+
+	// ErrExists is returned by InsertRoot when a node is already stored with the id
+	ErrExists = errors.New("node already exists")
+
+	// ErrRevisionConflict is returned by SwapRevision when another write moved the plan revision
+	ErrRevisionConflict = errors.New("plan revision conflict")
+)
+
+/*
+NodeStore stores the nodes of plan graphs (see graph.ExtractGraphNodes), one entry per objectId,
+with child objects kept as {"$ref": id}. Nodes shared between plans are stored once and removed
+when no plan references them anymore.
+*/
+type NodeStore interface {
+	/*
+		WithTransaction runs fn atomically, store calls made with the ctx passed to fn join it.
+	*/
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+
+	Exists(ctx context.Context, id string) (bool, error)
+
+	/*
+		GetRaw returns the stored node, with its $refs, or ErrNotFound.
+	*/
+	GetRaw(ctx context.Context, id string) (map[string]interface{}, error)
+
+	/*
+		GetExpanded returns the node with every $ref replaced by the referenced node, or ErrNotFound.
+	*/
+	GetExpanded(ctx context.Context, id string) (map[string]interface{}, error)
+
+	/*
+		ListRoots returns the root nodes selected by query, in its order, with their $refs.
+	*/
+	ListRoots(ctx context.Context, query ListQuery) ([]map[string]interface{}, error)
+
+	/*
+		UpsertNodes stores the nodes of a plan graph and returns the nodes it no longer references
+		and no other plan does, which are removed.
+	*/
+	UpsertNodes(ctx context.Context, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error)
+
+	/*
+		DeleteNodes deletes the plan rooted at id and returns the removed nodes,
+		nodes shared with other plans are kept.
+	*/
+	DeleteNodes(ctx context.Context, id string) (map[string]map[string]interface{}, error)
+
+	/*
+		InsertRoot claims the id of a new plan by inserting an empty root node, or fails with
+		ErrExists when a node is already stored with the id. Called first in the transaction of
+		a create, so of two concurrent creates of the same plan only one commits; the UpsertNodes
+		that follows fills the node.
+	*/
+	InsertRoot(ctx context.Context, id string) error
+
+	/*
+		SwapRevision bumps the revision of the plan root (storage.RevisionField) from expected to
+		expected+1, or fails with ErrRevisionConflict when the plan is gone or another write moved
+		it since it was read. Called first in the transaction of a write, so of two concurrent
+		writes of the same revision only one commits.
+	*/
+	SwapRevision(ctx context.Context, id string, expected int64) error
+
+	/*
+		AddVersion records version as the next version of its plan, setting its number and time.
+		Called in the transaction of the write, so the version commits with the nodes.
+	*/
+	AddVersion(ctx context.Context, version *Version) error
+
+	/*
+		ListVersions returns the versions of the plan in order, without their plan.
+	*/
+	ListVersions(ctx context.Context, planId string) ([]Version, error)
+
+	/*
+		GetVersion returns the version of the plan with the given number, or ErrNotFound.
+	*/
+	GetVersion(ctx context.Context, planId string, number int) (*Version, error)
+
+	/*
+		GetVersionAsOf returns the latest version of the plan created at or before asOf, or ErrNotFound.
+	*/
+	GetVersionAsOf(ctx context.Context, planId string, asOf time.Time) (*Version, error)
+}
+
+var (
+	_ NodeStore = (*MongoStore)(nil)
+	_ NodeStore = (*SQLStore)(nil)
+	_ NodeStore = (*MemoryStore)(nil)
+)
@@ -0,0 +1,467 @@
+package nodestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/objectstore/graph"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/resource/resourcetest"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+/*
+The same suite runs against every NodeStore. The Mongo one needs a MongoDB server at MONGO_URI
+(default mongodb://localhost:27017), started as a replica set for the transactions, and is
+skipped without one.
+*/
+
+func TestMemoryStore(t *testing.T) {
+	testNodeStore(t, func(t *testing.T) NodeStore {
+		return NewMemoryStore()
+	})
+}
+
+func TestSQLStore(t *testing.T) {
+	testNodeStore(t, func(t *testing.T) NodeStore {
+		service, err := database.NewSQLService(database.DriverSQLite, filepath.Join(t.TempDir(), "nodes.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(service.Close)
+
+		store := NewSQLStore(service.GetDB())
+		if err := store.EnsureSchema(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func TestMongoStore(t *testing.T) {
+	client := mongoClient(t)
+	testNodeStore(t, func(t *testing.T) NodeStore {
+		database := client.Database(fmt.Sprintf("nodestore_test_%d", time.Now().UnixNano()))
+		t.Cleanup(func() { database.Drop(context.Background()) })
+
+		store := NewMongoStore(database.Collection("plans"), database.Collection("plan_versions"))
+		if err := store.EnsureIndexes(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+}
+
+func mongoClient(t *testing.T) *mongo.Client {
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		uri = "mongodb://localhost:27017"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(2*time.Second))
+	if err != nil {
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		t.Skipf("MongoDB unavailable: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+func testNodeStore(t *testing.T, newStore func(t *testing.T) NodeStore) {
+	logger.Logger = zap.NewNop()
+
+	tests := []struct {
+		name string
+		test func(t *testing.T, store NodeStore)
+	}{
+		{"UpsertAndExpand", testUpsertAndExpand},
+		{"SharedNodeEdges", testSharedNodeEdges},
+		{"UpsertReleasesReplacedNodes", testUpsertReleasesReplacedNodes},
+		{"DeleteCollectsUnreferenced", testDeleteCollectsUnreferenced},
+		{"InsertRoot", testInsertRoot},
+		{"SwapRevision", testSwapRevision},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"Versions", testVersions},
+		{"ListRoots", testListRoots},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStore(t))
+		})
+	}
+}
+
+func upsertPlan(t *testing.T, store NodeStore, plan map[string]interface{}) map[string]map[string]interface{} {
+	t.Helper()
+	removed, err := store.UpsertNodes(context.Background(), graph.ExtractGraphNodes("plan", plan))
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+	return removed
+}
+
+func deletePlan(t *testing.T, store NodeStore, id string) []string {
+	t.Helper()
+	removed, err := store.DeleteNodes(context.Background(), id)
+	if err != nil {
+		t.Fatalf("DeleteNodes(%s): %v", id, err)
+	}
+	return sortedKeys(removed)
+}
+
+func sortedKeys(nodes map[string]map[string]interface{}) []string {
+	ids := []string{}
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func parentsOf(t *testing.T, store NodeStore, id string) []string {
+	t.Helper()
+	node, err := store.GetRaw(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetRaw(%s): %v", id, err)
+	}
+	parents := storage.ReferencedBy(node)
+	sort.Strings(parents)
+	return parents
+}
+
+func assertIds(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+	}
+}
+
+func testUpsertAndExpand(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+	if removed := upsertPlan(t, store, resourcetest.Plan("plan-1", "service-1")); len(removed) != 0 {
+		t.Errorf("first upsert removed %v", sortedKeys(removed))
+	}
+
+	exists, err := store.Exists(ctx, "plan-1-planservice")
+	if err != nil || !exists {
+		t.Errorf("Exists(plan-1-planservice) = %v, %v, want true", exists, err)
+	}
+
+	raw, err := store.GetRaw(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("GetRaw: %v", err)
+	}
+	if ref, _ := raw["planCostShares"].(map[string]interface{}); ref["$ref"] != "plan-1-cost" {
+		t.Errorf("raw planCostShares = %v, want a $ref to plan-1-cost", raw["planCostShares"])
+	}
+	assertIds(t, "plan edges", parentsOf(t, store, "plan-1"), []string{storage.RootEdge})
+
+	expanded, err := store.GetExpanded(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("GetExpanded: %v", err)
+	}
+	services, _ := expanded["linkedPlanServices"].([]interface{})
+	if len(services) != 1 {
+		t.Fatalf("expanded %d linked plan services, want 1", len(services))
+	}
+	service, _ := services[0].(map[string]interface{})["linkedService"].(map[string]interface{})
+	if service["name"] != "Yearly physical" {
+		t.Errorf("expanded linkedService = %v", service)
+	}
+
+	if _, err := store.GetExpanded(ctx, "plan-2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetExpanded of a missing plan: %v, want ErrNotFound", err)
+	}
+}
+
+func testSharedNodeEdges(t *testing.T, store NodeStore) {
+	upsertPlan(t, store, resourcetest.Plan("plan-1", "service-shared"))
+	upsertPlan(t, store, resourcetest.Plan("plan-2", "service-shared"))
+	assertIds(t, "shared service edges", parentsOf(t, store, "service-shared"), []string{"plan-1-planservice", "plan-2-planservice"})
+
+	assertIds(t, "removed by the first delete", deletePlan(t, store, "plan-1"), []string{"plan-1", "plan-1-cost", "plan-1-planservice", "plan-1-service-cost"})
+	assertIds(t, "shared service edges", parentsOf(t, store, "service-shared"), []string{"plan-2-planservice"})
+
+	assertIds(t, "removed by the second delete", deletePlan(t, store, "plan-2"), []string{"plan-2", "plan-2-cost", "plan-2-planservice", "plan-2-service-cost", "service-shared"})
+}
+
+func testUpsertReleasesReplacedNodes(t *testing.T, store NodeStore) {
+	upsertPlan(t, store, resourcetest.Plan("plan-1", "service-1"))
+
+	plan := resourcetest.Plan("plan-1", "service-2")
+	plan["planCostShares"].(map[string]interface{})["objectId"] = "plan-1-cost-2"
+	assertIds(t, "removed by the upsert", sortedKeys(upsertPlan(t, store, plan)), []string{"plan-1-cost", "service-1"})
+
+	exists, err := store.Exists(context.Background(), "plan-1-cost-2")
+	if err != nil || !exists {
+		t.Errorf("Exists(plan-1-cost-2) = %v, %v, want true", exists, err)
+	}
+}
+
+func testDeleteCollectsUnreferenced(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+	upsertPlan(t, store, resourcetest.Plan("plan-1", "service-1"))
+
+	assertIds(t, "removed", deletePlan(t, store, "plan-1"), []string{"plan-1", "plan-1-cost", "plan-1-planservice", "plan-1-service-cost", "service-1"})
+	for _, id := range []string{"plan-1", "plan-1-cost", "plan-1-planservice", "plan-1-service-cost", "service-1"} {
+		if exists, err := store.Exists(ctx, id); err != nil || exists {
+			t.Errorf("Exists(%s) after delete = %v, %v, want false", id, exists, err)
+		}
+	}
+
+	if _, err := store.DeleteNodes(ctx, "plan-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second DeleteNodes: %v, want ErrNotFound", err)
+	}
+}
+
+func testInsertRoot(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+
+	// a create inserts the root, then upserts the plan in the same transaction
+	err := store.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := store.InsertRoot(ctx, "plan-1"); err != nil {
+			return err
+		}
+		_, err := store.UpsertNodes(ctx, graph.ExtractGraphNodes("plan", resourcetest.Plan("plan-1", "service-1")))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	assertIds(t, "plan edges", parentsOf(t, store, "plan-1"), []string{storage.RootEdge})
+	if _, err := store.GetExpanded(ctx, "plan-1"); err != nil {
+		t.Errorf("GetExpanded after the create: %v", err)
+	}
+
+	if err := store.InsertRoot(ctx, "plan-1"); !errors.Is(err, ErrExists) {
+		t.Errorf("InsertRoot of a stored plan: %v, want ErrExists", err)
+	}
+	if err := store.InsertRoot(ctx, "service-1"); !errors.Is(err, ErrExists) {
+		t.Errorf("InsertRoot of a stored child node: %v, want ErrExists", err)
+	}
+
+	// the insert of a failed transaction is rolled back
+	failure := errors.New("failed create")
+	err = store.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := store.InsertRoot(ctx, "plan-2"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("failed create: %v", err)
+	}
+	if exists, err := store.Exists(ctx, "plan-2"); err != nil || exists {
+		t.Errorf("Exists(plan-2) after a rolled back insert = %v, %v, want false", exists, err)
+	}
+}
+
+func testSwapRevision(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+	upsertPlan(t, store, resourcetest.Plan("plan-1", "service-1"))
+
+	if err := store.SwapRevision(ctx, "plan-1", 0); err != nil {
+		t.Fatalf("SwapRevision(0): %v", err)
+	}
+	if err := store.SwapRevision(ctx, "plan-1", 0); !errors.Is(err, ErrRevisionConflict) {
+		t.Errorf("SwapRevision of a stale revision: %v, want ErrRevisionConflict", err)
+	}
+	if err := store.SwapRevision(ctx, "plan-2", 0); !errors.Is(err, ErrRevisionConflict) {
+		t.Errorf("SwapRevision of a missing plan: %v, want ErrRevisionConflict", err)
+	}
+
+	// the revision survives the upsert of the plan
+	upsertPlan(t, store, resourcetest.Plan("plan-1", "service-1"))
+	raw, err := store.GetRaw(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("GetRaw: %v", err)
+	}
+	if revision := storage.Revision(raw); revision != 1 {
+		t.Errorf("revision = %d, want 1", revision)
+	}
+}
+
+/*
+testConcurrentWriters runs two writes of the same read revision at once, each swapping the
+revision, upserting the plan and recording its version in one transaction: exactly one commits.
+*/
+func testConcurrentWriters(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+	upsertPlan(t, store, resourcetest.Plan("plan-1", "service-1"))
+	raw, err := store.GetRaw(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("GetRaw: %v", err)
+	}
+	revision := storage.Revision(raw)
+
+	// both writers read the revision before either writes
+	var ready sync.WaitGroup
+	ready.Add(2)
+	results := make(chan error, 2)
+	for _, planType := range []string{"outOfNetwork", "inNetworkOnly"} {
+		plan := resourcetest.Plan("plan-1", "service-1")
+		plan["planType"] = planType
+		go func() {
+			ready.Done()
+			ready.Wait()
+			results <- store.WithTransaction(ctx, func(ctx context.Context) error {
+				if err := store.SwapRevision(ctx, "plan-1", revision); err != nil {
+					return err
+				}
+				if _, err := store.UpsertNodes(ctx, graph.ExtractGraphNodes("plan", plan)); err != nil {
+					return err
+				}
+				return store.AddVersion(ctx, &Version{PlanID: "plan-1", Action: VersionUpdate, Plan: plan})
+			})
+		}()
+	}
+
+	var failures []error
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			failures = append(failures, err)
+		}
+	}
+	if len(failures) != 1 || !errors.Is(failures[0], ErrRevisionConflict) {
+		t.Fatalf("failed writers = %v, want exactly one ErrRevisionConflict", failures)
+	}
+
+	// only the winning write is stored
+	versions, err := store.ListVersions(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("plan has %d versions, want the one of the winning write", len(versions))
+	}
+	version, err := store.GetVersion(ctx, "plan-1", versions[0].Number)
+	if err != nil {
+		t.Fatalf("GetVersion: %v", err)
+	}
+	stored, err := store.GetExpanded(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("GetExpanded: %v", err)
+	}
+	if stored["planType"] != version.Plan["planType"] {
+		t.Errorf("stored planType %v, want %v of the recorded version", stored["planType"], version.Plan["planType"])
+	}
+	raw, err = store.GetRaw(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("GetRaw: %v", err)
+	}
+	if got := storage.Revision(raw); got != revision+1 {
+		t.Errorf("revision = %d, want %d", got, revision+1)
+	}
+}
+
+func testVersions(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+	before := time.Now().Add(-time.Minute)
+
+	for _, action := range []string{"create", "delete"} {
+		version := &Version{PlanID: "plan-1", Action: action, Author: "alice@example.com"}
+		if action == "create" {
+			version.Plan = resourcetest.Plan("plan-1", "service-1")
+		}
+		if err := store.AddVersion(ctx, version); err != nil {
+			t.Fatalf("AddVersion(%s): %v", action, err)
+		}
+	}
+
+	versions, err := store.ListVersions(ctx, "plan-1")
+	if err != nil {
+		t.Fatalf("ListVersions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Number != 1 || versions[1].Number != 2 || versions[1].Action != "delete" {
+		t.Fatalf("versions = %+v, want create 1 then delete 2", versions)
+	}
+
+	first, err := store.GetVersion(ctx, "plan-1", 1)
+	if err != nil {
+		t.Fatalf("GetVersion(1): %v", err)
+	}
+	if first.Plan["objectId"] != "plan-1" || first.Author != "alice@example.com" {
+		t.Errorf("version 1 = %+v", first)
+	}
+	if _, err := store.GetVersion(ctx, "plan-1", 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetVersion(3): %v, want ErrNotFound", err)
+	}
+
+	latest, err := store.GetVersionAsOf(ctx, "plan-1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("GetVersionAsOf(now): %v", err)
+	}
+	if latest.Number != 2 || latest.Plan != nil {
+		t.Errorf("latest version = %+v, want the delete version 2", latest)
+	}
+	if _, err := store.GetVersionAsOf(ctx, "plan-1", before); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetVersionAsOf(before): %v, want ErrNotFound", err)
+	}
+}
+
+func testListRoots(t *testing.T, store NodeStore) {
+	ctx := context.Background()
+
+	// dd-mm-yyyy dates, whose string order differs from the chronological one
+	for _, plan := range []struct {
+		id, planType, creationDate string
+	}{
+		{"plan-a", "inNetwork", "01-02-2021"},
+		{"plan-b", "outOfNetwork", "15-01-2020"},
+		{"plan-c", "inNetwork", "20-12-2019"},
+	} {
+		payload := resourcetest.Plan(plan.id, "service-shared")
+		payload["planType"] = plan.planType
+		payload["creationDate"] = plan.creationDate
+		upsertPlan(t, store, payload)
+	}
+
+	list := func(query ListQuery) []string {
+		t.Helper()
+		query.Root = "plan"
+		roots, err := store.ListRoots(ctx, query)
+		if err != nil {
+			t.Fatalf("ListRoots(%+v): %v", query, err)
+		}
+		ids := []string{}
+		for _, root := range roots {
+			ids = append(ids, root["objectId"].(string))
+		}
+		return ids
+	}
+
+	assertIds(t, "by objectId", list(ListQuery{Sort: SortObjectID}), []string{"plan-a", "plan-b", "plan-c"})
+	assertIds(t, "by objectId descending", list(ListQuery{Sort: SortObjectID, Descending: true}), []string{"plan-c", "plan-b", "plan-a"})
+	assertIds(t, "by creationDate", list(ListQuery{Sort: SortCreationDate}), []string{"plan-c", "plan-b", "plan-a"})
+	assertIds(t, "filtered", list(ListQuery{Sort: SortObjectID, Filter: map[string]string{"planType": "inNetwork"}}), []string{"plan-a", "plan-c"})
+
+	// keyset pages
+	query := ListQuery{Root: "plan", Sort: SortCreationDate, Descending: true, Limit: 2}
+	page, err := store.ListRoots(ctx, query)
+	if err != nil {
+		t.Fatalf("ListRoots: %v", err)
+	}
+	if len(page) != 2 {
+		t.Fatalf("first page has %d roots, want 2", len(page))
+	}
+	after := PositionOf(page[1], query.Sort)
+	query.After = &after
+	assertIds(t, "second page", list(query), []string{"plan-c"})
+}
@@ -0,0 +1,637 @@
+package nodestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.uber.org/zap"
+)
+
+var sqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS plan_nodes (
+		id            TEXT PRIMARY KEY,
+		object_type   TEXT NOT NULL,
+		parent_id     TEXT NOT NULL,
+		field_name    TEXT NOT NULL,
+		body          TEXT NOT NULL,
+		revision      INTEGER NOT NULL DEFAULT 0,
+		org           TEXT NOT NULL DEFAULT '',
+		plan_type     TEXT NOT NULL DEFAULT '',
+		creation_date TEXT NOT NULL DEFAULT ''
+	)`,
+	// edge set: the nodes whose fields $ref child_id, plus the root edge ('') of plan roots
+	`CREATE TABLE IF NOT EXISTS plan_node_refs (
+		parent_id TEXT NOT NULL,
+		child_id  TEXT NOT NULL,
+		PRIMARY KEY (parent_id, child_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS plan_node_refs_child_id ON plan_node_refs (child_id)`,
+	// plan is the expanded plan as JSON, NULL for a delete version
+	`CREATE TABLE IF NOT EXISTS plan_versions (
+		plan_id    TEXT NOT NULL,
+		version    INTEGER NOT NULL,
+		action     TEXT NOT NULL,
+		author     TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		plan       TEXT,
+		PRIMARY KEY (plan_id, version)
+	)`,
+}
+
+/*
+sqlColumns are the plan_nodes columns added after the table was first created, created on older
+databases by EnsureSchema. org, plan_type and creation_date copy body fields for ListRoots.
+*/
+var sqlColumns = []struct {
+	name       string
+	definition string
+}{
+	{"revision", "INTEGER NOT NULL DEFAULT 0"},
+	{"org", "TEXT NOT NULL DEFAULT ''"},
+	{"plan_type", "TEXT NOT NULL DEFAULT ''"},
+	{"creation_date", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// sqlIndexes serve ListRoots, created once the columns exist
+var sqlIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS plan_nodes_field_name_id ON plan_nodes (field_name, id)`,
+	`CREATE INDEX IF NOT EXISTS plan_nodes_field_name_creation_date ON plan_nodes (field_name, creation_date, id)`,
+}
+
+// sqlFilterColumns are the columns ListRoots filters the root fields on
+var sqlFilterColumns = map[string]string{
+	"_org":     "org",
+	"planType": "plan_type",
+}
+
+/*
+SQLStore keeps the nodes in a SQLite or PostgreSQL database: one plan_nodes row per node with
+its fields as a JSON body, and the edges between nodes in plan_node_refs. A plan is expanded
+by collecting its subgraph with a recursive CTE over the edges. Plan versions are kept in plan_versions.
+*/
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{
+		db: db,
+	}
+}
+
+func (s *SQLStore) EnsureSchema(ctx context.Context) error {
+	for _, statement := range sqlSchema {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			logger.Logger.Error("SQLStore.EnsureSchema failed", zap.Error(err))
+			return fmt.Errorf("failed to create node tables: %v", err)
+		}
+	}
+	if err := s.ensureColumns(ctx); err != nil {
+		return err
+	}
+	for _, statement := range sqlIndexes {
+		if _, err := s.db.ExecContext(ctx, statement); err != nil {
+			logger.Logger.Error("SQLStore.EnsureSchema failed", zap.Error(err))
+			return fmt.Errorf("failed to create node indexes: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+ensureColumns adds the sqlColumns missing from a plan_nodes table created by an older version,
+then fills the listing columns from the bodies of the stored nodes and rewrites the bodies with
+their CreationDateField.
+*/
+func (s *SQLStore) ensureColumns(ctx context.Context) error {
+	added := false
+	for _, column := range sqlColumns {
+		if _, err := s.db.ExecContext(ctx, `SELECT `+column.name+` FROM plan_nodes LIMIT 0`); err == nil {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, `ALTER TABLE plan_nodes ADD COLUMN `+column.name+` `+column.definition); err != nil {
+			logger.Logger.Error("SQLStore.ensureColumns failed", zap.String("column", column.name), zap.Error(err))
+			return fmt.Errorf("failed to add column %s to plan_nodes: %v", column.name, err)
+		}
+		added = true
+	}
+	if !added {
+		return nil
+	}
+
+	return s.WithTransaction(ctx, func(ctx context.Context) error {
+		nodes, err := s.loadNodes(ctx, `SELECT id, body, revision FROM plan_nodes`)
+		if err != nil {
+			return err
+		}
+		exec := database.SQLExecutorFrom(ctx, s.db)
+		for id, node := range nodes {
+			// the body gains the sortable creation date along with the columns
+			body, err := json.Marshal(storage.NodeFields(node))
+			if err != nil {
+				return fmt.Errorf("failed to encode node %s: %v", id, err)
+			}
+			org, planType, creationDate := listColumns(node)
+			if _, err := exec.ExecContext(ctx,
+				`UPDATE plan_nodes SET body = $1, org = $2, plan_type = $3, creation_date = $4 WHERE id = $5`,
+				string(body), org, planType, creationDate, id,
+			); err != nil {
+				return fmt.Errorf("failed to backfill the listing columns of node %s: %v", id, err)
+			}
+		}
+		return nil
+	})
+}
+
+/*
+listColumns returns the values of the org, plan_type and creation_date columns of a node.
+*/
+func listColumns(node map[string]interface{}) (string, string, string) {
+	org, _ := node["_org"].(string)
+	planType, _ := node["planType"].(string)
+	return org, planType, storage.SortableDate(node["creationDate"])
+}
+
+func (s *SQLStore) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return database.WithSQLTransaction(ctx, s.db, fn)
+}
+
+func (s *SQLStore) Exists(ctx context.Context, id string) (bool, error) {
+	var one int
+	err := database.SQLExecutorFrom(ctx, s.db).QueryRowContext(ctx, `SELECT 1 FROM plan_nodes WHERE id = $1`, id).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *SQLStore) GetRaw(ctx context.Context, id string) (map[string]interface{}, error) {
+	nodes, err := s.loadNodes(ctx, `SELECT id, body, revision FROM plan_nodes WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := nodes[id]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return nodes[id], nil
+}
+
+func (s *SQLStore) GetExpanded(ctx context.Context, id string) (map[string]interface{}, error) {
+	subgraph, err := s.loadNodes(ctx, `
+		WITH RECURSIVE subgraph(id) AS (
+			SELECT CAST($1 AS TEXT)
+			UNION
+			SELECT r.child_id FROM plan_node_refs r JOIN subgraph g ON r.parent_id = g.id
+		)
+		SELECT n.id, n.body, n.revision FROM plan_nodes n JOIN subgraph g ON n.id = g.id`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// like the Mongo store, a $ref pointing nowhere fails the expansion
+	if _, ok := subgraph[id]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	for _, node := range subgraph {
+		for _, ref := range storage.NodeRefs(node) {
+			if _, ok := subgraph[ref]; !ok {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, ref)
+			}
+		}
+	}
+
+	return storage.ExpandNode(subgraph, id)
+}
+
+/*
+ListRoots selects the page in SQL on the listing columns kept next to the body: the filters,
+the keyset condition on (sort column, id) and the limit.
+*/
+func (s *SQLStore) ListRoots(ctx context.Context, query ListQuery) ([]map[string]interface{}, error) {
+	args := []interface{}{query.Root}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions := []string{"field_name = $1"}
+	for field, value := range query.Filter {
+		column, ok := sqlFilterColumns[field]
+		if !ok {
+			return nil, fmt.Errorf("cannot filter plans on %s", field)
+		}
+		conditions = append(conditions, column+" = "+arg(value))
+	}
+
+	// keyset pagination on (sort column, id), the id being the objectId
+	column, order, next := "", "ASC", ">"
+	switch query.Sort {
+	case SortObjectID:
+	case SortCreationDate:
+		column = "creation_date"
+	default:
+		return nil, fmt.Errorf("cannot sort plans on %s", query.Sort)
+	}
+	if query.Descending {
+		order, next = "DESC", "<"
+	}
+	if query.After != nil {
+		if column == "" {
+			conditions = append(conditions, "id "+next+" "+arg(query.After.ObjectID))
+		} else {
+			sortValue, objectId := arg(query.After.SortValue), arg(query.After.ObjectID)
+			conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s %s))",
+				column, next, sortValue, column, sortValue, next, objectId))
+		}
+	}
+
+	orderBy := "id " + order
+	if column != "" {
+		orderBy = column + " " + order + ", " + orderBy
+	}
+	statement := `SELECT id, body, revision FROM plan_nodes WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY ` + orderBy
+	if query.Limit > 0 {
+		statement += ` LIMIT ` + arg(query.Limit)
+	}
+
+	nodes, err := s.loadNodes(ctx, statement, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// loadNodes keys the rows by id, the order is restored in memory
+	roots := make([]map[string]interface{}, 0, len(nodes))
+	for _, node := range nodes {
+		roots = append(roots, node)
+	}
+	sortRoots(roots, query)
+	return roots, nil
+}
+
+func (s *SQLStore) UpsertNodes(ctx context.Context, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	var removed map[string]map[string]interface{}
+	err := s.WithTransaction(ctx, func(ctx context.Context) error {
+		exec := database.SQLExecutorFrom(ctx, s.db)
+		edges := storage.GraphEdges(nodes)
+
+		ids := make([]interface{}, 0, len(nodes))
+		for id := range nodes {
+			ids = append(ids, id)
+		}
+		previous, err := s.edgesFrom(ctx, ids)
+		if err != nil {
+			return err
+		}
+
+		for id, node := range nodes {
+			body, err := json.Marshal(storage.NodeFields(node))
+			if err != nil {
+				return fmt.Errorf("failed to encode node %s: %v", id, err)
+			}
+			objectType, _ := node["objectType"].(string)
+			parentId, _ := node["parentId"].(string)
+			fieldName, _ := node["fieldName"].(string)
+			org, planType, creationDate := listColumns(node)
+
+			if _, err := exec.ExecContext(ctx, `
+				INSERT INTO plan_nodes (id, object_type, parent_id, field_name, body, org, plan_type, creation_date)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+				ON CONFLICT (id) DO UPDATE SET
+					object_type = excluded.object_type,
+					parent_id = excluded.parent_id,
+					field_name = excluded.field_name,
+					body = excluded.body,
+					org = excluded.org,
+					plan_type = excluded.plan_type,
+					creation_date = excluded.creation_date`,
+				id, objectType, parentId, fieldName, string(body), org, planType, creationDate,
+			); err != nil {
+				logger.Logger.Error("SQLStore.UpsertNodes failed", zap.String("id", id), zap.Error(err))
+				return fmt.Errorf("failed to store node %s: %v", id, err)
+			}
+
+			for _, parent := range edges[id] {
+				if err := s.addEdge(ctx, parent, id); err != nil {
+					return err
+				}
+			}
+		}
+
+		released := []string{}
+		for _, edge := range previous {
+			if contains(edges[edge.child], edge.parent) {
+				continue
+			}
+			if err := s.removeEdge(ctx, edge.parent, edge.child); err != nil {
+				return err
+			}
+			released = append(released, edge.child)
+		}
+
+		removed, err = s.collectUnreferenced(ctx, released)
+		return err
+	})
+	return removed, err
+}
+
+func (s *SQLStore) DeleteNodes(ctx context.Context, id string) (map[string]map[string]interface{}, error) {
+	var removed map[string]map[string]interface{}
+	err := s.WithTransaction(ctx, func(ctx context.Context) error {
+		exists, err := s.Exists(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+
+		if err := s.removeEdge(ctx, storage.RootEdge, id); err != nil {
+			return err
+		}
+		removed, err = s.collectUnreferenced(ctx, []string{id})
+		return err
+	})
+	return removed, err
+}
+
+func (s *SQLStore) InsertRoot(ctx context.Context, id string) error {
+	result, err := database.SQLExecutorFrom(ctx, s.db).ExecContext(ctx, `
+		INSERT INTO plan_nodes (id, object_type, parent_id, field_name, body)
+		VALUES ($1, '', '', '', '{}')
+		ON CONFLICT (id) DO NOTHING`, id,
+	)
+	if err != nil {
+		logger.Logger.Error("SQLStore.InsertRoot failed", zap.String("id", id), zap.Error(err))
+		return fmt.Errorf("failed to insert plan %s: %v", id, err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to insert plan %s: %v", id, err)
+	}
+	if inserted == 0 {
+		return fmt.Errorf("%w: %s", ErrExists, id)
+	}
+	return nil
+}
+
+func (s *SQLStore) SwapRevision(ctx context.Context, id string, expected int64) error {
+	result, err := database.SQLExecutorFrom(ctx, s.db).ExecContext(ctx,
+		`UPDATE plan_nodes SET revision = revision + 1 WHERE id = $1 AND revision = $2`, id, expected,
+	)
+	if err != nil {
+		logger.Logger.Error("SQLStore.SwapRevision failed", zap.String("id", id), zap.Error(err))
+		return fmt.Errorf("failed to swap revision of plan %s: %v", id, err)
+	}
+	swapped, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to swap revision of plan %s: %v", id, err)
+	}
+	if swapped == 0 {
+		return fmt.Errorf("%w: plan %s is no longer at revision %d", ErrRevisionConflict, id, expected)
+	}
+	return nil
+}
+
+func (s *SQLStore) AddVersion(ctx context.Context, version *Version) error {
+	exec := database.SQLExecutorFrom(ctx, s.db)
+
+	var latest int
+	if err := exec.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM plan_versions WHERE plan_id = $1`, version.PlanID,
+	).Scan(&latest); err != nil {
+		return fmt.Errorf("failed to get the latest version of plan %s: %v", version.PlanID, err)
+	}
+
+	var plan sql.NullString
+	if version.Plan != nil {
+		body, err := json.Marshal(version.Plan)
+		if err != nil {
+			return fmt.Errorf("failed to encode plan %s: %v", version.PlanID, err)
+		}
+		plan = sql.NullString{String: string(body), Valid: true}
+	}
+
+	version.Number = latest + 1
+	version.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	if _, err := exec.ExecContext(ctx,
+		`INSERT INTO plan_versions (plan_id, version, action, author, created_at, plan) VALUES ($1, $2, $3, $4, $5, $6)`,
+		version.PlanID, version.Number, version.Action, version.Author, version.CreatedAt, plan,
+	); err != nil {
+		logger.Logger.Error("SQLStore.AddVersion failed", zap.String("planId", version.PlanID), zap.Error(err))
+		return fmt.Errorf("failed to add version %d of plan %s: %v", version.Number, version.PlanID, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) ListVersions(ctx context.Context, planId string) ([]Version, error) {
+	rows, err := database.SQLExecutorFrom(ctx, s.db).QueryContext(ctx,
+		`SELECT plan_id, version, action, author, created_at FROM plan_versions WHERE plan_id = $1 ORDER BY version`, planId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions of plan %s: %v", planId, err)
+	}
+	defer rows.Close()
+
+	versions := []Version{}
+	for rows.Next() {
+		var version Version
+		if err := rows.Scan(&version.PlanID, &version.Number, &version.Action, &version.Author, &version.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to decode versions of plan %s: %v", planId, err)
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+func (s *SQLStore) GetVersion(ctx context.Context, planId string, number int) (*Version, error) {
+	return s.findVersion(ctx, `WHERE plan_id = $1 AND version = $2`, planId, number)
+}
+
+func (s *SQLStore) GetVersionAsOf(ctx context.Context, planId string, asOf time.Time) (*Version, error) {
+	return s.findVersion(ctx, `WHERE plan_id = $1 AND created_at <= $2`, planId, asOf.UTC())
+}
+
+func (s *SQLStore) findVersion(ctx context.Context, where string, args ...interface{}) (*Version, error) {
+	var version Version
+	var plan sql.NullString
+	err := database.SQLExecutorFrom(ctx, s.db).QueryRowContext(ctx,
+		`SELECT plan_id, version, action, author, created_at, plan FROM plan_versions `+where+` ORDER BY version DESC LIMIT 1`, args...,
+	).Scan(&version.PlanID, &version.Number, &version.Action, &version.Author, &version.CreatedAt, &plan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: no version of plan %v", ErrNotFound, args[0])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version of plan %v: %v", args[0], err)
+	}
+
+	if plan.Valid {
+		if err := json.Unmarshal([]byte(plan.String), &version.Plan); err != nil {
+			return nil, fmt.Errorf("failed to decode version %d of plan %s: %v", version.Number, version.PlanID, err)
+		}
+	}
+	return &version, nil
+}
+
+type sqlEdge struct {
+	parent string
+	child  string
+}
+
+func (s *SQLStore) edgesFrom(ctx context.Context, parentIds []interface{}) ([]sqlEdge, error) {
+	if len(parentIds) == 0 {
+		return nil, nil
+	}
+
+	placeholders := make([]string, len(parentIds))
+	for i := range parentIds {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	rows, err := database.SQLExecutorFrom(ctx, s.db).QueryContext(ctx,
+		`SELECT parent_id, child_id FROM plan_node_refs WHERE parent_id IN (`+strings.Join(placeholders, ", ")+`)`,
+		parentIds...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load edges: %v", err)
+	}
+	defer rows.Close()
+
+	edges := []sqlEdge{}
+	for rows.Next() {
+		var edge sqlEdge
+		if err := rows.Scan(&edge.parent, &edge.child); err != nil {
+			return nil, err
+		}
+		edges = append(edges, edge)
+	}
+	return edges, rows.Err()
+}
+
+func (s *SQLStore) addEdge(ctx context.Context, parent, child string) error {
+	if _, err := database.SQLExecutorFrom(ctx, s.db).ExecContext(ctx,
+		`INSERT INTO plan_node_refs (parent_id, child_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, parent, child,
+	); err != nil {
+		return fmt.Errorf("failed to add edge %s -> %s: %v", parent, child, err)
+	}
+	return nil
+}
+
+func (s *SQLStore) removeEdge(ctx context.Context, parent, child string) error {
+	if _, err := database.SQLExecutorFrom(ctx, s.db).ExecContext(ctx,
+		`DELETE FROM plan_node_refs WHERE parent_id = $1 AND child_id = $2`, parent, child,
+	); err != nil {
+		return fmt.Errorf("failed to remove edge %s -> %s: %v", parent, child, err)
+	}
+	return nil
+}
+
+/*
+collectUnreferenced removes the candidates left without any edge together with their edges,
+then collects the nodes they referenced in turn. It returns the removed nodes.
+*/
+func (s *SQLStore) collectUnreferenced(ctx context.Context, candidates []string) (map[string]map[string]interface{}, error) {
+	exec := database.SQLExecutorFrom(ctx, s.db)
+	removed := map[string]map[string]interface{}{}
+	for len(candidates) > 0 {
+		id := candidates[0]
+		candidates = candidates[1:]
+
+		var referenced int
+		if err := exec.QueryRowContext(ctx, `SELECT COUNT(*) FROM plan_node_refs WHERE child_id = $1`, id).Scan(&referenced); err != nil {
+			return nil, fmt.Errorf("failed to count edges of node %s: %v", id, err)
+		}
+		if referenced > 0 {
+			continue
+		}
+
+		node, err := s.GetRaw(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := exec.ExecContext(ctx, `DELETE FROM plan_nodes WHERE id = $1`, id); err != nil {
+			logger.Logger.Error("SQLStore.collectUnreferenced: failed to delete node", zap.String("id", id), zap.Error(err))
+			return nil, fmt.Errorf("failed to delete node %s: %v", id, err)
+		}
+		if _, err := exec.ExecContext(ctx, `DELETE FROM plan_node_refs WHERE parent_id = $1`, id); err != nil {
+			return nil, fmt.Errorf("failed to remove edges of node %s: %v", id, err)
+		}
+		removed[id] = node
+		candidates = append(candidates, storage.NodeRefs(node)...)
+	}
+
+	return removed, nil
+}
+
+/*
+loadNodes runs a query selecting (id, body, revision) rows and decodes them into raw nodes,
+shaped like the Mongo ones (with _id, the referencedBy edge set and the revision once set).
+*/
+func (s *SQLStore) loadNodes(ctx context.Context, query string, args ...interface{}) (map[string]map[string]interface{}, error) {
+	exec := database.SQLExecutorFrom(ctx, s.db)
+	rows, err := exec.QueryContext(ctx, query, args...)
+	if err != nil {
+		logger.Logger.Error("SQLStore.loadNodes failed", zap.Error(err))
+		return nil, fmt.Errorf("failed to load nodes: %v", err)
+	}
+	defer rows.Close()
+
+	nodes := map[string]map[string]interface{}{}
+	for rows.Next() {
+		var id, body string
+		var revision int64
+		if err := rows.Scan(&id, &body, &revision); err != nil {
+			return nil, err
+		}
+		var node map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &node); err != nil {
+			return nil, fmt.Errorf("failed to decode node %s: %v", id, err)
+		}
+		node["_id"] = id
+		if revision > 0 {
+			node[storage.RevisionField] = revision
+		}
+		nodes[id] = node
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for id, node := range nodes {
+		parents, err := s.referencedBy(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		node[storage.ReferencedByField] = parents
+	}
+	return nodes, nil
+}
+
+func (s *SQLStore) referencedBy(ctx context.Context, id string) ([]interface{}, error) {
+	rows, err := database.SQLExecutorFrom(ctx, s.db).QueryContext(ctx, `SELECT parent_id FROM plan_node_refs WHERE child_id = $1 ORDER BY parent_id`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load edges of node %s: %v", id, err)
+	}
+	defer rows.Close()
+
+	parents := []interface{}{}
+	for rows.Next() {
+		var parent string
+		if err := rows.Scan(&parent); err != nil {
+			return nil, err
+		}
+		parents = append(parents, parent)
+	}
+	return parents, rows.Err()
+}
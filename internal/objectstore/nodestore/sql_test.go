@@ -0,0 +1,61 @@
+package nodestore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.uber.org/zap"
+)
+
+func TestSQLStoreMigratesListingColumns(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	ctx := context.Background()
+
+	service, err := database.NewSQLService(database.DriverSQLite, filepath.Join(t.TempDir(), "nodes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	db := service.GetDB()
+
+	// plan_nodes as first created, without the revision and listing columns
+	for _, statement := range []string{
+		`CREATE TABLE plan_nodes (
+			id          TEXT PRIMARY KEY,
+			object_type TEXT NOT NULL,
+			parent_id   TEXT NOT NULL,
+			field_name  TEXT NOT NULL,
+			body        TEXT NOT NULL
+		)`,
+		`INSERT INTO plan_nodes VALUES ('plan-a', 'plan', '', 'plan', '{"objectId":"plan-a","objectType":"plan","planType":"inNetwork","creationDate":"01-02-2021"}')`,
+		`INSERT INTO plan_nodes VALUES ('plan-b', 'plan', '', 'plan', '{"objectId":"plan-b","objectType":"plan","planType":"inNetwork","creationDate":"20-12-2019"}')`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := NewSQLStore(db)
+	if err := store.EnsureSchema(ctx); err != nil {
+		t.Fatalf("EnsureSchema: %v", err)
+	}
+
+	roots, err := store.ListRoots(ctx, ListQuery{
+		Root:   "plan",
+		Sort:   SortCreationDate,
+		Filter: map[string]string{"planType": "inNetwork"},
+	})
+	if err != nil {
+		t.Fatalf("ListRoots: %v", err)
+	}
+	if len(roots) != 2 || roots[0]["objectId"] != "plan-b" || roots[1]["objectId"] != "plan-a" {
+		t.Errorf("roots = %v, want plan-b then plan-a", roots)
+	}
+
+	if err := store.SwapRevision(ctx, "plan-a", 0); err != nil {
+		t.Errorf("SwapRevision on the migrated table: %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+package nodestore
+
+import "time"
+
+const (
+	VersionCreate  = "create"
+	VersionUpdate  = "update"
+	VersionReplace = "replace"
+	VersionDelete  = "delete"
+)
+
+/*
+Version is an immutable record of a committed plan write. Plan holds the expanded plan as it was
+after the write, a delete version has none. Numbers start at 1 and increase with each write.
+*/
+type Version struct {
+	PlanID    string                 `bson:"planId" json:"planId"`
+	Number    int                    `bson:"version" json:"version"`
+	Action    string                 `bson:"action" json:"action"`
+	Author    string                 `bson:"author" json:"author"`
+	CreatedAt time.Time              `bson:"createdAt" json:"createdAt"`
+	Plan      map[string]interface{} `bson:"plan,omitempty" json:"-"`
+}
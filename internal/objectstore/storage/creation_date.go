@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+/*
+CreationDateField holds the creationDate of a node in the sortable form of SortableDate, so plans
+can be listed in chronological order. NodeFields derives it on every write.
+*/
+const CreationDateField = "_creationDate"
+
+// creationDateLayouts are the accepted creationDate formats, the plan data uses dd-mm-yyyy
+var creationDateLayouts = []string{"02-01-2006", "2006-01-02", time.RFC3339Nano}
+
+/*
+SortableDate converts a creationDate to a string that sorts chronologically: yyyy-mm-dd for a date,
+the RFC 3339 UTC time for a timestamp. A value in another format converts to "", listed first.
+*/
+func SortableDate(value interface{}) string {
+	date, ok := value.(string)
+	if !ok {
+		return ""
+	}
+
+	for _, layout := range creationDateLayouts {
+		parsed, err := time.Parse(layout, date)
+		if err != nil {
+			continue
+		}
+		if layout == time.RFC3339Nano {
+			return parsed.UTC().Format(time.RFC3339Nano)
+		}
+		return parsed.Format("2006-01-02")
+	}
+	return ""
+}
+
+/*
+BackfillCreationDates derives CreationDateField on the nodes stored before it was kept,
+and returns how many were updated.
+*/
+func BackfillCreationDates(ctx context.Context, collection *mongo.Collection) (int, error) {
+	cursor, err := collection.Find(ctx, bson.M{
+		"creationDate":    bson.M{"$exists": true},
+		CreationDateField: bson.M{"$exists": false},
+	})
+	if err != nil {
+		logger.Logger.Error("storage.BackfillCreationDates failed", zap.Error(err))
+		return 0, fmt.Errorf("failed to find nodes without sortable creation date: %v", err)
+	}
+	defer cursor.Close(ctx)
+
+	updated := 0
+	for cursor.Next(ctx) {
+		var node map[string]interface{}
+		if err := cursor.Decode(&node); err != nil {
+			return updated, err
+		}
+		date := SortableDate(node["creationDate"])
+		if date == "" {
+			continue
+		}
+
+		if _, err := collection.UpdateByID(ctx, node["_id"], bson.M{"$set": bson.M{CreationDateField: date}}); err != nil {
+			logger.Logger.Error("storage.BackfillCreationDates: failed to update node", zap.Any("id", node["_id"]), zap.Error(err))
+			return updated, fmt.Errorf("failed to backfill creation date of node %v: %v", node["_id"], err)
+		}
+		updated++
+	}
+	return updated, cursor.Err()
+}
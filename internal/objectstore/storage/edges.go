@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	/*
+		ReferencedByField holds the edge set of a node: the ids of the nodes whose fields $ref it.
+		The root node of a plan also holds RootEdge, which its plan keeps until the plan is deleted.
+	*/
+	ReferencedByField = "referencedBy"
+	RootEdge          = ""
+)
+
+/*
+EnsureIndexes creates the index used to find the nodes referenced by a set of parents.
+*/
+func EnsureIndexes(ctx context.Context, collection *mongo.Collection) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: ReferencedByField, Value: 1}}}); err != nil {
+		logger.Logger.Error("storage.EnsureIndexes failed", zap.Error(err))
+		return fmt.Errorf("failed to create node indexes: %v", err)
+	}
+	return nil
+}
+
+/*
+GraphEdges returns, for every node referenced in the graph, the ids of the graph nodes referencing it.
+The root of the graph (the node without parent) gets the root edge.
+*/
+func GraphEdges(nodes map[string]map[string]interface{}) map[string][]string {
+	edges := map[string][]string{}
+	for id, node := range nodes {
+		if parentId, _ := node["parentId"].(string); parentId == "" {
+			edges[id] = appendUnique(edges[id], RootEdge)
+		}
+		for _, ref := range NodeRefs(node) {
+			edges[ref] = appendUnique(edges[ref], id)
+		}
+	}
+	return edges
+}
+
+/*
+findReferencedBy returns the stored nodes referenced by any of the parents.
+*/
+func findReferencedBy(ctx context.Context, collection *mongo.Collection, parentIds []string) ([]map[string]interface{}, error) {
+	cursor, err := collection.Find(ctx, bson.M{ReferencedByField: bson.M{"$in": parentIds}})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []map[string]interface{}{}
+	if err := cursor.All(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+/*
+collectUnreferenced removes the candidates left without any edge, then releases their edges on
+the nodes they referenced and collects those in turn. Candidates still referenced are kept.
+It returns the removed nodes.
+*/
+func collectUnreferenced(ctx context.Context, collection *mongo.Collection, candidates []string) (map[string]map[string]interface{}, error) {
+	removed := map[string]map[string]interface{}{}
+	for len(candidates) > 0 {
+		id := candidates[0]
+		candidates = candidates[1:]
+
+		var node map[string]interface{}
+		err := collection.FindOneAndDelete(ctx, bson.M{"_id": id, ReferencedByField: bson.M{"$size": 0}}).Decode(&node)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			logger.Logger.Error("storage.collectUnreferenced: failed to delete node", zap.String("id", id), zap.Error(err))
+			return nil, fmt.Errorf("failed to delete node %s: %v", id, err)
+		}
+		removed[id] = node
+
+		for _, child := range NodeRefs(node) {
+			if _, err := collection.UpdateByID(ctx, child, bson.M{"$pull": bson.M{ReferencedByField: id}}); err != nil {
+				logger.Logger.Error("storage.collectUnreferenced: failed to release edge", zap.String("id", child), zap.Error(err))
+				return nil, fmt.Errorf("failed to release edge of node %s: %v", child, err)
+			}
+			candidates = append(candidates, child)
+		}
+	}
+
+	return removed, nil
+}
+
+/*
+BackfillEdges derives the edge sets of all nodes from their $refs when some node was stored
+before edge sets existed (with a refCount instead), and returns the number of updated nodes.
+*/
+func BackfillEdges(ctx context.Context, collection *mongo.Collection) (int, error) {
+	legacy := collection.FindOne(ctx, bson.M{ReferencedByField: bson.M{"$exists": false}})
+	if errors.Is(legacy.Err(), mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if legacy.Err() != nil {
+		return 0, legacy.Err()
+	}
+
+	edges := map[string][]string{}
+	ids := []string{}
+	for afterId := ""; ; {
+		nodes, err := ScanNodes(ctx, collection, afterId, 500)
+		if err != nil {
+			return 0, err
+		}
+		if len(nodes) == 0 {
+			break
+		}
+		page := make(map[string]map[string]interface{}, len(nodes))
+		for _, node := range nodes {
+			id, _ := node["_id"].(string)
+			page[id] = node
+			ids = append(ids, id)
+		}
+		for child, parents := range GraphEdges(page) {
+			for _, parent := range parents {
+				edges[child] = appendUnique(edges[child], parent)
+			}
+		}
+		afterId = ids[len(ids)-1]
+	}
+
+	unreferenced := 0
+	for _, id := range ids {
+		parents := edges[id]
+		if parents == nil {
+			parents = []string{}
+			unreferenced++
+		}
+		if _, err := collection.UpdateByID(ctx, id, edgesUpdate(parents)); err != nil {
+			logger.Logger.Error("storage.BackfillEdges: failed to update node", zap.String("id", id), zap.Error(err))
+			return 0, fmt.Errorf("failed to backfill edges of node %s: %v", id, err)
+		}
+	}
+
+	if unreferenced > 0 {
+		logger.Logger.Warn("storage.BackfillEdges: nodes without any parent", zap.Int("count", unreferenced))
+	}
+	return len(ids), nil
+}
+
+/*
+edgesUpdate sets the edge set of a node and drops the refCount it replaces.
+*/
+func edgesUpdate(parents []string) bson.M {
+	return bson.M{
+		"$set":   bson.M{ReferencedByField: parents},
+		"$unset": bson.M{"refCount": ""},
+	}
+}
+
+/*
+ReplaceNodeEdges sets the edge set of the node to parents, provided it still is expected
+(nil expects a node without edge set). It reports whether the node was updated, so a node
+changed by a concurrent write is left alone.
+*/
+func ReplaceNodeEdges(ctx context.Context, collection *mongo.Collection, id string, expected, parents []string) (bool, error) {
+	filter := bson.M{"_id": id, ReferencedByField: expected}
+	if expected == nil {
+		filter[ReferencedByField] = bson.M{"$exists": false}
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, edgesUpdate(parents))
+	if err != nil {
+		logger.Logger.Error("storage.ReplaceNodeEdges failed", zap.String("id", id), zap.Error(err))
+		return false, fmt.Errorf("failed to replace edges of node %s: %v", id, err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+/*
+IsReachable walks the edge sets up from the node and reports whether it reaches the root of a plan.
+A node without edge set cannot be judged and counts as reachable.
+*/
+func IsReachable(ctx context.Context, collection *mongo.Collection, id string) (bool, error) {
+	visited := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		nodes, err := FindNodes(ctx, collection, queue)
+		if err != nil {
+			return false, err
+		}
+
+		queue = nil
+		for _, node := range nodes {
+			parents := ReferencedBy(node)
+			if parents == nil || contains(parents, RootEdge) {
+				return true, nil
+			}
+			for _, parent := range parents {
+				if !visited[parent] {
+					visited[parent] = true
+					queue = append(queue, parent)
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+/*
+DeleteNode removes the node and releases its edges on the nodes it references,
+it returns the removed node or nil when it was already gone.
+*/
+func DeleteNode(ctx context.Context, collection *mongo.Collection, id string) (map[string]interface{}, error) {
+	var node map[string]interface{}
+	err := collection.FindOneAndDelete(ctx, bson.M{"_id": id}).Decode(&node)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		logger.Logger.Error("storage.DeleteNode failed", zap.String("id", id), zap.Error(err))
+		return nil, fmt.Errorf("failed to delete node %s: %v", id, err)
+	}
+
+	for _, child := range NodeRefs(node) {
+		if _, err := collection.UpdateByID(ctx, child, bson.M{"$pull": bson.M{ReferencedByField: id}}); err != nil {
+			logger.Logger.Error("storage.DeleteNode: failed to release edge", zap.String("id", child), zap.Error(err))
+			return nil, fmt.Errorf("failed to release edge of node %s: %v", child, err)
+		}
+	}
+	return node, nil
+}
+
+/*
+ReferencedBy returns the edge set of a stored node, nil when the node has none.
+*/
+func ReferencedBy(node map[string]interface{}) []string {
+	if _, ok := node[ReferencedByField]; !ok {
+		return nil
+	}
+
+	var items []interface{}
+	switch v := node[ReferencedByField].(type) {
+	case primitive.A:
+		items = v
+	case []interface{}:
+		items = v
+	}
+
+	parents := make([]string, 0, len(items))
+	for _, item := range items {
+		if parent, ok := item.(string); ok {
+			parents = append(parents, parent)
+		}
+	}
+	return parents
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(values []string, value string) []string {
+	if contains(values, value) {
+		return values
+	}
+	return append(values, value)
+}
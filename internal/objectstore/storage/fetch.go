@@ -2,17 +2,20 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"eric-cw-hsu.github.io/internal/shared/logger"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
 )
 
-func GetNodeRaw(collection *mongo.Collection, id string) (map[string]interface{}, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func GetNodeRaw(ctx context.Context, collection *mongo.Collection, id string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	var result map[string]interface{}
@@ -23,61 +26,275 @@ func GetNodeRaw(collection *mongo.Collection, id string) (map[string]interface{}
 	return result, nil
 }
 
-func GetExpandedNode(collection *mongo.Collection, id string) (map[string]interface{}, error) {
-	rawNode, err := GetNodeRaw(collection, id)
+/*
+GetExpandedNode returns the node with every $ref replaced by the referenced node, recursively.
+The subgraph is loaded breadth-first, one $in query per depth level, and assembled in memory.
+*/
+func GetExpandedNode(ctx context.Context, collection *mongo.Collection, id string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	loaded, err := loadSubgraph(ctx, collection, id)
 	if err != nil {
 		logger.Logger.Error("storage.GetExpandedNode failed", zap.String("id", id), zap.Error(err))
 		return nil, err
 	}
-	return expandRefs(collection, rawNode)
+	return ExpandNode(loaded, id)
+}
+
+/*
+ExpandNode assembles the expanded node from loaded, which must hold every node of its subgraph:
+a node missing from loaded fails with mongo.ErrNoDocuments, like loadSubgraph, and a reference
+cycle fails as well.
+*/
+func ExpandNode(loaded map[string]map[string]interface{}, id string) (map[string]interface{}, error) {
+	return assembleNode(loaded, id, map[string]bool{})
+}
+
+/*
+loadSubgraph loads the node and all the nodes it references, keyed by id.
+A missing node fails with mongo.ErrNoDocuments, like a FindOne would.
+*/
+func loadSubgraph(ctx context.Context, collection *mongo.Collection, id string) (map[string]map[string]interface{}, error) {
+	loaded := map[string]map[string]interface{}{}
+	frontier := []string{id}
+
+	for len(frontier) > 0 {
+		cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": frontier}})
+		if err != nil {
+			return nil, err
+		}
+		nodes := []map[string]interface{}{}
+		if err := cursor.All(ctx, &nodes); err != nil {
+			return nil, err
+		}
+
+		for _, node := range nodes {
+			nodeId, _ := node["_id"].(string)
+			loaded[nodeId] = node
+		}
+
+		next := []string{}
+		queued := map[string]bool{}
+		for _, requested := range frontier {
+			node, ok := loaded[requested]
+			if !ok {
+				return nil, fmt.Errorf("node %s: %w", requested, mongo.ErrNoDocuments)
+			}
+			for _, ref := range NodeRefs(node) {
+				if _, ok := loaded[ref]; !ok && !queued[ref] {
+					queued[ref] = true
+					next = append(next, ref)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	return loaded, nil
 }
 
-func expandRefs(collection *mongo.Collection, node map[string]interface{}) (map[string]interface{}, error) {
-	for k, v := range node {
+/*
+NodeRefs returns the ids referenced by the fields of the node, directly or as array items.
+*/
+func NodeRefs(node map[string]interface{}) []string {
+	refs := []string{}
+	for _, v := range node {
 		switch vv := v.(type) {
 		case map[string]interface{}:
-			if ref, ok := vv["$ref"]; ok {
-				referencedNode, err := GetExpandedNode(collection, ref.(string))
+			if ref, ok := vv["$ref"].(string); ok {
+				refs = append(refs, ref)
+			}
+		case []interface{}:
+			refs = append(refs, arrayRefs(vv)...)
+		case primitive.A:
+			refs = append(refs, arrayRefs(vv)...)
+		}
+	}
+	return refs
+}
+
+func arrayRefs(items []interface{}) []string {
+	refs := []string{}
+	for _, item := range items {
+		refMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if ref, ok := refMap["$ref"].(string); ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+var errReferenceCycle = errors.New("reference cycle")
+
+/*
+assembleNode builds the expanded copy of a loaded node. A node referenced from several places
+is expanded at each of them; visiting guards against reference cycles.
+*/
+func assembleNode(loaded map[string]map[string]interface{}, id string, visiting map[string]bool) (map[string]interface{}, error) {
+	if visiting[id] {
+		return nil, fmt.Errorf("%w through node %s", errReferenceCycle, id)
+	}
+	stored, ok := loaded[id]
+	if !ok {
+		return nil, fmt.Errorf("node %s: %w", id, mongo.ErrNoDocuments)
+	}
+	visiting[id] = true
+	defer delete(visiting, id)
+
+	node := make(map[string]interface{}, len(stored))
+	for k, v := range stored {
+		if k == ReferencedByField {
+			continue
+		}
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := vv["$ref"].(string); ok {
+				expanded, err := assembleNode(loaded, ref, visiting)
 				if err != nil {
 					return nil, err
 				}
-				node[k] = referencedNode
+				node[k] = expanded
+				continue
 			}
 		case []interface{}:
-			expandedArray, err := expandArray(collection, vv)
+			expanded, err := assembleArray(loaded, vv, visiting)
 			if err != nil {
 				return nil, err
 			}
-			node[k] = expandedArray
+			node[k] = expanded
+			continue
 		case primitive.A:
-			expandedArray, err := expandArray(collection, []interface{}(vv))
+			expanded, err := assembleArray(loaded, vv, visiting)
 			if err != nil {
 				return nil, err
 			}
-			node[k] = expandedArray
+			node[k] = expanded
+			continue
 		}
+		node[k] = v
 	}
 
 	return node, nil
 }
 
-func expandArray(collection *mongo.Collection, items []interface{}) ([]interface{}, error) {
-	expended := []interface{}{}
-	for _, item := range items {
-		refMap, ok := item.(map[string]interface{})
-		if !ok {
-			continue
+func assembleArray(loaded map[string]map[string]interface{}, items []interface{}, visiting map[string]bool) ([]interface{}, error) {
+	expanded := []interface{}{}
+	for _, ref := range arrayRefs(items) {
+		referencedNode, err := assembleNode(loaded, ref, visiting)
+		if err != nil {
+			return nil, err
 		}
-		refId, ok := refMap["$ref"].(string)
-		if !ok {
-			continue
+		expanded = append(expanded, referencedNode)
+	}
+
+	return expanded, nil
+}
+
+/*
+ScanNodes returns up to limit raw nodes with an id greater than afterId, in id order.
+Passing the last id of a page as afterId walks the whole collection.
+*/
+func ScanNodes(ctx context.Context, collection *mongo.Collection, afterId string, limit int) ([]map[string]interface{}, error) {
+	return scanNodes(ctx, collection, bson.M{}, afterId, limit)
+}
+
+/*
+ScanRoots returns up to limit roots of the documents of one resource type, the nodes whose
+fieldName is rootField, with an id greater than afterId, in id order.
+*/
+func ScanRoots(ctx context.Context, collection *mongo.Collection, rootField, afterId string, limit int) ([]map[string]interface{}, error) {
+	return scanNodes(ctx, collection, bson.M{"fieldName": rootField}, afterId, limit)
+}
+
+func scanNodes(ctx context.Context, collection *mongo.Collection, filter bson.M, afterId string, limit int) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if afterId != "" {
+		filter["_id"] = bson.M{"$gt": afterId}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		logger.Logger.Error("storage.ScanNodes failed", zap.String("afterId", afterId), zap.Error(err))
+		return nil, err
+	}
+
+	nodes := []map[string]interface{}{}
+	if err := cursor.All(ctx, &nodes); err != nil {
+		logger.Logger.Error("storage.ScanNodes: decode failed", zap.Error(err))
+		return nil, err
+	}
+	return nodes, nil
+}
+
+/*
+FindSubgraphs returns the roots and every node they reference, directly or not, keyed by id.
+Unlike an expansion it skips a $ref without a node, so one broken graph doesn't stop a scan.
+*/
+func FindSubgraphs(ctx context.Context, collection *mongo.Collection, roots []map[string]interface{}) (map[string]map[string]interface{}, error) {
+	loaded := make(map[string]map[string]interface{}, len(roots))
+	frontier := []string{}
+	for _, root := range roots {
+		id, _ := root["_id"].(string)
+		loaded[id] = root
+		frontier = append(frontier, NodeRefs(root)...)
+	}
+
+	for len(frontier) > 0 {
+		requested := []string{}
+		for _, id := range frontier {
+			if _, ok := loaded[id]; !ok {
+				loaded[id] = nil
+				requested = append(requested, id)
+			}
+		}
+		if len(requested) == 0 {
+			break
 		}
-		referencedNode, err := GetExpandedNode(collection, refId)
+
+		nodes, err := FindNodes(ctx, collection, requested)
 		if err != nil {
 			return nil, err
 		}
-		expended = append(expended, referencedNode)
+		frontier = []string{}
+		for _, node := range nodes {
+			id, _ := node["_id"].(string)
+			loaded[id] = node
+			frontier = append(frontier, NodeRefs(node)...)
+		}
 	}
 
-	return expended, nil
+	for id, node := range loaded {
+		if node == nil {
+			delete(loaded, id)
+		}
+	}
+	return loaded, nil
+}
+
+/*
+FindNodes returns the raw nodes with the given ids in a single query, ids without a node are skipped.
+*/
+func FindNodes(ctx context.Context, collection *mongo.Collection, ids []string) ([]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		logger.Logger.Error("storage.FindNodes failed", zap.Int("ids", len(ids)), zap.Error(err))
+		return nil, err
+	}
+
+	nodes := []map[string]interface{}{}
+	if err := cursor.All(ctx, &nodes); err != nil {
+		logger.Logger.Error("storage.FindNodes: decode failed", zap.Error(err))
+		return nil, err
+	}
+	return nodes, nil
 }
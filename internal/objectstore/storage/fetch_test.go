@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+func TestExpandNode(t *testing.T) {
+	ref := func(id string) map[string]interface{} { return map[string]interface{}{"$ref": id} }
+	node := func(id string, fields map[string]interface{}) map[string]interface{} {
+		n := map[string]interface{}{"_id": id, "objectId": id, ReferencedByField: []interface{}{RootEdge}}
+		for k, v := range fields {
+			n[k] = v
+		}
+		return n
+	}
+
+	tests := []struct {
+		name   string
+		loaded map[string]map[string]interface{}
+		want   string
+		err    error
+	}{
+		{
+			name: "refs and arrays of refs",
+			loaded: map[string]map[string]interface{}{
+				"plan":    node("plan", map[string]interface{}{"cost": ref("cost"), "services": []interface{}{ref("service")}, "planType": "inNetwork"}),
+				"cost":    node("cost", map[string]interface{}{"copay": 23}),
+				"service": node("service", map[string]interface{}{"linked": ref("linked")}),
+				"linked":  node("linked", map[string]interface{}{"name": "Yearly physical"}),
+			},
+			want: `{"_id":"plan","cost":{"_id":"cost","copay":23,"objectId":"cost"},"objectId":"plan","planType":"inNetwork",` +
+				`"services":[{"_id":"service","linked":{"_id":"linked","name":"Yearly physical","objectId":"linked"},"objectId":"service"}]}`,
+		},
+		{
+			name: "BSON arrays",
+			loaded: map[string]map[string]interface{}{
+				"plan":    node("plan", map[string]interface{}{"services": primitive.A{ref("service")}}),
+				"service": node("service", nil),
+			},
+			want: `{"_id":"plan","objectId":"plan","services":[{"_id":"service","objectId":"service"}]}`,
+		},
+		{
+			name: "shared node expanded at each reference",
+			loaded: map[string]map[string]interface{}{
+				"plan":   node("plan", map[string]interface{}{"a": ref("a"), "b": ref("b")}),
+				"a":      node("a", map[string]interface{}{"shared": ref("shared")}),
+				"b":      node("b", map[string]interface{}{"shared": ref("shared"), "again": []interface{}{ref("shared")}}),
+				"shared": node("shared", map[string]interface{}{"name": "s"}),
+			},
+			want: `{"_id":"plan","a":{"_id":"a","objectId":"a","shared":{"_id":"shared","name":"s","objectId":"shared"}},` +
+				`"b":{"_id":"b","again":[{"_id":"shared","name":"s","objectId":"shared"}],"objectId":"b","shared":{"_id":"shared","name":"s","objectId":"shared"}},"objectId":"plan"}`,
+		},
+		{
+			name: "cycle",
+			loaded: map[string]map[string]interface{}{
+				"plan": node("plan", map[string]interface{}{"a": ref("a")}),
+				"a":    node("a", map[string]interface{}{"b": []interface{}{ref("b")}}),
+				"b":    node("b", map[string]interface{}{"a": ref("a")}),
+			},
+			err: errReferenceCycle,
+		},
+		{
+			name: "self reference",
+			loaded: map[string]map[string]interface{}{
+				"plan": node("plan", map[string]interface{}{"self": ref("plan")}),
+			},
+			err: errReferenceCycle,
+		},
+		{
+			name: "dangling ref",
+			loaded: map[string]map[string]interface{}{
+				"plan": node("plan", map[string]interface{}{"services": []interface{}{ref("service")}}),
+			},
+			err: mongo.ErrNoDocuments,
+		},
+		{
+			name:   "missing node",
+			loaded: map[string]map[string]interface{}{},
+			err:    mongo.ErrNoDocuments,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expanded, err := ExpandNode(tt.loaded, "plan")
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("ExpandNode = %v, %v, want %v", expanded, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExpandNode: %v", err)
+			}
+			encoded, err := json.Marshal(expanded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(encoded) != tt.want {
+				t.Errorf("ExpandNode =\n%s\nwant\n%s", encoded, tt.want)
+			}
+		})
+	}
+}
+
+/*
+The benchmarks compare the expansion of a plan with n linked services (3n+1 nodes, the shape
+of the plan schema) by the former recursive loader, one FindOne per node, and by GetExpandedNode,
+one $in query per depth level. They need a MongoDB server at MONGO_URI (default
+mongodb://localhost:27017) and are skipped without one:
+
+	go test ./internal/objectstore/storage -run '^$' -bench Expand
+*/
+
+var benchmarkSizes = []int{10, 100, 500}
+
+func BenchmarkExpandRecursive(b *testing.B) {
+	benchmarkExpand(b, func(ctx context.Context, collection *mongo.Collection, id string) (map[string]interface{}, error) {
+		return getExpandedNodeRecursive(ctx, collection, id)
+	})
+}
+
+func BenchmarkExpandBreadthFirst(b *testing.B) {
+	benchmarkExpand(b, GetExpandedNode)
+}
+
+func benchmarkExpand(b *testing.B, expand func(ctx context.Context, collection *mongo.Collection, id string) (map[string]interface{}, error)) {
+	collection := benchmarkCollection(b)
+	ctx := context.Background()
+
+	for _, size := range benchmarkSizes {
+		planId := seedPlan(b, collection, size)
+
+		b.Run(fmt.Sprintf("services=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				plan, err := expand(ctx, collection, planId)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if services, _ := plan["linkedPlanServices"].([]interface{}); len(services) != size {
+					b.Fatalf("expanded %d linked services, want %d", len(services), size)
+				}
+			}
+		})
+	}
+}
+
+/*
+benchmarkCollection returns an empty collection of a throwaway database, dropped after the benchmark.
+*/
+func benchmarkCollection(b *testing.B) *mongo.Collection {
+	logger.Logger = zap.NewNop()
+
+	uri := os.Getenv("MONGO_URI")
+	if uri == "" {
+		uri = "mongodb://localhost:27017"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetServerSelectionTimeout(2*time.Second))
+	if err != nil {
+		b.Skipf("MongoDB unavailable: %v", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(context.Background())
+		b.Skipf("MongoDB unavailable: %v", err)
+	}
+
+	database := client.Database(fmt.Sprintf("storage_bench_%d", time.Now().UnixNano()))
+	b.Cleanup(func() {
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return database.Collection("plans")
+}
+
+/*
+seedPlan stores a plan with size linked services, each referencing a linked service and its
+cost shares, and returns its id.
+*/
+func seedPlan(b *testing.B, collection *mongo.Collection, size int) string {
+	planId := fmt.Sprintf("plan-%d", size)
+	nodes := []interface{}{}
+	services := primitive.A{}
+
+	for i := 0; i < size; i++ {
+		serviceId := fmt.Sprintf("%s-service-%d", planId, i)
+		linkedId := serviceId + "-linked"
+		costId := serviceId + "-cost"
+
+		nodes = append(nodes,
+			bson.M{"_id": linkedId, "objectId": linkedId, "objectType": "service", "name": "Yearly physical", ReferencedByField: bson.A{serviceId}},
+			bson.M{"_id": costId, "objectId": costId, "objectType": "membercostshare", "copay": 175, "deductible": 10, ReferencedByField: bson.A{serviceId}},
+			bson.M{
+				"_id":                   serviceId,
+				"objectId":              serviceId,
+				"objectType":            "planservice",
+				"linkedService":         bson.M{"$ref": linkedId},
+				"planserviceCostShares": bson.M{"$ref": costId},
+				ReferencedByField:       bson.A{planId},
+			},
+		)
+		services = append(services, bson.M{"$ref": serviceId})
+	}
+	nodes = append(nodes, bson.M{
+		"_id":                planId,
+		"objectId":           planId,
+		"objectType":         "plan",
+		"planType":           "inNetwork",
+		"linkedPlanServices": services,
+		ReferencedByField:    bson.A{RootEdge},
+	})
+
+	if _, err := collection.InsertMany(context.Background(), nodes); err != nil {
+		b.Fatalf("failed to seed plan: %v", err)
+	}
+	return planId
+}
+
+/*
+getExpandedNodeRecursive is the expansion GetExpandedNode replaced, kept as the baseline:
+every $ref is resolved with its own FindOne, depth-first.
+*/
+func getExpandedNodeRecursive(ctx context.Context, collection *mongo.Collection, id string) (map[string]interface{}, error) {
+	rawNode, err := GetNodeRaw(ctx, collection, id)
+	if err != nil {
+		return nil, err
+	}
+	return expandRefsRecursive(ctx, collection, rawNode)
+}
+
+func expandRefsRecursive(ctx context.Context, collection *mongo.Collection, node map[string]interface{}) (map[string]interface{}, error) {
+	for k, v := range node {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := vv["$ref"]; ok {
+				referencedNode, err := getExpandedNodeRecursive(ctx, collection, ref.(string))
+				if err != nil {
+					return nil, err
+				}
+				node[k] = referencedNode
+			}
+		case []interface{}:
+			expandedArray, err := expandArrayRecursive(ctx, collection, vv)
+			if err != nil {
+				return nil, err
+			}
+			node[k] = expandedArray
+		case primitive.A:
+			expandedArray, err := expandArrayRecursive(ctx, collection, []interface{}(vv))
+			if err != nil {
+				return nil, err
+			}
+			node[k] = expandedArray
+		}
+	}
+
+	return node, nil
+}
+
+func expandArrayRecursive(ctx context.Context, collection *mongo.Collection, items []interface{}) ([]interface{}, error) {
+	expanded := []interface{}{}
+	for _, item := range items {
+		refMap, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		refId, ok := refMap["$ref"].(string)
+		if !ok {
+			continue
+		}
+		referencedNode, err := getExpandedNodeRecursive(ctx, collection, refId)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, referencedNode)
+	}
+
+	return expanded, nil
+}
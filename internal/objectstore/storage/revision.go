@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+/*
+RevisionField holds the revision of a plan on its root node, bumped by every guarded write.
+A root stored before revisions were kept has none, which reads as revision 0.
+*/
+const RevisionField = "_rev"
+
+/*
+Revision returns the revision stored on a root node, whatever numeric type it was decoded as.
+*/
+func Revision(node map[string]interface{}) int64 {
+	switch rev := node[RevisionField].(type) {
+	case int32:
+		return int64(rev)
+	case int64:
+		return rev
+	case int:
+		return int64(rev)
+	case float64:
+		return int64(rev)
+	case json.Number:
+		n, _ := rev.Int64()
+		return n
+	default:
+		return 0
+	}
+}
+
+/*
+InsertNode inserts an empty node with the id, and reports false when a node is already stored
+with it. The unique _id makes the insert fail for the second of two concurrent inserts,
+whether they run in transactions or not.
+*/
+func InsertNode(ctx context.Context, collection *mongo.Collection, id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := collection.InsertOne(ctx, bson.M{"_id": id}); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return false, nil
+		}
+		logger.Logger.Error("storage.InsertNode failed", zap.String("id", id), zap.Error(err))
+		return false, fmt.Errorf("failed to insert node %s: %w", id, err)
+	}
+	return true, nil
+}
+
+/*
+SwapRevision bumps the revision of the root node from expected to expected+1 in a single
+conditional update, and reports false when the root is gone or holds another revision.
+The update is atomic on its own, inside a transaction it also makes a concurrent
+transaction writing the same root fail with a write conflict.
+*/
+func SwapRevision(ctx context.Context, collection *mongo.Collection, id string, expected int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{"_id": id, RevisionField: expected}
+	if expected == 0 {
+		filter[RevisionField] = bson.M{"$in": bson.A{int64(0), nil}}
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{RevisionField: int64(1)}})
+	if err != nil {
+		logger.Logger.Error("storage.SwapRevision failed", zap.String("id", id), zap.Error(err))
+		return false, fmt.Errorf("failed to swap revision of node %s: %v", id, err)
+	}
+	return result.MatchedCount == 1, nil
+}
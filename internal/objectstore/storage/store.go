@@ -12,22 +12,101 @@ import (
 	"go.uber.org/zap"
 )
 
-func StoreExtractedGraphNodes(collection *mongo.Collection, nodes map[string]map[string]interface{}) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+/*
+StoreExtractedGraphNodes upserts the nodes of a plan in one transaction (see WithTransaction)
+and updates the edge sets from the diff between the stored graph and the new one:
+  - every node gets the nodes of the plan that reference it added to its referencedBy
+  - a node a plan node stopped referencing loses that edge, and is removed with its
+    descendants once no parent refers to it anymore (see collectUnreferenced)
+
+It returns the removed nodes.
+*/
+func StoreExtractedGraphNodes(ctx context.Context, collection *mongo.Collection, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
+	var removed map[string]map[string]interface{}
+	err := WithTransaction(ctx, collection, func(ctx context.Context) error {
+		var err error
+		removed, err = storeNodes(ctx, collection, nodes)
+		return err
+	})
+	return removed, err
+}
+
+func storeNodes(ctx context.Context, collection *mongo.Collection, nodes map[string]map[string]interface{}) (map[string]map[string]interface{}, error) {
+	edges := GraphEdges(nodes)
+
+	parentIds := make([]string, 0, len(nodes))
+	for id := range nodes {
+		parentIds = append(parentIds, id)
+	}
+	previousChildren, err := findReferencedBy(ctx, collection, parentIds)
+	if err != nil {
+		logger.Logger.Error("storage.StoreExtractedGraphNodes: failed to load edges", zap.Error(err))
+		return nil, fmt.Errorf("failed to load edges: %v", err)
+	}
+
 	for id, node := range nodes {
-		node["_id"] = id
-		update := bson.M{"$set": node}
-		if _, exists := node["refCount"]; !exists {
-			update["$inc"] = bson.M{"refCount": 1}
+		fields := NodeFields(node)
+		unset := bson.M{"refCount": ""}
+		if _, ok := fields[CreationDateField]; !ok {
+			unset[CreationDateField] = ""
+		}
+		update := bson.M{
+			"$set":   fields,
+			"$unset": unset,
+		}
+		if parents := edges[id]; len(parents) > 0 {
+			update["$addToSet"] = bson.M{ReferencedByField: bson.M{"$each": parents}}
 		}
 		opts := options.Update().SetUpsert(true)
 		if _, err := collection.UpdateByID(ctx, id, update, opts); err != nil {
 			logger.Logger.Error("storage.StoreExtractedGraphNodes failed", zap.String("id", id), zap.Error(err))
-			return fmt.Errorf("failed to store node %s: %v", id, err)
+			return nil, fmt.Errorf("failed to store node %s: %v", id, err)
 		}
 	}
 
-	return nil
+	// edges from nodes of this plan that are not in the new graph
+	released := []string{}
+	for _, child := range previousChildren {
+		childId, _ := child["_id"].(string)
+
+		stale := []string{}
+		for _, parent := range ReferencedBy(child) {
+			if _, inGraph := nodes[parent]; inGraph && !contains(edges[childId], parent) {
+				stale = append(stale, parent)
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+
+		if _, err := collection.UpdateByID(ctx, childId, bson.M{"$pullAll": bson.M{ReferencedByField: stale}}); err != nil {
+			logger.Logger.Error("storage.StoreExtractedGraphNodes: failed to release edges", zap.String("id", childId), zap.Error(err))
+			return nil, fmt.Errorf("failed to release edges of node %s: %v", childId, err)
+		}
+		released = append(released, childId)
+	}
+
+	return collectUnreferenced(ctx, collection, released)
+}
+
+/*
+NodeFields returns the fields of the node to store, without the bookkeeping fields. The revision
+is only changed by SwapRevision, so a write keeps the stored one, and CreationDateField is derived
+from the creationDate of the node.
+*/
+func NodeFields(node map[string]interface{}) bson.M {
+	fields := bson.M{}
+	for k, v := range node {
+		if k == "_id" || k == "refCount" || k == ReferencedByField || k == RevisionField || k == CreationDateField {
+			continue
+		}
+		fields[k] = v
+	}
+	if date := SortableDate(node["creationDate"]); date != "" {
+		fields[CreationDateField] = date
+	}
+	return fields
 }
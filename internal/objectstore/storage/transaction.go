@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+var ErrTransactionsUnsupported = errors.New("MongoDB is a standalone server, transactions require a replica set or a sharded cluster")
+
+// transaction support per client, detected once
+var transactionSupport sync.Map
+
+/*
+WithTransaction runs fn inside a MongoDB session transaction on the collection's client.
+Storage functions called with the ctx passed to fn join the transaction, and a call made with
+a ctx already inside a transaction runs fn in that transaction.
+
+A standalone server does not support transactions: fn then runs without one, so a failure can
+leave its writes partially applied. A warning reporting ErrTransactionsUnsupported is logged
+when the topology is first detected.
+*/
+func WithTransaction(ctx context.Context, collection *mongo.Collection, fn func(ctx context.Context) error) error {
+	if mongo.SessionFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+
+	client := collection.Database().Client()
+	supported, err := transactionsSupported(ctx, client)
+	if err != nil {
+		logger.Logger.Error("storage.WithTransaction: failed to detect the server topology", zap.Error(err))
+		return fmt.Errorf("failed to detect the server topology: %v", err)
+	}
+	if !supported {
+		return fn(ctx)
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		logger.Logger.Error("storage.WithTransaction: failed to start session", zap.Error(err))
+		return fmt.Errorf("failed to start session: %v", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sessCtx)
+	})
+	if err != nil {
+		logger.Logger.Error("storage.WithTransaction: transaction failed", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+/*
+transactionsSupported asks the server whether it is a replica set member or a mongos,
+the deployments where multi-document transactions are available.
+*/
+func transactionsSupported(ctx context.Context, client *mongo.Client) (bool, error) {
+	if supported, ok := transactionSupport.Load(client); ok {
+		return supported.(bool), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return false, err
+	}
+
+	supported := hello.SetName != "" || hello.Msg == "isdbgrid"
+	if !supported {
+		logger.Logger.Warn("MongoDB does not support transactions, plan writes will not be all-or-nothing", zap.Error(ErrTransactionsUnsupported))
+	}
+	transactionSupport.Store(client, supported)
+	return supported, nil
+}
@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+MemoryStore keeps the outbox entries in memory, for the tests running on a nodestore.MemoryStore.
+It does not join transactions: the entries of a rolled back transaction are kept.
+*/
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (o *MemoryStore) Enqueue(ctx context.Context, msgs ...messagequeue.Message) error {
+	now := time.Now()
+	entries := make([]Entry, 0, len(msgs))
+	for _, msg := range msgs {
+		payload, err := msg.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode %s message: %v", msg.Type(), err)
+		}
+		entries = append(entries, Entry{
+			ID:         primitive.NewObjectID(),
+			RoutingKey: msg.Type(),
+			Payload:    payload,
+			Status:     StatusPending,
+			CreatedAt:  now,
+		})
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.entries = append(o.entries, entries...)
+	return nil
+}
+
+/*
+FetchPending returns up to limit pending entries in insertion order.
+*/
+func (o *MemoryStore) FetchPending(ctx context.Context, limit int) ([]Entry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var entries []Entry
+	for _, entry := range o.entries {
+		if len(entries) == limit {
+			break
+		}
+		if entry.Status == StatusPending {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+/*
+FetchCreated returns up to limit entries, sent or not, created in [since, until) with an id
+greater than after, in insertion order.
+*/
+func (o *MemoryStore) FetchCreated(ctx context.Context, since, until time.Time, after primitive.ObjectID, limit int) ([]Entry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var entries []Entry
+	for _, entry := range o.entries {
+		if len(entries) == limit {
+			break
+		}
+		if entry.CreatedAt.Before(since) || !entry.CreatedAt.Before(until) || entry.ID.Hex() <= after.Hex() {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (o *MemoryStore) MarkSent(ctx context.Context, id primitive.ObjectID) error {
+	return o.update(id, func(entry *Entry) {
+		now := time.Now()
+		entry.Status = StatusSent
+		entry.SentAt = &now
+		entry.Attempts++
+	})
+}
+
+func (o *MemoryStore) MarkFailed(ctx context.Context, id primitive.ObjectID, cause error) error {
+	return o.update(id, func(entry *Entry) {
+		entry.LastError = cause.Error()
+		entry.Attempts++
+	})
+}
+
+func (o *MemoryStore) update(id primitive.ObjectID, fn func(entry *Entry)) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for i := range o.entries {
+		if o.entries[i].ID == id {
+			fn(&o.entries[i])
+			return nil
+		}
+	}
+	return fmt.Errorf("outbox entry %s not found", id.Hex())
+}
@@ -0,0 +1,195 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+
+	// sent entries are kept for a while for troubleshooting, then expired by a TTL index
+	sentRetention = 7 * 24 * time.Hour
+)
+
+/*
+Entry is an encoded message waiting in the outbox. It implements messagequeue.Message
+so the relay can publish it as-is.
+*/
+type Entry struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	RoutingKey string             `bson:"routingKey"`
+	Payload    []byte             `bson:"payload"`
+	Status     string             `bson:"status"`
+	Attempts   int                `bson:"attempts"`
+	LastError  string             `bson:"lastError,omitempty"`
+	CreatedAt  time.Time          `bson:"createdAt"`
+	SentAt     *time.Time         `bson:"sentAt,omitempty"`
+}
+
+func (e Entry) Type() string {
+	return e.RoutingKey
+}
+
+func (e Entry) Encode() ([]byte, error) {
+	return e.Payload, nil
+}
+
+/*
+Store persists the outbox entries. Enqueue joins the transaction carried by ctx, so the entries
+commit together with the writes they describe; Outbox keeps them in MongoDB, SQLOutbox in a SQL database
+and MemoryStore in memory.
+*/
+type Store interface {
+	Enqueue(ctx context.Context, msgs ...messagequeue.Message) error
+	FetchPending(ctx context.Context, limit int) ([]Entry, error)
+	FetchCreated(ctx context.Context, since, until time.Time, after primitive.ObjectID, limit int) ([]Entry, error)
+	MarkSent(ctx context.Context, id primitive.ObjectID) error
+	MarkFailed(ctx context.Context, id primitive.ObjectID, cause error) error
+}
+
+type Outbox struct {
+	collection *mongo.Collection
+}
+
+func NewOutbox(collection *mongo.Collection) *Outbox {
+	return &Outbox{
+		collection: collection,
+	}
+}
+
+func (o *Outbox) EnsureIndexes(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	_, err := o.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "sentAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(sentRetention.Seconds())),
+		},
+	})
+	if err != nil {
+		logger.Logger.Error("Outbox.EnsureIndexes failed", zap.Error(err))
+		return fmt.Errorf("failed to create outbox indexes: %v", err)
+	}
+	return nil
+}
+
+/*
+Enqueue encodes the messages and inserts them as pending entries.
+When ctx carries a Mongo session transaction, the entries are committed together with it.
+*/
+func (o *Outbox) Enqueue(ctx context.Context, msgs ...messagequeue.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	docs := make([]interface{}, 0, len(msgs))
+	for _, msg := range msgs {
+		payload, err := msg.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode %s message: %v", msg.Type(), err)
+		}
+		docs = append(docs, Entry{
+			ID:         primitive.NewObjectID(),
+			RoutingKey: msg.Type(),
+			Payload:    payload,
+			Status:     StatusPending,
+			CreatedAt:  now,
+		})
+	}
+
+	if _, err := o.collection.InsertMany(ctx, docs); err != nil {
+		logger.Logger.Error("Outbox.Enqueue failed", zap.Error(err))
+		return fmt.Errorf("failed to enqueue outbox entries: %v", err)
+	}
+	return nil
+}
+
+/*
+FetchPending returns up to limit pending entries in insertion order.
+*/
+func (o *Outbox) FetchPending(ctx context.Context, limit int) ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := o.collection.Find(ctx, bson.M{"status": StatusPending}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch pending outbox entries: %v", err)
+	}
+
+	var entries []Entry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode outbox entries: %v", err)
+	}
+	return entries, nil
+}
+
+/*
+FetchCreated returns up to limit entries, sent or not, created in [since, until) with an id
+greater than after, in insertion order. Passing the last id of a page as after walks the range.
+*/
+func (o *Outbox) FetchCreated(ctx context.Context, since, until time.Time, after primitive.ObjectID, limit int) ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	filter := bson.M{
+		"createdAt": bson.M{"$gte": since, "$lt": until},
+		"_id":       bson.M{"$gt": after},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit))
+	cursor, err := o.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch outbox entries: %v", err)
+	}
+
+	var entries []Entry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode outbox entries: %v", err)
+	}
+	return entries, nil
+}
+
+func (o *Outbox) MarkSent(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$set": bson.M{"status": StatusSent, "sentAt": time.Now()},
+		"$inc": bson.M{"attempts": 1},
+	}
+	if _, err := o.collection.UpdateByID(ctx, id, update); err != nil {
+		return fmt.Errorf("failed to mark outbox entry %s as sent: %v", id.Hex(), err)
+	}
+	return nil
+}
+
+func (o *Outbox) MarkFailed(ctx context.Context, id primitive.ObjectID, cause error) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	update := bson.M{
+		"$set": bson.M{"lastError": cause.Error()},
+		"$inc": bson.M{"attempts": 1},
+	}
+	if _, err := o.collection.UpdateByID(ctx, id, update); err != nil {
+		return fmt.Errorf("failed to record outbox failure for %s: %v", id.Hex(), err)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"eric-cw-hsu.github.io/internal/shared/metrics"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	DefaultPollInterval = 2 * time.Second
+	DefaultBatchSize    = 100
+)
+
+/*
+Relay publishes pending outbox entries through the publisher and marks them sent.
+Entries are relayed in insertion order and a pass stops at the first failure, so events
+for the same node are never reordered. Delivery is at-least-once.
+
+A failed publish is recorded on its entry (MarkFailed), counted in the outbox metrics by reason,
+and kept as the relay's LastFailure until a later pass drains the outbox.
+*/
+type Relay struct {
+	mu           sync.Mutex
+	outbox       Store
+	publisher    messagePublisher
+	pollInterval time.Duration
+	batchSize    int
+	wake         chan struct{}
+
+	statusMu    sync.Mutex
+	lastFailure *PublishFailure
+}
+
+// messagePublisher is the part of messagequeue.Publisher the relay uses
+type messagePublisher interface {
+	PublishMessage(ctx context.Context, routingKey string, msg messagequeue.Message) error
+}
+
+/*
+PublishFailure is the publish failure that stopped the last relay pass, At is when the entry
+first failed. Err wraps
+messagequeue.ErrPublishNacked, ErrPublishUnroutable or ErrConfirmTimeout when the broker refused
+or did not confirm the entry.
+*/
+type PublishFailure struct {
+	EntryID    primitive.ObjectID
+	RoutingKey string
+	Err        error
+	At         time.Time
+}
+
+/*
+PublishFailureReason names the kind of a publish failure, the reason label of the outbox metrics.
+*/
+func PublishFailureReason(err error) string {
+	switch {
+	case errors.Is(err, messagequeue.ErrPublishNacked):
+		return "nacked"
+	case errors.Is(err, messagequeue.ErrPublishUnroutable):
+		return "unroutable"
+	case errors.Is(err, messagequeue.ErrConfirmTimeout):
+		return "confirm_timeout"
+	default:
+		return "error"
+	}
+}
+
+func NewRelay(outbox Store, publisher messagePublisher, pollInterval time.Duration, batchSize int) *Relay {
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	return &Relay{
+		outbox:       outbox,
+		publisher:    publisher,
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+/*
+Notify wakes the relay up after a transaction committed new entries, instead of waiting
+for the next poll.
+*/
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := r.RelayPending(ctx); err != nil {
+				logger.Logger.Warn("Relay: pass stopped early", zap.Error(err))
+			}
+
+			select {
+			case <-ctx.Done():
+				logger.Logger.Info("Relay stopped")
+				return
+			case <-ticker.C:
+			case <-r.wake:
+			}
+		}
+	}()
+}
+
+/*
+LastFailure returns the publish failure that stopped the last pass, nil once a pass drained the outbox.
+*/
+func (r *Relay) LastFailure() *PublishFailure {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.lastFailure
+}
+
+func (r *Relay) setLastFailure(failure *PublishFailure) {
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	r.lastFailure = failure
+
+	if failure != nil {
+		metrics.OutboxRelayFailing.Set(1)
+	} else {
+		metrics.OutboxRelayFailing.Set(0)
+	}
+}
+
+/*
+RelayPending publishes pending entries batch by batch until the outbox is drained
+and returns how many entries were sent. Passes are serialized, so concurrent callers never
+publish the same entries twice.
+*/
+func (r *Relay) RelayPending(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sent := 0
+	for {
+		entries, err := r.outbox.FetchPending(ctx, r.batchSize)
+		if err != nil {
+			return sent, err
+		}
+
+		for _, entry := range entries {
+			if err := r.publisher.PublishMessage(ctx, entry.Type(), entry); err != nil {
+				reason := PublishFailureReason(err)
+				logger.Logger.Error("Relay: failed to publish outbox entry", zap.String("id", entry.ID.Hex()), zap.String("routingKey", entry.RoutingKey), zap.String("reason", reason), zap.Error(err))
+				metrics.OutboxPublishFailures.WithLabelValues(reason).Inc()
+				failure := &PublishFailure{EntryID: entry.ID, RoutingKey: entry.RoutingKey, Err: err, At: time.Now()}
+				if last := r.LastFailure(); last != nil && last.EntryID == entry.ID {
+					// the entry keeps failing, At stays the time of its first failure
+					failure.At = last.At
+				}
+				r.setLastFailure(failure)
+				if markErr := r.outbox.MarkFailed(ctx, entry.ID, err); markErr != nil {
+					logger.Logger.Error("Relay: failed to record publish failure", zap.Error(markErr))
+				}
+				return sent, err
+			}
+
+			if err := r.outbox.MarkSent(ctx, entry.ID); err != nil {
+				return sent, err
+			}
+			metrics.OutboxPublished.Inc()
+			sent++
+		}
+
+		if len(entries) < r.batchSize {
+			r.setLastFailure(nil)
+			return sent, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"go.uber.org/zap"
+)
+
+type testMessage string
+
+func (m testMessage) Type() string {
+	return "test." + string(m)
+}
+
+func (m testMessage) Encode() ([]byte, error) {
+	return []byte(m), nil
+}
+
+// failingPublisher fails the publishes while err is set, and records the published routing keys
+type failingPublisher struct {
+	err       error
+	published []string
+}
+
+func (p *failingPublisher) PublishMessage(ctx context.Context, routingKey string, msg messagequeue.Message) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, routingKey)
+	return nil
+}
+
+func TestRelayReportsPublishFailures(t *testing.T) {
+	logger.Logger = zap.NewNop()
+	ctx := context.Background()
+
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{fmt.Errorf("%w: routing key test.first", messagequeue.ErrPublishNacked), "nacked"},
+		{fmt.Errorf("%w: routing key test.first", messagequeue.ErrPublishUnroutable), "unroutable"},
+		{fmt.Errorf("%w after 5s", messagequeue.ErrConfirmTimeout), "confirm_timeout"},
+		{errors.New("channel closed"), "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			store := NewMemoryStore()
+			if err := store.Enqueue(ctx, testMessage("first"), testMessage("second")); err != nil {
+				t.Fatal(err)
+			}
+			publisher := &failingPublisher{err: tt.err}
+			relay := NewRelay(store, publisher, 0, 0)
+
+			// a failed pass stops at the first entry and records the failure on it
+			for pass := 0; pass < 2; pass++ {
+				if sent, err := relay.RelayPending(ctx); !errors.Is(err, tt.err) || sent != 0 {
+					t.Fatalf("RelayPending = %d, %v, want 0, %v", sent, err, tt.err)
+				}
+			}
+			if reason := PublishFailureReason(tt.err); reason != tt.reason {
+				t.Errorf("PublishFailureReason = %s, want %s", reason, tt.reason)
+			}
+
+			pending, _ := store.FetchPending(ctx, 10)
+			if len(pending) != 2 || pending[0].Attempts != 2 || pending[0].LastError != tt.err.Error() {
+				t.Fatalf("pending entries = %+v, want both, the first failed twice", pending)
+			}
+			failure := relay.LastFailure()
+			if failure == nil || failure.EntryID != pending[0].ID || failure.RoutingKey != "test.first" || !errors.Is(failure.Err, tt.err) {
+				t.Fatalf("LastFailure = %+v, want the failure of the first entry", failure)
+			}
+
+			// a pass draining the outbox clears the failure
+			publisher.err = nil
+			if sent, err := relay.RelayPending(ctx); err != nil || sent != 2 {
+				t.Fatalf("RelayPending after recovery = %d, %v, want 2, nil", sent, err)
+			}
+			if fmt.Sprint(publisher.published) != "[test.first test.second]" {
+				t.Errorf("published %v, want the entries in insertion order", publisher.published)
+			}
+			if failure := relay.LastFailure(); failure != nil {
+				t.Errorf("LastFailure after recovery = %+v, want nil", failure)
+			}
+		})
+	}
+}
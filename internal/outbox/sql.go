@@ -0,0 +1,164 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/database"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+var sqlSchema = []string{
+	// ids are ObjectID hex strings, which sort in insertion order like the Mongo _id
+	`CREATE TABLE IF NOT EXISTS outbox_entries (
+		id          TEXT PRIMARY KEY,
+		routing_key TEXT NOT NULL,
+		payload     TEXT NOT NULL,
+		status      TEXT NOT NULL,
+		attempts    INTEGER NOT NULL DEFAULT 0,
+		last_error  TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMP NOT NULL,
+		sent_at     TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_entries_status ON outbox_entries (status, id)`,
+}
+
+/*
+SQLOutbox keeps the outbox entries in the outbox_entries table of the database holding the
+nodes, for the SQL node stores. Sent entries are purged after the retention period.
+*/
+type SQLOutbox struct {
+	db *sql.DB
+}
+
+func NewSQLOutbox(db *sql.DB) *SQLOutbox {
+	return &SQLOutbox{
+		db: db,
+	}
+}
+
+func (o *SQLOutbox) EnsureSchema(ctx context.Context) error {
+	for _, statement := range sqlSchema {
+		if _, err := o.db.ExecContext(ctx, statement); err != nil {
+			logger.Logger.Error("SQLOutbox.EnsureSchema failed", zap.Error(err))
+			return fmt.Errorf("failed to create outbox table: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Enqueue encodes the messages and inserts them as pending entries.
+When ctx carries a transaction of the database, the entries are committed together with it.
+*/
+func (o *SQLOutbox) Enqueue(ctx context.Context, msgs ...messagequeue.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	exec := database.SQLExecutorFrom(ctx, o.db)
+	now := time.Now().UTC()
+	for _, msg := range msgs {
+		payload, err := msg.Encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode %s message: %v", msg.Type(), err)
+		}
+		if _, err := exec.ExecContext(ctx,
+			`INSERT INTO outbox_entries (id, routing_key, payload, status, created_at) VALUES ($1, $2, $3, $4, $5)`,
+			primitive.NewObjectID().Hex(), msg.Type(), string(payload), StatusPending, now,
+		); err != nil {
+			logger.Logger.Error("SQLOutbox.Enqueue failed", zap.Error(err))
+			return fmt.Errorf("failed to enqueue outbox entries: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+FetchPending returns up to limit pending entries in insertion order, after purging the
+entries sent before the retention period.
+*/
+func (o *SQLOutbox) FetchPending(ctx context.Context, limit int) ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := o.db.ExecContext(ctx,
+		`DELETE FROM outbox_entries WHERE status = $1 AND sent_at < $2`, StatusSent, time.Now().UTC().Add(-sentRetention),
+	); err != nil {
+		logger.Logger.Warn("SQLOutbox.FetchPending: failed to purge sent entries", zap.Error(err))
+	}
+
+	return o.queryEntries(ctx,
+		`SELECT id, routing_key, payload, status, attempts, last_error, created_at FROM outbox_entries
+		WHERE status = $1 ORDER BY id LIMIT $2`, StatusPending, limit,
+	)
+}
+
+/*
+FetchCreated returns up to limit entries, sent or not, created in [since, until) with an id
+greater than after, in insertion order. Passing the last id of a page as after walks the range.
+*/
+func (o *SQLOutbox) FetchCreated(ctx context.Context, since, until time.Time, after primitive.ObjectID, limit int) ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	return o.queryEntries(ctx,
+		`SELECT id, routing_key, payload, status, attempts, last_error, created_at FROM outbox_entries
+		WHERE created_at >= $1 AND created_at < $2 AND id > $3 ORDER BY id LIMIT $4`,
+		since.UTC(), until.UTC(), after.Hex(), limit,
+	)
+}
+
+func (o *SQLOutbox) queryEntries(ctx context.Context, query string, args ...interface{}) ([]Entry, error) {
+	rows, err := o.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch outbox entries: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var id, payload string
+		var entry Entry
+		if err := rows.Scan(&id, &entry.RoutingKey, &payload, &entry.Status, &entry.Attempts, &entry.LastError, &entry.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to decode outbox entries: %v", err)
+		}
+		if entry.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+			return nil, fmt.Errorf("invalid outbox entry id %s: %v", id, err)
+		}
+		entry.Payload = []byte(payload)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (o *SQLOutbox) MarkSent(ctx context.Context, id primitive.ObjectID) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := o.db.ExecContext(ctx,
+		`UPDATE outbox_entries SET status = $1, sent_at = $2, attempts = attempts + 1 WHERE id = $3`,
+		StatusSent, time.Now().UTC(), id.Hex(),
+	); err != nil {
+		return fmt.Errorf("failed to mark outbox entry %s as sent: %v", id.Hex(), err)
+	}
+	return nil
+}
+
+func (o *SQLOutbox) MarkFailed(ctx context.Context, id primitive.ObjectID, cause error) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if _, err := o.db.ExecContext(ctx,
+		`UPDATE outbox_entries SET last_error = $1, attempts = attempts + 1 WHERE id = $2`,
+		cause.Error(), id.Hex(),
+	); err != nil {
+		return fmt.Errorf("failed to record outbox failure for %s: %v", id.Hex(), err)
+	}
+	return nil
+}
@@ -1,10 +1,42 @@
 package rabbitmq
 
-import "github.com/rabbitmq/amqp091-go"
+import (
+	"fmt"
+	"sync"
+	"time"
 
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"github.com/rabbitmq/amqp091-go"
+	"go.uber.org/zap"
+)
+
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = 30 * time.Second
+)
+
+/*
+ChannelBinder is implemented by clients owning a channel of the connection (publisher, consumer).
+Bind is called with a fresh channel on Attach and after every recovery, it must re-declare
+the exchanges, queues and bindings the client relies on.
+*/
+type ChannelBinder interface {
+	Bind(channel *amqp091.Channel) error
+}
+
+/*
+MQConnection keeps a RabbitMQ connection alive. It watches NotifyClose on the connection and
+on every attached channel: a lost connection is re-dialed with exponential backoff and all
+binders get new channels, a channel closed by a channel-level error is reopened on its own.
+*/
 type MQConnection struct {
-	Conn    *amqp091.Connection
-	Channel *amqp091.Channel
+	uri string
+
+	mu       sync.Mutex
+	conn     *amqp091.Connection
+	channels map[ChannelBinder]*amqp091.Channel
+	closed   bool
+	done     chan struct{}
 }
 
 func NewMQConnection(uri string) (*MQConnection, error) {
@@ -13,23 +45,172 @@ func NewMQConnection(uri string) (*MQConnection, error) {
 		return nil, err
 	}
 
+	mq := &MQConnection{
+		uri:      uri,
+		conn:     conn,
+		channels: make(map[ChannelBinder]*amqp091.Channel),
+		done:     make(chan struct{}),
+	}
+	go mq.watchConnection(conn.NotifyClose(make(chan *amqp091.Error, 1)))
+
+	return mq, nil
+}
+
+/*
+Attach opens a channel for the binder and keeps it bound across reconnections.
+*/
+func (mq *MQConnection) Attach(binder ChannelBinder) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if mq.closed {
+		return amqp091.ErrClosed
+	}
+
+	return mq.bind(mq.conn, binder)
+}
+
+// bind must be called with mq.mu held
+func (mq *MQConnection) bind(conn *amqp091.Connection, binder ChannelBinder) error {
 	ch, err := conn.Channel()
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	if err := binder.Bind(ch); err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to bind channel: %w", err)
+	}
+
+	mq.channels[binder] = ch
+	go mq.watchChannel(conn, binder, ch.NotifyClose(make(chan *amqp091.Error, 1)))
+	return nil
+}
+
+func (mq *MQConnection) watchConnection(closes chan *amqp091.Error) {
+	err, ok := <-closes
+	if !ok || err == nil {
+		// closed on purpose
+		return
+	}
+
+	logger.Logger.Error("RabbitMQ connection lost, reconnecting", zap.Error(err))
+	mq.reconnect()
+}
+
+func (mq *MQConnection) watchChannel(conn *amqp091.Connection, binder ChannelBinder, closes chan *amqp091.Error) {
+	err, ok := <-closes
+	if !ok || err == nil || conn.IsClosed() {
+		// closed on purpose, or the connection watcher takes care of it
+		return
 	}
 
-	return &MQConnection{
-		Conn:    conn,
-		Channel: ch,
-	}, nil
+	logger.Logger.Error("RabbitMQ channel closed, reopening", zap.Error(err))
+	backoff := minReconnectBackoff
+	for {
+		if !mq.sleep(backoff) {
+			return
+		}
+
+		mq.mu.Lock()
+		if mq.closed || mq.conn != conn || conn.IsClosed() {
+			mq.mu.Unlock()
+			return
+		}
+		err := mq.bind(conn, binder)
+		mq.mu.Unlock()
+
+		if err == nil {
+			logger.Logger.Info("RabbitMQ channel recovered")
+			return
+		}
+
+		logger.Logger.Warn("Failed to reopen RabbitMQ channel", zap.Duration("backoff", backoff), zap.Error(err))
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (mq *MQConnection) reconnect() {
+	backoff := minReconnectBackoff
+	for {
+		if !mq.sleep(backoff) {
+			return
+		}
+
+		conn, err := amqp091.Dial(mq.uri)
+		var closes chan *amqp091.Error
+		if err == nil {
+			closes = conn.NotifyClose(make(chan *amqp091.Error, 1))
+			if err = mq.rebindAll(conn); err != nil {
+				conn.Close()
+			}
+		}
+
+		if err == nil {
+			go mq.watchConnection(closes)
+			logger.Logger.Info("RabbitMQ connection recovered")
+			return
+		}
+
+		logger.Logger.Warn("Failed to reconnect to RabbitMQ", zap.Duration("backoff", backoff), zap.Error(err))
+		backoff = nextBackoff(backoff)
+	}
+}
+
+func (mq *MQConnection) rebindAll(conn *amqp091.Connection) error {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if mq.closed {
+		return amqp091.ErrClosed
+	}
+
+	mq.conn = conn
+	for binder := range mq.channels {
+		if err := mq.bind(conn, binder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+sleep waits for d and reports false when the connection was closed in the meantime.
+*/
+func (mq *MQConnection) sleep(d time.Duration) bool {
+	select {
+	case <-mq.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > maxReconnectBackoff {
+		return maxReconnectBackoff
+	}
+	return backoff
 }
 
 func (mq *MQConnection) Close() {
-	if mq.Channel != nil {
-		mq.Channel.Close()
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if mq.closed {
+		return
+	}
+	mq.closed = true
+	close(mq.done)
+
+	for _, ch := range mq.channels {
+		if !ch.IsClosed() {
+			ch.Close()
+		}
 	}
 
-	if mq.Conn != nil {
-		mq.Conn.Close()
+	if mq.conn != nil && !mq.conn.IsClosed() {
+		mq.conn.Close()
 	}
 }
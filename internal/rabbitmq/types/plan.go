@@ -2,6 +2,7 @@ package types
 
 type PlanMessage struct {
 	Action string                 `json:"action"` // "create" | "update" | "delete"
+	Index  string                 `json:"index"`  // index of the resource, see resource.Resource
 	Key    string                 `json:"key"`
 	Data   map[string]interface{} `json:"data,omitempty"`
 }
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"log"
+	"os"
+	"path"
+	"time"
+
+	esconfig "eric-cw-hsu.github.io/internal/elasticsearch/config"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Mongo struct {
+		URI      string
+		Database string
+	}
+	ElasticSearch esconfig.ElasticSearch
+	Reconcile     struct {
+		Interval    time.Duration
+		BatchSize   int `mapstructure:"batch_size"`
+		Repair      bool
+		MetricsPort string `mapstructure:"metrics_port"`
+	}
+}
+
+func Load() Config {
+	dir, _ := os.Getwd()
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath(path.Join(dir, "cmd/reconciler"))
+	viper.AddConfigPath("config/")
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+
+	var cfg Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		log.Fatalf("Unable to decode config into struct: %v", err)
+	}
+
+	return cfg
+}
@@ -0,0 +1,74 @@
+package reconcile
+
+import (
+	"context"
+	"sort"
+
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+nodeCursor pages through the Mongo nodes with the given ids, which are in id order, and skips the
+nodes removed since the ids were collected. next returns nil at the end.
+*/
+type nodeCursor struct {
+	collection *mongo.Collection
+	ids        []string
+	batchSize  int
+	page       []map[string]interface{}
+}
+
+func (c *nodeCursor) next(ctx context.Context) (map[string]interface{}, error) {
+	for len(c.page) == 0 && len(c.ids) > 0 {
+		batch := c.ids[:min(c.batchSize, len(c.ids))]
+		c.ids = c.ids[len(batch):]
+
+		page, err := storage.FindNodes(ctx, c.collection, batch)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(page, func(i, j int) bool {
+			return nodeID(page[i]) < nodeID(page[j])
+		})
+		c.page = page
+	}
+	if len(c.page) == 0 {
+		return nil, nil
+	}
+
+	node := c.page[0]
+	c.page = c.page[1:]
+	return node, nil
+}
+
+/*
+documentCursor pages through the index documents in objectId order, next returns nil at the end.
+*/
+type documentCursor struct {
+	client    *elasticsearch.Client
+	batchSize int
+	page      []elasticsearch.StoredDocument
+	lastId    string
+	done      bool
+}
+
+func (c *documentCursor) next(ctx context.Context) (*elasticsearch.StoredDocument, error) {
+	if len(c.page) == 0 && !c.done {
+		page, err := c.client.ScanDocuments(ctx, c.lastId, c.batchSize)
+		if err != nil {
+			return nil, err
+		}
+		c.page = page
+		c.done = len(page) < c.batchSize
+	}
+	if len(c.page) == 0 {
+		return nil, nil
+	}
+
+	doc := c.page[0]
+	c.page = c.page[1:]
+	c.lastId = doc.ID
+	return &doc, nil
+}
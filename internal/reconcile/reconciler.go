@@ -0,0 +1,376 @@
+package reconcile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue/messages"
+	"eric-cw-hsu.github.io/internal/shared/metrics"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const DefaultBatchSize = 500
+
+/*
+Report lists the nodes that differ between MongoDB and the indices of their resources:
+  - Missing: node in MongoDB without a document
+  - Stale: document whose content differs from the document built from the node
+  - Orphaned: document without a node
+*/
+type Report struct {
+	Nodes       int64
+	Documents   int64
+	InSync      int64
+	Missing     []string
+	Stale       []string
+	Orphaned    []string
+	Republished int
+	Deleted     int
+}
+
+/*
+Reconciler checks the index of every resource against the nodes of the resource, the roots whose
+fieldName is its root field and their subgraphs. It walks the nodes and the index documents side by
+side in id order and compares each document with elasticsearch.BuildDocument of its node by content
+hash. With repair, missing and stale nodes are republished as node events of their resource through
+the outbox, so they are indexed in order with the regular writes, and orphaned documents are deleted.
+*/
+type Reconciler struct {
+	resources  []*resource.Resource
+	nodes      *mongo.Collection
+	outbox     *outbox.Outbox
+	client     *elasticsearch.Client
+	bulkConfig elasticsearch.BulkConfig
+	batchSize  int
+}
+
+/*
+NewReconciler returns a reconciler of the resources, client being the client of the configured
+plan index: each resource is checked against its index alias (see Client.ForResource).
+*/
+func NewReconciler(
+	resources []*resource.Resource,
+	nodes *mongo.Collection,
+	planOutbox *outbox.Outbox,
+	client *elasticsearch.Client,
+	bulkConfig elasticsearch.BulkConfig,
+	batchSize int,
+) *Reconciler {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	return &Reconciler{
+		resources:  resources,
+		nodes:      nodes,
+		outbox:     planOutbox,
+		client:     client,
+		bulkConfig: bulkConfig,
+		batchSize:  batchSize,
+	}
+}
+
+func (r *Reconciler) Run(ctx context.Context, repair bool) (*Report, error) {
+	started := time.Now()
+	report := newReport()
+	for _, res := range r.resources {
+		if err := r.reconcile(ctx, res, repair, report); err != nil {
+			metrics.ReconcileFailures.Inc()
+			return report, fmt.Errorf("reconciliation of %s failed: %w", res.Name, err)
+		}
+	}
+
+	metrics.ReconcileDocuments.WithLabelValues("in_sync").Set(float64(report.InSync))
+	metrics.ReconcileDocuments.WithLabelValues("missing").Set(float64(len(report.Missing)))
+	metrics.ReconcileDocuments.WithLabelValues("stale").Set(float64(len(report.Stale)))
+	metrics.ReconcileDocuments.WithLabelValues("orphaned").Set(float64(len(report.Orphaned)))
+	metrics.ReconcileRunDuration.Observe(time.Since(started).Seconds())
+	metrics.ReconcileLastSuccess.SetToCurrentTime()
+
+	logger.Logger.Info("Reconciliation completed",
+		zap.Int64("nodes", report.Nodes),
+		zap.Int64("documents", report.Documents),
+		zap.Int("missing", len(report.Missing)),
+		zap.Int("stale", len(report.Stale)),
+		zap.Int("orphaned", len(report.Orphaned)),
+		zap.Int("republished", report.Republished),
+		zap.Int("deleted", report.Deleted),
+		zap.Duration("elapsed", time.Since(started)),
+	)
+	return report, nil
+}
+
+func newReport() *Report {
+	return &Report{Missing: []string{}, Stale: []string{}, Orphaned: []string{}}
+}
+
+/*
+add adds the report of one resource to the report.
+*/
+func (r *Report) add(other *Report) {
+	r.Nodes += other.Nodes
+	r.Documents += other.Documents
+	r.InSync += other.InSync
+	r.Missing = append(r.Missing, other.Missing...)
+	r.Stale = append(r.Stale, other.Stale...)
+	r.Orphaned = append(r.Orphaned, other.Orphaned...)
+	r.Republished += other.Republished
+	r.Deleted += other.Deleted
+}
+
+/*
+reconcile compares the nodes of the resource with the documents of its index, repairs them with
+repair, and adds the result to the report.
+*/
+func (r *Reconciler) reconcile(ctx context.Context, res *resource.Resource, repair bool, report *Report) error {
+	client := r.client.ForResource(res)
+	ids, err := r.resourceNodeIDs(ctx, res)
+	if err != nil {
+		return err
+	}
+
+	part, orphans, err := r.compare(ctx, ids, client)
+	if err == nil && repair {
+		err = r.repair(ctx, res, client, part, orphans)
+	}
+	report.add(part)
+	if err != nil {
+		return err
+	}
+
+	logger.Logger.Info("Resource reconciled",
+		zap.String("resource", res.Name),
+		zap.String("index", client.Index()),
+		zap.Int64("nodes", part.Nodes),
+		zap.Int64("documents", part.Documents),
+		zap.Int("missing", len(part.Missing)),
+		zap.Int("stale", len(part.Stale)),
+		zap.Int("orphaned", len(part.Orphaned)),
+	)
+	return nil
+}
+
+/*
+resourceNodeIDs walks the roots of the resource and their subgraphs, and returns the ids of
+their nodes in id order.
+*/
+func (r *Reconciler) resourceNodeIDs(ctx context.Context, res *resource.Resource) ([]string, error) {
+	seen := map[string]bool{}
+	afterId := ""
+	for {
+		roots, err := storage.ScanRoots(ctx, r.nodes, res.RootField, afterId, r.batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(roots) == 0 {
+			break
+		}
+		subgraphs, err := storage.FindSubgraphs(ctx, r.nodes, roots)
+		if err != nil {
+			return nil, err
+		}
+		for id := range subgraphs {
+			seen[id] = true
+		}
+		afterId = nodeID(roots[len(roots)-1])
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+/*
+compare merges the nodes with the given ids and the documents of the index, both in id order.
+It returns the routing of every orphaned document.
+*/
+func (r *Reconciler) compare(ctx context.Context, ids []string, client *elasticsearch.Client) (*Report, map[string]string, error) {
+	report := newReport()
+	orphans := map[string]string{}
+
+	nodes := &nodeCursor{collection: r.nodes, ids: ids, batchSize: r.batchSize}
+	docs := &documentCursor{client: client, batchSize: r.batchSize}
+
+	node, err := nodes.next(ctx)
+	if err != nil {
+		return report, nil, err
+	}
+	doc, err := docs.next(ctx)
+	if err != nil {
+		return report, nil, err
+	}
+
+	for node != nil || doc != nil {
+		switch {
+		case doc == nil || (node != nil && nodeID(node) < doc.ID):
+			report.Nodes++
+			report.Missing = append(report.Missing, nodeID(node))
+			if node, err = nodes.next(ctx); err != nil {
+				return report, nil, err
+			}
+		case node == nil || doc.ID < nodeID(node):
+			report.Documents++
+			report.Orphaned = append(report.Orphaned, doc.ID)
+			orphans[doc.ID] = doc.Routing
+			if doc, err = docs.next(ctx); err != nil {
+				return report, nil, err
+			}
+		default:
+			report.Nodes++
+			report.Documents++
+			expected, err := contentHash(elasticsearch.BuildDocument(node))
+			if err != nil {
+				return report, nil, err
+			}
+			actual, err := contentHash(doc.Source)
+			if err != nil {
+				return report, nil, err
+			}
+			if expected == actual {
+				report.InSync++
+			} else {
+				report.Stale = append(report.Stale, doc.ID)
+			}
+
+			if node, err = nodes.next(ctx); err != nil {
+				return report, nil, err
+			}
+			if doc, err = docs.next(ctx); err != nil {
+				return report, nil, err
+			}
+		}
+	}
+
+	return report, orphans, nil
+}
+
+/*
+repair re-reads the nodes before acting, since the stores kept changing during the scan:
+a node created after the Mongo cursor passed its id must not be deleted as an orphan.
+*/
+func (r *Reconciler) repair(ctx context.Context, res *resource.Resource, client *elasticsearch.Client, report *Report, orphans map[string]string) error {
+	outdated := append(append([]string{}, report.Missing...), report.Stale...)
+	for start := 0; start < len(outdated); start += r.batchSize {
+		ids := outdated[start:min(start+r.batchSize, len(outdated))]
+		nodes, err := storage.FindNodes(ctx, r.nodes, ids)
+		if err != nil {
+			return err
+		}
+
+		events := make([]messagequeue.Message, 0, len(nodes))
+		for _, node := range nodes {
+			events = append(events, messages.PlanNodeMessage{
+				Action: "update",
+				Index:  res.Index,
+				Key:    nodeID(node),
+				Data:   nodeData(node),
+			})
+		}
+		if err := r.outbox.Enqueue(ctx, events...); err != nil {
+			return fmt.Errorf("failed to republish nodes: %w", err)
+		}
+		report.Republished += len(events)
+		metrics.ReconcileRepairs.WithLabelValues("republished").Add(float64(len(events)))
+	}
+
+	if len(report.Orphaned) == 0 {
+		return nil
+	}
+
+	indexer := elasticsearch.NewBulkIndexer(client, r.bulkConfig)
+	defer indexer.Close()
+
+	var failure error
+	deleted := 0
+	for start := 0; start < len(report.Orphaned); start += r.batchSize {
+		ids := report.Orphaned[start:min(start+r.batchSize, len(report.Orphaned))]
+		recreated, err := storage.FindNodes(ctx, r.nodes, ids)
+		if err != nil {
+			return err
+		}
+		exists := make(map[string]bool, len(recreated))
+		for _, node := range recreated {
+			exists[nodeID(node)] = true
+		}
+
+		for _, id := range ids {
+			if exists[id] {
+				continue
+			}
+			indexer.Add(elasticsearch.BulkOperation{
+				Action:  elasticsearch.BulkActionDelete,
+				ID:      id,
+				Routing: orphans[id],
+				Done: func(err error) {
+					// Done runs on the indexer worker, read only after Flush
+					if err != nil && failure == nil {
+						failure = fmt.Errorf("failed to delete orphaned document %s: %w", id, err)
+					} else if err == nil {
+						deleted++
+					}
+				},
+			})
+		}
+	}
+	indexer.Flush()
+
+	report.Deleted = deleted
+	metrics.ReconcileRepairs.WithLabelValues("deleted").Add(float64(deleted))
+	return failure
+}
+
+func nodeID(node map[string]interface{}) string {
+	id, _ := node["_id"].(string)
+	return id
+}
+
+/*
+nodeData strips the storage fields, leaving the node as the api service publishes it.
+*/
+func nodeData(node map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(node))
+	for k, v := range node {
+		data[k] = v
+	}
+	delete(data, "_id")
+	delete(data, "refCount")
+	delete(data, "referencedBy")
+	return data
+}
+
+/*
+contentHash hashes the JSON form of a document. The document goes through a JSON round trip
+first, so a Mongo node (int32, ...) and a decoded _source (float64, ...) hash the same.
+*/
+func contentHash(doc map[string]interface{}) (string, error) {
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode document: %w", err)
+	}
+	var normalized interface{}
+	if err := json.Unmarshal(encoded, &normalized); err != nil {
+		return "", err
+	}
+	// maps are encoded with sorted keys
+	if encoded, err = json.Marshal(normalized); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,50 @@
+package reindex
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Checkpoint records the progress of a reindex into one target index, so an interrupted run
+resumes after the last node whose batch was fully indexed.
+*/
+type Checkpoint struct {
+	Index     string    `bson:"_id"`
+	LastID    string    `bson:"lastId"`
+	Indexed   int64     `bson:"indexed"`
+	FailedIDs []string  `bson:"failedIds"`
+	Completed bool      `bson:"completed"`
+	StartedAt time.Time `bson:"startedAt"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+}
+
+type checkpointStore struct {
+	collection *mongo.Collection
+}
+
+/*
+load returns the checkpoint of the index, or nil when no run targeted it yet.
+*/
+func (s *checkpointStore) load(ctx context.Context, index string) (*Checkpoint, error) {
+	var checkpoint Checkpoint
+	err := s.collection.FindOne(ctx, bson.M{"_id": index}).Decode(&checkpoint)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (s *checkpointStore) save(ctx context.Context, checkpoint *Checkpoint) error {
+	checkpoint.UpdatedAt = time.Now()
+	_, err := s.collection.ReplaceOne(ctx, bson.M{"_id": checkpoint.Index}, checkpoint, options.Replace().SetUpsert(true))
+	return err
+}
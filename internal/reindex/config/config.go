@@ -0,0 +1,46 @@
+package config
+
+import (
+	"log"
+	"os"
+	"path"
+
+	esconfig "eric-cw-hsu.github.io/internal/elasticsearch/config"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Mongo struct {
+		URI      string
+		Database string
+	}
+	// NodeStore is the backend of the api-service, the reindex only reads MongoDB
+	NodeStore struct {
+		Backend string
+	} `mapstructure:"node_store"`
+	ElasticSearch esconfig.ElasticSearch
+	Reindex       struct {
+		BatchSize int `mapstructure:"batch_size"`
+	}
+}
+
+func Load() Config {
+	dir, _ := os.Getwd()
+
+	viper.SetConfigName("config")
+	viper.SetConfigType("yaml")
+	viper.AddConfigPath(".")
+	viper.AddConfigPath(path.Join(dir, "cmd/reindex"))
+	viper.AddConfigPath("config/")
+
+	if err := viper.ReadInConfig(); err != nil {
+		log.Fatalf("Failed to read config: %v", err)
+	}
+
+	var cfg Config
+	if err := viper.Unmarshal(&cfg); err != nil {
+		log.Fatalf("Unable to decode config into struct: %v", err)
+	}
+
+	return cfg
+}
@@ -0,0 +1,251 @@
+package reindex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/outbox"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+/*
+Migrator moves the index alias of the resource of its reindexer to a new version without downtime:
+  - the next version <alias>_vN is created from the resource mapping and backfilled from MongoDB
+    while the alias keeps serving the current version
+  - the outbox events recorded since the backfill started are replayed into the new version,
+    round after round until a round finds few new events
+  - writes to the current version are blocked, the events of the last round are replayed, and
+    the alias is swapped to the new version in one _aliases request before the block is lifted
+
+The consumer never writes to the new version while events are replayed into it, so a replayed
+event cannot overwrite a newer document. Its writes rejected by the block are retried, and land
+in the new version once the alias points to it.
+*/
+type Migrator struct {
+	reindexer *Reindexer
+	outbox    outbox.Store
+	client    *elasticsearch.Client
+}
+
+func NewMigrator(reindexer *Reindexer, outbox outbox.Store) *Migrator {
+	return &Migrator{
+		reindexer: reindexer,
+		outbox:    outbox,
+		client:    reindexer.client,
+	}
+}
+
+/*
+Migrate builds the next index version and swaps the alias to it, it returns the new index.
+With resume it continues the backfill of the latest version when the alias does not point to it yet.
+*/
+func (m *Migrator) Migrate(ctx context.Context, resume bool) (string, error) {
+	alias := m.reindexer.Alias()
+
+	current, err := m.client.AliasIndices(alias)
+	if err != nil {
+		return "", err
+	}
+	latest, err := m.client.LatestIndexVersion(alias)
+	if err != nil {
+		return "", err
+	}
+
+	target := elasticsearch.VersionedIndexName(alias, latest+1)
+	if resume {
+		target = elasticsearch.VersionedIndexName(alias, latest)
+		for _, index := range current {
+			if index == target {
+				return "", fmt.Errorf("alias %s already points to %s, nothing to resume", alias, target)
+			}
+		}
+	}
+	logger.Logger.Info("Migrating index alias", zap.String("alias", alias), zap.Strings("from", current), zap.String("to", target))
+
+	checkpoint, err := m.reindexer.Run(ctx, target, resume)
+	if err != nil {
+		return target, fmt.Errorf("backfill of %s stopped: %w", target, err)
+	}
+	if len(checkpoint.FailedIDs) > 0 {
+		return target, fmt.Errorf("backfill of %s rejected %d nodes, the alias was not swapped", target, len(checkpoint.FailedIDs))
+	}
+
+	since, replayed, err := m.catchUp(ctx, target, checkpoint.StartedAt)
+	if err != nil {
+		return target, fmt.Errorf("replaying outbox events into %s failed, the alias was not swapped: %w", target, err)
+	}
+
+	fenced, err := m.fencedIndices(alias, current)
+	if err != nil {
+		return target, err
+	}
+	if err := m.client.SetWriteBlock(fenced, true); err != nil {
+		return target, err
+	}
+	// the block is lifted on every path, the previous versions are kept for rollback
+	defer func() {
+		if err := m.client.SetWriteBlock(fenced, false); err != nil {
+			logger.Logger.Error("Failed to lift the write block", zap.Strings("indices", fenced), zap.Error(err))
+		}
+	}()
+
+	last, err := m.replayOutbox(ctx, target, since.Add(-replayOverlap), time.Now())
+	if err != nil {
+		return target, fmt.Errorf("replaying outbox events into %s failed, the alias was not swapped: %w", target, err)
+	}
+	if err := m.client.SwapAlias(alias, target, current); err != nil {
+		return target, err
+	}
+	// a concrete index named like the alias was removed by the swap
+	fenced = current
+
+	logger.Logger.Info("Index alias migrated", zap.String("alias", alias), zap.String("index", target), zap.Int("replayed", replayed+last))
+	return target, nil
+}
+
+const (
+	// catch-up rounds stop once a round replays fewer events, the rest is replayed under the write block
+	catchUpThreshold = 100
+	maxCatchUpRounds = 10
+
+	/*
+		replayOverlap widens each round back in time, covering events enqueued in a transaction
+		that committed after the previous round read the outbox. Replaying an event again is safe:
+		every round applies its events in order, so a document ends at its latest event.
+	*/
+	replayOverlap = 5 * time.Second
+)
+
+/*
+catchUp replays the outbox events enqueued since the backfill started into the index, while the
+alias still serves the current version. It returns the time the last round replayed up to.
+*/
+func (m *Migrator) catchUp(ctx context.Context, index string, since time.Time) (time.Time, int, error) {
+	total := 0
+	from := since
+	for round := 1; round <= maxCatchUpRounds; round++ {
+		until := time.Now()
+		replayed, err := m.replayOutbox(ctx, index, from, until)
+		if err != nil {
+			return since, total, err
+		}
+		total += replayed
+		since = until
+		from = until.Add(-replayOverlap)
+
+		logger.Logger.Info("Outbox events replayed", zap.String("index", index), zap.Int("round", round), zap.Int("replayed", replayed))
+		if replayed < catchUpThreshold {
+			break
+		}
+	}
+	return since, total, nil
+}
+
+/*
+fencedIndices returns the indices to block while the last events are replayed: the current versions,
+or the concrete index named like the alias that the first migration replaces.
+*/
+func (m *Migrator) fencedIndices(alias string, current []string) ([]string, error) {
+	if len(current) > 0 {
+		return current, nil
+	}
+	exists, err := m.client.IndexExists(alias)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return []string{alias}, nil
+}
+
+/*
+replayOutbox applies, in order, the node events of the resource enqueued between since and until
+to the index.
+*/
+func (m *Migrator) replayOutbox(ctx context.Context, index string, since, until time.Time) (int, error) {
+	indexer := elasticsearch.NewBulkIndexer(m.client.WithIndex(index), m.reindexer.bulkConfig)
+	defer indexer.Close()
+	indices := elasticsearch.NewResourceIndices(resource.NewDefaultRegistry())
+	target, err := indices.Resolve(m.reindexer.resource.Index)
+	if err != nil {
+		return 0, err
+	}
+
+	var failure error
+	replayed := 0
+	after := primitive.NilObjectID
+	for {
+		entries, err := m.outbox.FetchCreated(ctx, since, until, after, m.reindexer.batchSize)
+		if err != nil {
+			return replayed, err
+		}
+
+		for _, entry := range entries {
+			op, err := replayOperation(entry, indices, target)
+			if errors.Is(err, errOtherResource) {
+				continue
+			}
+			if err != nil {
+				logger.Logger.Warn("Skipping outbox entry", zap.String("id", entry.ID.Hex()), zap.Error(err))
+				continue
+			}
+			op.Done = func(err error) {
+				// Done runs on the indexer worker, read only after Flush
+				if err != nil && failure == nil {
+					failure = fmt.Errorf("failed to replay %s of %s: %w", op.Action, op.ID, err)
+				}
+			}
+			indexer.Add(op)
+			replayed++
+		}
+
+		if len(entries) < m.reindexer.batchSize {
+			break
+		}
+		after = entries[len(entries)-1].ID
+	}
+
+	indexer.Flush()
+	return replayed, failure
+}
+
+// errOtherResource is returned by replayOperation for the events of another resource than the migrated one
+var errOtherResource = errors.New("event of another resource")
+
+/*
+replayOperation returns the bulk operation of an outbox entry, or errOtherResource when its event
+is not written to target (see ResourceIndices.Resolve).
+*/
+func replayOperation(entry outbox.Entry, indices elasticsearch.ResourceIndices, target string) (elasticsearch.BulkOperation, error) {
+	var base messagequeue.BaseMessage
+	if err := json.Unmarshal(entry.Payload, &base); err != nil {
+		return elasticsearch.BulkOperation{}, err
+	}
+	msg, err := elasticsearch.ParseRabbitMQPlanMessage(base.Body)
+	if err != nil {
+		return elasticsearch.BulkOperation{}, err
+	}
+	if index, err := indices.Resolve(msg.Index); err != nil || index != target {
+		return elasticsearch.BulkOperation{}, errOtherResource
+	}
+
+	if msg.Action == "delete" {
+		return elasticsearch.BulkOperation{
+			Action:  elasticsearch.BulkActionDelete,
+			ID:      msg.Key,
+			Routing: elasticsearch.DocumentRouting(msg.Data),
+		}, nil
+	}
+	return elasticsearch.BulkOperation{
+		Action:   elasticsearch.BulkActionIndex,
+		ID:       msg.Key,
+		Routing:  elasticsearch.DocumentRouting(msg.Data),
+		Document: elasticsearch.BuildDocument(msg.Data),
+	}, nil
+}
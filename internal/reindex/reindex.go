@@ -0,0 +1,227 @@
+package reindex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"eric-cw-hsu.github.io/internal/elasticsearch"
+	"eric-cw-hsu.github.io/internal/objectstore/storage"
+	"eric-cw-hsu.github.io/internal/resource"
+	"eric-cw-hsu.github.io/internal/shared/logger"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const DefaultBatchSize = 500
+
+var ErrIndexExists = errors.New("target index already exists")
+
+/*
+Reindexer rebuilds the Elasticsearch index of one resource type from the nodes stored in MongoDB.
+The roots of the resource (see resource.Resource) are read in id order, a batch at a time, and
+their subgraphs are turned into documents exactly like the consumer does (elasticsearch.BuildDocument
+and DocumentRouting), then bulk-loaded into the target index. After every batch the last root id is
+checkpointed, so a run can be resumed. A node shared by roots of several batches is indexed again
+with each of them.
+*/
+type Reindexer struct {
+	resource    *resource.Resource
+	nodes       *mongo.Collection
+	checkpoints *checkpointStore
+	client      *elasticsearch.Client
+	bulkConfig  elasticsearch.BulkConfig
+	batchSize   int
+}
+
+/*
+NewReindexer returns a reindexer of the resource, client being the client of the configured
+plan index: the reindexer works on the index alias of the resource (see Client.ForResource).
+*/
+func NewReindexer(
+	resource *resource.Resource,
+	nodes, checkpoints *mongo.Collection,
+	client *elasticsearch.Client,
+	bulkConfig elasticsearch.BulkConfig,
+	batchSize int,
+) *Reindexer {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	return &Reindexer{
+		resource:    resource,
+		nodes:       nodes,
+		checkpoints: &checkpointStore{collection: checkpoints},
+		client:      client.ForResource(resource),
+		bulkConfig:  bulkConfig,
+		batchSize:   batchSize,
+	}
+}
+
+/*
+Alias returns the index alias of the resource, which the target index versions are named after.
+*/
+func (r *Reindexer) Alias() string {
+	return r.client.Index()
+}
+
+/*
+Run indexes the nodes of the resource into the target index and returns the final checkpoint.
+Without resume the target index must not exist yet, it is created with the resource mapping.
+With resume the run continues from the checkpoint of the target index.
+Documents rejected by Elasticsearch (4xx) are recorded in the checkpoint and skipped,
+any other failure stops the run before the checkpoint moves past the failed batch.
+*/
+func (r *Reindexer) Run(ctx context.Context, index string, resume bool) (*Checkpoint, error) {
+	checkpoint, err := r.prepare(ctx, index, resume)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint.Completed {
+		logger.Logger.Info("Reindex already completed", zap.String("index", index))
+		return checkpoint, nil
+	}
+
+	total, err := r.nodes.CountDocuments(ctx, bson.M{"fieldName": r.resource.RootField})
+	if err != nil {
+		return checkpoint, fmt.Errorf("failed to count the roots of %s: %w", r.resource.Name, err)
+	}
+
+	indexer := elasticsearch.NewBulkIndexer(r.client.WithIndex(index), r.bulkConfig)
+	defer indexer.Close()
+
+	started := time.Now()
+	processed, walked := int64(0), int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return checkpoint, err
+		}
+
+		roots, err := storage.ScanRoots(ctx, r.nodes, r.resource.RootField, checkpoint.LastID, r.batchSize)
+		if err != nil {
+			return checkpoint, fmt.Errorf("failed to read roots after %q: %w", checkpoint.LastID, err)
+		}
+		if len(roots) == 0 {
+			break
+		}
+		subgraphs, err := storage.FindSubgraphs(ctx, r.nodes, roots)
+		if err != nil {
+			return checkpoint, fmt.Errorf("failed to read the nodes of roots after %q: %w", checkpoint.LastID, err)
+		}
+		nodes := make([]map[string]interface{}, 0, len(subgraphs))
+		for _, node := range subgraphs {
+			nodes = append(nodes, node)
+		}
+
+		rejected, err := r.indexBatch(indexer, nodes)
+		if err != nil {
+			return checkpoint, err
+		}
+
+		checkpoint.LastID = roots[len(roots)-1]["_id"].(string)
+		checkpoint.Indexed += int64(len(nodes) - len(rejected))
+		checkpoint.FailedIDs = append(checkpoint.FailedIDs, rejected...)
+		if err := r.checkpoints.save(ctx, checkpoint); err != nil {
+			return checkpoint, fmt.Errorf("failed to save checkpoint: %w", err)
+		}
+
+		processed += int64(len(nodes))
+		walked += int64(len(roots))
+		logger.Logger.Info("Reindex progress",
+			zap.String("index", index),
+			zap.Int64("indexed", checkpoint.Indexed),
+			zap.Int("failed", len(checkpoint.FailedIDs)),
+			zap.Int64("roots", walked),
+			zap.Int64("totalRoots", total),
+			zap.Float64("nodesPerSecond", float64(processed)/time.Since(started).Seconds()),
+		)
+	}
+
+	checkpoint.Completed = true
+	if err := r.checkpoints.save(ctx, checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+
+	logger.Logger.Info("Reindex completed",
+		zap.String("index", index),
+		zap.Int64("indexed", checkpoint.Indexed),
+		zap.Int("failed", len(checkpoint.FailedIDs)),
+		zap.Duration("elapsed", time.Since(started)),
+	)
+	return checkpoint, nil
+}
+
+func (r *Reindexer) prepare(ctx context.Context, index string, resume bool) (*Checkpoint, error) {
+	if resume {
+		checkpoint, err := r.checkpoints.load(ctx, index)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load checkpoint: %w", err)
+		}
+		if checkpoint == nil {
+			return nil, fmt.Errorf("no checkpoint found for index %s", index)
+		}
+		logger.Logger.Info("Resuming reindex", zap.String("index", index), zap.String("after", checkpoint.LastID), zap.Int64("indexed", checkpoint.Indexed))
+		return checkpoint, nil
+	}
+
+	exists, err := r.client.IndexExists(index)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("%w: %s", ErrIndexExists, index)
+	}
+	if err := r.client.CreateIndex(index, r.resource.Mapping); err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{Index: index, FailedIDs: []string{}, StartedAt: time.Now()}
+	if err := r.checkpoints.save(ctx, checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return checkpoint, nil
+}
+
+/*
+indexBatch indexes the nodes and waits until every operation is settled.
+It returns the ids of the documents Elasticsearch rejected, or an error when some
+operation failed for another reason and the batch has to be retried.
+*/
+func (r *Reindexer) indexBatch(indexer *elasticsearch.BulkIndexer, nodes []map[string]interface{}) ([]string, error) {
+	var (
+		mu       sync.Mutex
+		rejected []string
+		failure  error
+	)
+
+	for _, node := range nodes {
+		id := node["_id"].(string)
+		indexer.Add(elasticsearch.BulkOperation{
+			Action:   elasticsearch.BulkActionIndex,
+			ID:       id,
+			Routing:  elasticsearch.DocumentRouting(node),
+			Document: elasticsearch.BuildDocument(node),
+			Done: func(err error) {
+				if err == nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if elasticsearch.IsClientError(err) {
+					rejected = append(rejected, id)
+				} else if failure == nil {
+					failure = fmt.Errorf("failed to index node %s: %w", id, err)
+				}
+			},
+		})
+	}
+	indexer.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return rejected, failure
+}
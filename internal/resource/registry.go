@@ -0,0 +1,126 @@
+package resource
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"eric-cw-hsu.github.io/internal/api/schema"
+	"eric-cw-hsu.github.io/internal/elasticsearch/mappings"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Plans is the name of the plan resource, registered by NewDefaultRegistry
+const Plans = "plans"
+
+var ErrInvalidResource = errors.New("invalid resource")
+
+// reserved are the path segments of /v1 routes that are not resources
+var reserved = map[string]bool{"nodes": true}
+
+/*
+Resource is a type of document stored as a graph of nodes, like a plan. Its documents are
+validated against Schema, extracted into nodes whose root gets RootField as fieldName, and their
+node events name Index, the Elasticsearch index created with Mapping.
+*/
+type Resource struct {
+	// Name is the path segment of the resource routes, /v1/<Name>/:id
+	Name      string
+	RootField string
+	Schema    string
+	Mapping   string
+	// Index defaults to Name
+	Index string
+}
+
+/*
+Registry holds the resource types served by the API and indexed by the Elasticsearch service.
+*/
+type Registry struct {
+	mu        sync.RWMutex
+	resources map[string]*Resource
+	order     []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		resources: make(map[string]*Resource),
+	}
+}
+
+/*
+NewDefaultRegistry returns the resources served by the API service and indexed by the Elasticsearch
+service, both build their registry here, so a new resource type is registered in this function.
+*/
+func NewDefaultRegistry() *Registry {
+	registry := NewRegistry()
+	if err := registry.Register(Resource{
+		Name:      Plans,
+		RootField: "plan",
+		Schema:    schema.GetPlanJsonSchema(),
+		Mapping:   mappings.GetPlanMapping(),
+		Index:     "plans",
+	}); err != nil {
+		panic(err)
+	}
+	return registry
+}
+
+/*
+Register adds a resource type. The name and the root field must be unused, since the roots of
+every resource are listed by their fieldName, and the schema must compile.
+*/
+func (r *Registry) Register(resource Resource) error {
+	if resource.Name == "" || resource.RootField == "" || resource.Schema == "" || resource.Mapping == "" {
+		return fmt.Errorf("%w: name, root field, schema and mapping are required", ErrInvalidResource)
+	}
+	if reserved[resource.Name] {
+		return fmt.Errorf("%w: %s is a reserved path", ErrInvalidResource, resource.Name)
+	}
+	if _, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(resource.Schema)); err != nil {
+		return fmt.Errorf("%w: schema of %s: %v", ErrInvalidResource, resource.Name, err)
+	}
+	if resource.Index == "" {
+		resource.Index = resource.Name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, registered := range r.resources {
+		switch {
+		case registered.Name == resource.Name:
+			return fmt.Errorf("%w: %s is already registered", ErrInvalidResource, resource.Name)
+		case registered.RootField == resource.RootField:
+			return fmt.Errorf("%w: root field %s is already used by %s", ErrInvalidResource, resource.RootField, registered.Name)
+		case registered.Index == resource.Index:
+			return fmt.Errorf("%w: index %s is already used by %s", ErrInvalidResource, resource.Index, registered.Name)
+		}
+	}
+
+	r.resources[resource.Name] = &resource
+	r.order = append(r.order, resource.Name)
+	return nil
+}
+
+func (r *Registry) Get(name string) (*Resource, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	resource, ok := r.resources[name]
+	return resource, ok
+}
+
+/*
+All returns the registered resources in registration order.
+*/
+func (r *Registry) All() []*Resource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	resources := make([]*Resource, 0, len(r.order))
+	for _, name := range r.order {
+		resources = append(resources, r.resources[name])
+	}
+	return resources
+}
@@ -0,0 +1,45 @@
+/*
+Package resourcetest holds the documents shared by the tests of the stores, the services and the handlers.
+*/
+package resourcetest
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const planTemplate = `{
+	"planCostShares": {"deductible": 2000, "_org": "example.com", "copay": 23, "objectId": "<id>-cost", "objectType": "membercostshare"},
+	"linkedPlanServices": [{
+		"linkedService": {"_org": "example.com", "objectId": "<service>", "objectType": "service", "name": "Yearly physical"},
+		"planserviceCostShares": {"deductible": 10, "_org": "example.com", "copay": 0, "objectId": "<id>-service-cost", "objectType": "membercostshare"},
+		"_org": "example.com",
+		"objectId": "<id>-planservice",
+		"objectType": "planservice"
+	}],
+	"_org": "example.com",
+	"objectId": "<id>",
+	"objectType": "plan",
+	"planType": "inNetwork",
+	"creationDate": "12-12-2017"
+}`
+
+/*
+PlanJSON returns a plan valid against the plan schema, whose linked service has the given
+objectId so two plans can share it. Its other nodes are <id>-cost, <id>-planservice and
+<id>-service-cost.
+*/
+func PlanJSON(id, serviceId string) string {
+	return strings.NewReplacer("<id>", id, "<service>", serviceId).Replace(planTemplate)
+}
+
+/*
+Plan returns PlanJSON decoded, numbers as float64 like a request body.
+*/
+func Plan(id, serviceId string) map[string]interface{} {
+	plan := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(PlanJSON(id, serviceId)), &plan); err != nil {
+		panic(err)
+	}
+	return plan
+}
@@ -1,5 +1,7 @@
 package apperror
 
+import "strings"
+
 func NewETagRequiredError() *AppError {
 	return &AppError{
 		Code:       "ETAG_REQUIRED",
@@ -26,3 +28,12 @@ func NewInvalidJSONError(err error) *AppError {
 		Details:    err.Error(),
 	}
 }
+
+func NewUnsupportedMediaTypeError(contentType string, supported ...string) *AppError {
+	return &AppError{
+		Code:       "UNSUPPORTED_MEDIA_TYPE",
+		StatusCode: 415,
+		Message:    "Unsupported Content-Type",
+		Details:    "Content-Type " + contentType + " is not supported, use one of: " + strings.Join(supported, ", ") + ".",
+	}
+}
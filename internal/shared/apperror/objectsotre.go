@@ -8,3 +8,30 @@ func NewJSONMergeError(err error) *AppError {
 		Details:    err.Error(),
 	}
 }
+
+func NewJSONPatchError(err error) *AppError {
+	return &AppError{
+		Code:       "JSON_PATCH_ERROR",
+		StatusCode: 400,
+		Message:    "Failed to apply JSON patch",
+		Details:    err.Error(),
+	}
+}
+
+func NewJSONPatchTestFailedError(err error) *AppError {
+	return &AppError{
+		Code:       "JSON_PATCH_TEST_FAILED",
+		StatusCode: 409,
+		Message:    "JSON patch test operation failed",
+		Details:    err.Error(),
+	}
+}
+
+func NewObjectIdChangedError(id string) *AppError {
+	return &AppError{
+		Code:       "OBJECT_ID_CHANGED",
+		StatusCode: 400,
+		Message:    "The objectId of a plan cannot be changed",
+		Details:    "The updated plan must keep the objectId " + id + ".",
+	}
+}
@@ -17,3 +17,66 @@ func NewPlanNotFoundError(err error) *AppError {
 		Details:    err.Error(),
 	}
 }
+
+func NewPlanVersionNotFoundError(err error) *AppError {
+	return &AppError{
+		Code:       "PLAN_VERSION_NOT_FOUND",
+		StatusCode: 404,
+		Message:    "Plan version not found",
+		Details:    err.Error(),
+	}
+}
+
+func NewInvalidVersionQueryError(err error) *AppError {
+	return &AppError{
+		Code:       "INVALID_VERSION_QUERY",
+		StatusCode: 400,
+		Message:    "Invalid plan version query",
+		Details:    err.Error(),
+	}
+}
+
+func NewPlanExistsPreconditionError(id string) *AppError {
+	return &AppError{
+		Code:       "PLAN_EXISTS",
+		StatusCode: 412,
+		Message:    "Plan already exists",
+		Details:    "If-None-Match: * forbids overwriting the existing plan " + id + ".",
+	}
+}
+
+func NewPlanModifiedError(id string) *AppError {
+	return &AppError{
+		Code:       "PLAN_MODIFIED",
+		StatusCode: 412,
+		Message:    "Plan was modified concurrently",
+		Details:    "Another write changed plan " + id + " after its ETag was checked, fetch it again and retry.",
+	}
+}
+
+func NewInvalidListQueryError(err error) *AppError {
+	return &AppError{
+		Code:       "INVALID_LIST_QUERY",
+		StatusCode: 400,
+		Message:    "Invalid plan list query",
+		Details:    err.Error(),
+	}
+}
+
+func NewPlanNodeNotFoundError(err error) *AppError {
+	return &AppError{
+		Code:       "PLAN_NODE_NOT_FOUND",
+		StatusCode: 404,
+		Message:    "Plan node not found",
+		Details:    err.Error(),
+	}
+}
+
+func NewRootNodeDeleteError(id string) *AppError {
+	return &AppError{
+		Code:       "ROOT_NODE_DELETE",
+		StatusCode: 400,
+		Message:    "Cannot delete the root node of a plan",
+		Details:    "Node " + id + " is the plan itself, delete it with DELETE /v1/plans/" + id + ".",
+	}
+}
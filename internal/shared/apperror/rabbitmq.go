@@ -8,3 +8,30 @@ func NewRabbitMQFailPublishError(err error) *AppError {
 		Details:    err.Error(),
 	}
 }
+
+func NewRabbitMQNackError(err error) *AppError {
+	return &AppError{
+		Code:       "RABBITMQ_NACK",
+		StatusCode: 502,
+		Message:    "RabbitMQ rejected the plan event",
+		Details:    err.Error(),
+	}
+}
+
+func NewRabbitMQUnroutableError(err error) *AppError {
+	return &AppError{
+		Code:       "RABBITMQ_UNROUTABLE",
+		StatusCode: 502,
+		Message:    "RabbitMQ could not route the plan event to any queue",
+		Details:    err.Error(),
+	}
+}
+
+func NewRabbitMQConfirmTimeoutError(err error) *AppError {
+	return &AppError{
+		Code:       "RABBITMQ_CONFIRM_TIMEOUT",
+		StatusCode: 504,
+		Message:    "RabbitMQ did not confirm the plan event in time",
+		Details:    err.Error(),
+	}
+}
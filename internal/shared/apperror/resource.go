@@ -0,0 +1,10 @@
+package apperror
+
+func NewResourceTypeNotFoundError(resourceType string) *AppError {
+	return &AppError{
+		Code:       "RESOURCE_TYPE_NOT_FOUND",
+		StatusCode: 404,
+		Message:    "Resource type not found",
+		Details:    "No resource type " + resourceType + " is registered.",
+	}
+}
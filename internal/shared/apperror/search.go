@@ -0,0 +1,19 @@
+package apperror
+
+func NewInvalidSearchQueryError(err error) *AppError {
+	return &AppError{
+		Code:       "INVALID_SEARCH_QUERY",
+		StatusCode: 400,
+		Message:    "Invalid search query",
+		Details:    err.Error(),
+	}
+}
+
+func NewSearchError(err error) *AppError {
+	return &AppError{
+		Code:       "SEARCH_ERROR",
+		StatusCode: 500,
+		Message:    "Failed to search plans",
+		Details:    err.Error(),
+	}
+}
@@ -1,53 +1,180 @@
 package messagequeue
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
 
 	"eric-cw-hsu.github.io/internal/shared/logger"
 	"github.com/rabbitmq/amqp091-go"
 	"go.uber.org/zap"
 )
 
+const (
+	retryCountHeader = "x-retry-count"
+	defaultPrefetch  = 10
+)
+
 type HandlerFunc func(body json.RawMessage) error
 
+/*
+AsyncHandlerFunc handles a message without blocking the delivery loop. It must call done
+once with the outcome, which acks, retries or dead-letters the delivery like a HandlerFunc error.
+*/
+type AsyncHandlerFunc func(body json.RawMessage, done func(error))
+
+/*
+Consumer consumes a queue with manual acknowledgements.
+A message is acked when its handler succeeds. A failed message is republished to a delay
+queue whose TTL dead-letters it back to the main queue after the policy's backoff, and once
+the retries are exhausted (or the error is permanent) it is rejected into the dead-letter queue.
+The channel is in confirm mode, a failed message is acked only once the broker confirmed its copy
+in the delay queue.
+
+For a queue named "plans" on exchange "plans" the topology is:
+  - plans                main queue, dead-letters rejected messages to exchange "plans.dlx"
+  - plans.retry.<ttl>ms  delay queue of one backoff, dead-letters back to "plans" after its TTL
+  - plans.dlx            dead-letter exchange, routing to queue "plans.dlq"
+
+The TTL is part of the delay queue name since a queue cannot be redeclared with other arguments:
+a changed retry policy declares new delay queues instead of failing on the existing ones.
+*/
 type Consumer struct {
-	channel    *amqp091.Channel
-	queueName  string
-	handlerMap map[string]HandlerFunc
+	mu          sync.Mutex
+	channel     *amqp091.Channel
+	started     bool
+	exchange    string
+	queueName   string
+	routingKeys []string
+	prefetch    int
+	retryPolicy RetryPolicy
+	handlerMap  map[string]AsyncHandlerFunc
+}
+
+/*
+NewConsumer creates a consumer for the queue, it consumes once a channel is bound
+(see rabbitmq.MQConnection.Attach) and Start has been called.
+prefetch bounds the unacked deliveries in flight, it defaults to 10.
+*/
+func NewConsumer(exchange, queueName string, prefetch int, retryPolicy RetryPolicy, routingKeys ...string) *Consumer {
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
+	}
+
+	return &Consumer{
+		exchange:    exchange,
+		queueName:   queueName,
+		routingKeys: routingKeys,
+		prefetch:    prefetch,
+		retryPolicy: retryPolicy.WithDefaults(),
+		handlerMap:  make(map[string]AsyncHandlerFunc),
+	}
 }
 
-func NewConsumer(channel *amqp091.Channel, exchange, queueName string, routingKeys ...string) (*Consumer, error) {
-	if err := channel.ExchangeDeclare(exchange, "direct", true, false, false, false, nil); err != nil {
-		return nil, err
+/*
+Bind declares the consumer topology on the channel and, when the consumer is already started,
+resumes consuming on it. Unacked deliveries of a lost channel are redelivered by the broker.
+*/
+func (c *Consumer) Bind(channel *amqp091.Channel) error {
+	if err := c.declareTopology(channel); err != nil {
+		return err
+	}
+
+	if err := channel.Qos(c.prefetch, 0, false); err != nil {
+		return err
+	}
+	if err := channel.Confirm(false); err != nil {
+		return fmt.Errorf("failed to enable confirm mode: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channel = channel
+	if c.started {
+		return c.consume(channel)
+	}
+	return nil
+}
+
+func (c *Consumer) declareTopology(channel *amqp091.Channel) error {
+	if err := channel.ExchangeDeclare(c.exchange, "direct", true, false, false, false, nil); err != nil {
+		return err
 	}
 
-	q, err := channel.QueueDeclare(queueName, true, false, false, false, nil)
+	deadLetterExchange := c.exchange + ".dlx"
+	if err := channel.ExchangeDeclare(deadLetterExchange, "direct", true, false, false, false, nil); err != nil {
+		return err
+	}
+	deadLetterQueue, err := channel.QueueDeclare(c.queueName+".dlq", true, false, false, false, nil)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if err := channel.QueueBind(deadLetterQueue.Name, c.queueName, deadLetterExchange, false, nil); err != nil {
+		return err
 	}
 
-	for _, key := range routingKeys {
-		if err := channel.QueueBind(q.Name, key, exchange, false, nil); err != nil {
-			return nil, err
+	q, err := channel.QueueDeclare(c.queueName, true, false, false, false, amqp091.Table{
+		"x-dead-letter-exchange":    deadLetterExchange,
+		"x-dead-letter-routing-key": c.queueName,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range c.routingKeys {
+		if err := channel.QueueBind(q.Name, key, c.exchange, false, nil); err != nil {
+			return err
 		}
 	}
 
-	return &Consumer{
-		channel:    channel,
-		queueName:  queueName,
-		handlerMap: make(map[string]HandlerFunc),
-	}, nil
+	// one delay queue per backoff of the policy, attempts capped by MaxBackoff share one
+	for attempt := 0; attempt < c.retryPolicy.MaxRetries; attempt++ {
+		backoff := c.retryPolicy.Backoff(attempt)
+		if _, err := channel.QueueDeclare(retryQueueName(c.queueName, backoff), true, false, false, false, amqp091.Table{
+			"x-message-ttl":             backoff.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": c.queueName,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func retryQueueName(queueName string, backoff time.Duration) string {
+	return fmt.Sprintf("%s.retry.%dms", queueName, backoff.Milliseconds())
 }
 
 func (c *Consumer) RegisterHandler(msgType string, handler HandlerFunc) {
+	c.handlerMap[msgType] = func(body json.RawMessage, done func(error)) {
+		done(handler(body))
+	}
+}
+
+func (c *Consumer) RegisterAsyncHandler(msgType string, handler AsyncHandlerFunc) {
 	c.handlerMap[msgType] = handler
 }
 
 func (c *Consumer) Start() error {
-	msgs, err := c.channel.Consume(
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channel == nil {
+		return amqp091.ErrClosed
+	}
+	c.started = true
+	return c.consume(c.channel)
+}
+
+// consume must be called with c.mu held
+func (c *Consumer) consume(channel *amqp091.Channel) error {
+	msgs, err := channel.Consume(
 		c.queueName,
 		"",
-		true,
+		false,
 		false,
 		false,
 		false,
@@ -59,29 +186,143 @@ func (c *Consumer) Start() error {
 
 	go func() {
 		for d := range msgs {
-			var baseMsg BaseMessage
-			if err := json.Unmarshal(d.Body, &baseMsg); err != nil {
-				logger.Logger.Error("Failed to unmarshal message", zap.Error(err))
-				continue
-			}
-
-			handler, ok := c.handlerMap[baseMsg.Type]
-			if !ok {
-				logger.Logger.Error("No handler found for message type", zap.String("type", baseMsg.Type))
-				continue
-			}
-
-			if err := handler(baseMsg.Body); err != nil {
-				logger.Logger.Error("Failed to handle message", zap.Error(err))
-				continue
-			}
+			c.handleDelivery(d)
 		}
+		logger.Logger.Warn("Consumer delivery channel closed", zap.String("queue", c.queueName))
 	}()
 
 	return nil
 }
 
+func (c *Consumer) handleDelivery(d amqp091.Delivery) {
+	var baseMsg BaseMessage
+	if err := json.Unmarshal(d.Body, &baseMsg); err != nil {
+		logger.Logger.Error("Failed to unmarshal message", zap.Error(err))
+		c.deadLetter(d)
+		return
+	}
+
+	handler, ok := c.handlerMap[baseMsg.Type]
+	if !ok {
+		logger.Logger.Error("No handler found for message type", zap.String("type", baseMsg.Type))
+		c.deadLetter(d)
+		return
+	}
+
+	var once sync.Once
+	handler(baseMsg.Body, func(err error) {
+		once.Do(func() { c.settle(d, baseMsg.Type, err) })
+	})
+}
+
+func (c *Consumer) settle(d amqp091.Delivery, msgType string, err error) {
+	if err != nil {
+		logger.Logger.Error("Failed to handle message", zap.String("type", msgType), zap.Error(err))
+		c.retry(d, err)
+		return
+	}
+
+	if err := d.Ack(false); err != nil {
+		logger.Logger.Error("Failed to ack message", zap.Error(err))
+	}
+}
+
+/*
+retry republishes the delivery to the delay queue of its next attempt and acks the original once
+the broker confirmed the copy, or dead-letters it when the error is permanent or the retries are
+exhausted. When the copy is not confirmed the original is requeued, so the message is never lost
+but can be handled twice.
+*/
+func (c *Consumer) retry(d amqp091.Delivery, cause error) {
+	attempt := retryCount(d)
+	if IsPermanent(cause) || attempt >= c.retryPolicy.MaxRetries {
+		logger.Logger.Warn("Dead-lettering message", zap.Int("attempts", attempt), zap.Bool("permanent", IsPermanent(cause)))
+		c.deadLetter(d)
+		return
+	}
+
+	headers := amqp091.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(attempt + 1)
+	headers["x-last-error"] = cause.Error()
+
+	c.mu.Lock()
+	channel := c.channel
+	c.mu.Unlock()
+
+	backoff := c.retryPolicy.Backoff(attempt)
+	if err := publishConfirmed(channel, retryQueueName(c.queueName, backoff), amqp091.Publishing{
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp091.Persistent,
+		Headers:      headers,
+		Body:         d.Body,
+	}); err != nil {
+		// could not schedule the retry, let the broker redeliver it instead of losing it
+		logger.Logger.Error("Failed to schedule retry, requeueing message", zap.Error(err))
+		if err := d.Nack(false, true); err != nil {
+			logger.Logger.Error("Failed to nack message", zap.Error(err))
+		}
+		return
+	}
+
+	logger.Logger.Info("Scheduled message retry", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff))
+	if err := d.Ack(false); err != nil {
+		logger.Logger.Error("Failed to ack message", zap.Error(err))
+	}
+}
+
+/*
+publishConfirmed publishes the message to the queue through the default exchange and waits for
+the broker to confirm it.
+*/
+func publishConfirmed(channel *amqp091.Channel, queue string, msg amqp091.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultConfirmTimeout)
+	defer cancel()
+
+	confirmation, err := channel.PublishWithDeferredConfirmWithContext(ctx, "", queue, false, false, msg)
+	if err != nil {
+		return err
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrConfirmTimeout, queue, err)
+	}
+	if !acked {
+		return fmt.Errorf("%w: %s", ErrPublishNacked, queue)
+	}
+	return nil
+}
+
+func (c *Consumer) deadLetter(d amqp091.Delivery) {
+	if err := d.Nack(false, false); err != nil {
+		logger.Logger.Error("Failed to reject message", zap.Error(err))
+	}
+}
+
+func retryCount(d amqp091.Delivery) int {
+	switch v := d.Headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
 func (c *Consumer) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channel == nil {
+		return
+	}
+
 	logger.Logger.Info("Closing consumer channel")
 	if err := c.channel.Close(); err != nil {
 		logger.Logger.Error("Failed to close consumer channel", zap.Error(err))
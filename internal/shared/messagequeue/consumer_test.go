@@ -0,0 +1,22 @@
+package messagequeue
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryQueueNames(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, InitialBackoff: time.Second, Multiplier: 2, MaxBackoff: 5 * time.Second}
+
+	names := []string{}
+	for attempt := 0; attempt < policy.MaxRetries; attempt++ {
+		names = append(names, retryQueueName("plans", policy.Backoff(attempt)))
+	}
+
+	// the attempts capped by MaxBackoff share the delay queue of MaxBackoff
+	want := "[plans.retry.1000ms plans.retry.2000ms plans.retry.4000ms plans.retry.5000ms plans.retry.5000ms]"
+	if fmt.Sprint(names) != want {
+		t.Errorf("delay queues = %v, want %s", names, want)
+	}
+}
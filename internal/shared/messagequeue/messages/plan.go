@@ -1,12 +1,20 @@
 package messages
 
-import "eric-cw-hsu.github.io/internal/shared/messagequeue"
+import (
+	"eric-cw-hsu.github.io/internal/objectstore/graph"
+	"eric-cw-hsu.github.io/internal/shared/messagequeue"
+)
 
+/*
+PlanNodeMessage is the event of one written node. The events of a plan update carry in Changes
+what the update changed in the node, they have none when the node was left unchanged.
+*/
 type PlanNodeMessage struct {
-	Action string                 `json:"action"`
-	Index  string                 `json:"index"`
-	Key    string                 `json:"key"`
-	Data   map[string]interface{} `json:"data"`
+	Action  string                 `json:"action"`
+	Index   string                 `json:"index"`
+	Key     string                 `json:"key"`
+	Data    map[string]interface{} `json:"data"`
+	Changes *graph.NodeChange      `json:"changes,omitempty"`
 }
 
 func (m PlanNodeMessage) Type() string {
@@ -2,19 +2,58 @@ package messagequeue
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/rabbitmq/amqp091-go"
 )
 
+const DefaultConfirmTimeout = 5 * time.Second
+
+var (
+	ErrPublishNacked     = errors.New("message was nacked by the broker")
+	ErrPublishUnroutable = errors.New("message could not be routed to any queue")
+	ErrConfirmTimeout    = errors.New("timed out waiting for the broker confirm")
+)
+
+/*
+Publisher publishes persistent messages in confirm mode with mandatory routing.
+PublishMessage returns only after the broker has confirmed the message, so a nil error
+means the message is stored in at least one queue.
+*/
 type Publisher struct {
-	channel  *amqp091.Channel
-	exchange string
+	mu             sync.Mutex
+	channel        *amqp091.Channel
+	exchange       string
+	confirmTimeout time.Duration
+	returns        chan amqp091.Return
 }
 
-func NewPublisher(channel *amqp091.Channel, exchange string) (*Publisher, error) {
+/*
+NewPublisher creates a publisher for the exchange, it publishes once a channel is bound
+(see rabbitmq.MQConnection.Attach).
+*/
+func NewPublisher(exchange string, confirmTimeout time.Duration) *Publisher {
+	if confirmTimeout <= 0 {
+		confirmTimeout = DefaultConfirmTimeout
+	}
 
+	return &Publisher{
+		exchange:       exchange,
+		confirmTimeout: confirmTimeout,
+	}
+}
+
+/*
+Bind declares the exchange on the channel, puts it in confirm mode and publishes through it from now on.
+*/
+func (p *Publisher) Bind(channel *amqp091.Channel) error {
 	if err := channel.ExchangeDeclare(
-		exchange,
+		p.exchange,
 		"direct",
 		true,
 		false,
@@ -22,13 +61,18 @@ func NewPublisher(channel *amqp091.Channel, exchange string) (*Publisher, error)
 		false,
 		nil,
 	); err != nil {
-		return nil, err
+		return err
 	}
 
-	return &Publisher{
-		channel:  channel,
-		exchange: exchange,
-	}, nil
+	if err := channel.Confirm(false); err != nil {
+		return fmt.Errorf("failed to enable confirm mode: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.channel = channel
+	p.returns = channel.NotifyReturn(make(chan amqp091.Return, 16))
+	return nil
 }
 
 func (p *Publisher) PublishMessage(ctx context.Context, routingKey string, msg Message) error {
@@ -37,15 +81,70 @@ func (p *Publisher) PublishMessage(ctx context.Context, routingKey string, msg M
 		return err
 	}
 
-	return p.channel.PublishWithContext(
+	messageId, err := newMessageId()
+	if err != nil {
+		return err
+	}
+
+	// publishes are serialized so a basic.return can be matched with the confirm that follows it
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == nil {
+		return amqp091.ErrClosed
+	}
+
+	confirmation, err := p.channel.PublishWithDeferredConfirmWithContext(
 		ctx,
 		p.exchange,
 		routingKey,
-		false,
+		true,
 		false,
 		amqp091.Publishing{
-			ContentType: "application/json",
-			Body:        data,
+			ContentType:  "application/json",
+			DeliveryMode: amqp091.Persistent,
+			MessageId:    messageId,
+			Timestamp:    time.Now(),
+			Body:         data,
 		},
 	)
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, p.confirmTimeout)
+	defer cancel()
+
+	acked, err := confirmation.WaitContext(waitCtx)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrConfirmTimeout, routingKey, err)
+	}
+	if !acked {
+		return fmt.Errorf("%w: %s", ErrPublishNacked, routingKey)
+	}
+
+	// the broker sends basic.return before the ack of an unroutable message
+	for {
+		select {
+		case ret, ok := <-p.returns:
+			if !ok {
+				// the channel is closed, no return can follow; Bind sets up the next one
+				p.returns = nil
+				return nil
+			}
+			if ret.MessageId == messageId {
+				return fmt.Errorf("%w: %s (%d %s)", ErrPublishUnroutable, routingKey, ret.ReplyCode, ret.ReplyText)
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+func newMessageId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -0,0 +1,82 @@
+package messagequeue
+
+import (
+	"errors"
+	"time"
+)
+
+/*
+RetryPolicy controls how often a failed message is redelivered and how long the consumer
+waits in between. The wait of attempt n is InitialBackoff * Multiplier^n, capped by MaxBackoff.
+*/
+type RetryPolicy struct {
+	MaxRetries     int           `mapstructure:"max_retries"`
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+	Multiplier     float64       `mapstructure:"multiplier"`
+	MaxBackoff     time.Duration `mapstructure:"max_backoff"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:     5,
+		InitialBackoff: time.Second,
+		Multiplier:     2,
+		MaxBackoff:     5 * time.Minute,
+	}
+}
+
+/*
+WithDefaults fills the zero fields of the policy from DefaultRetryPolicy.
+*/
+func (p RetryPolicy) WithDefaults() RetryPolicy {
+	defaults := DefaultRetryPolicy()
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = defaults.MaxRetries
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = defaults.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = defaults.Multiplier
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = defaults.MaxBackoff
+	}
+	return p
+}
+
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff)
+	for i := 0; i < attempt; i++ {
+		backoff *= p.Multiplier
+		if backoff >= float64(p.MaxBackoff) {
+			return p.MaxBackoff
+		}
+	}
+	return time.Duration(backoff)
+}
+
+/*
+PermanentError marks a handler failure that will not succeed on redelivery,
+the message is dead-lettered right away instead of being retried.
+*/
+type PermanentError struct {
+	Err error
+}
+
+func NewPermanentError(err error) *PermanentError {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	OutboxPublished = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "outbox_published_total",
+			Help: "Total number of outbox entries published and confirmed by the broker",
+		},
+	)
+
+	OutboxPublishFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "outbox_publish_failures_total",
+			Help: "Total number of failed outbox publishes by reason (nacked, unroutable, confirm_timeout, error)",
+		},
+		[]string{"reason"},
+	)
+
+	OutboxRelayFailing = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_relay_failing",
+			Help: "1 while the last relay pass stopped on a publish failure, 0 once a pass drained the outbox",
+		},
+	)
+)
+
+func RegisterOutbox() {
+	prometheus.MustRegister(OutboxPublished)
+	prometheus.MustRegister(OutboxPublishFailures)
+	prometheus.MustRegister(OutboxRelayFailing)
+}
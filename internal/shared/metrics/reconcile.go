@@ -0,0 +1,51 @@
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	ReconcileDocuments = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "reconcile_documents",
+			Help: "Nodes found in each state (in_sync, missing, stale, orphaned) by the last reconciliation",
+		},
+		[]string{"state"},
+	)
+
+	ReconcileRepairs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reconcile_repairs_total",
+			Help: "Total number of repairs by action (republished, deleted)",
+		},
+		[]string{"action"},
+	)
+
+	ReconcileRunDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "reconcile_run_duration_seconds",
+			Help:    "Duration of reconciliation runs in seconds",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+
+	ReconcileLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "reconcile_last_success_timestamp_seconds",
+			Help: "Unix time of the last reconciliation that completed",
+		},
+	)
+
+	ReconcileFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "reconcile_failures_total",
+			Help: "Total number of reconciliation runs that failed",
+		},
+	)
+)
+
+func RegisterReconcile() {
+	prometheus.MustRegister(ReconcileDocuments)
+	prometheus.MustRegister(ReconcileRepairs)
+	prometheus.MustRegister(ReconcileRunDuration)
+	prometheus.MustRegister(ReconcileLastSuccess)
+	prometheus.MustRegister(ReconcileFailures)
+}